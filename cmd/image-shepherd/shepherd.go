@@ -1,15 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
 
 	"github.com/HackUCF/image-shepherd/internal/client"
 	"github.com/HackUCF/image-shepherd/internal/config"
+	"github.com/HackUCF/image-shepherd/internal/metrics"
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/HackUCF/image-shepherd/pkg/notify"
 	"github.com/HackUCF/image-shepherd/pkg/shepherd"
-	"github.com/gophercloud/gophercloud/v2"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
@@ -23,6 +30,23 @@ var requireProtected = flag.Bool("require-protected", false, "Require matched cu
 var requirePublic = flag.Bool("require-public", false, "Require matched current image to be public")
 var uploadTimeout = flag.Int("upload-timeout", 600, "Timeout for image upload in seconds")
 var downloadTimeout = flag.Int("download-timeout", 600, "Timeout for image download in seconds")
+var concurrency = flag.Int("concurrency", 1, "Number of images to process in parallel")
+var cacheDir = flag.String("cache-dir", "", "Directory to keep downloads in between runs (disabled if empty)")
+var cacheMaxSize = flag.String("cache-max-size", "", "Maximum size of the download cache, e.g. 50G (unlimited if empty)")
+var reportFile = flag.String("report", "", "Write a JSON report of the run to this file (disabled if empty)")
+var failFast = flag.Bool("fail-fast", false, "Stop starting new images after the first failure")
+var interval = flag.Duration("interval", 0, "Keep running and start a new run this long after each one, e.g. 6h (disabled if 0)")
+var metricsListen = flag.String("metrics-listen", "", "Serve Prometheus metrics at /metrics on this address with -interval, e.g. :9150 (disabled if empty)")
+var metricsTextfile = flag.String("metrics-textfile", "", "Write Prometheus metrics to this node_exporter textfile after each run (disabled if empty)")
+
+// Exit codes. Fatal log messages exit with exitTotalFailure, and the flag
+// package exits with exitConfigError on invalid flags.
+const (
+	exitOK             = 0
+	exitTotalFailure   = 1
+	exitConfigError    = 2
+	exitPartialFailure = 3
+)
 
 func initLogging() {
 	z := zap.NewDevelopmentConfig()
@@ -51,20 +75,307 @@ func initLogging() {
 	defer logger.Sync() //nolint:errcheck
 }
 
+// parseArgs splits an optional subcommand from the flags, so
+// `image-shepherd -verbose`, `image-shepherd plan -verbose` and
+// `image-shepherd -verbose plan` all work. Any other argument is an error,
+// so that a misplaced command never turns into a run.
+func parseArgs() string {
+	args := os.Args[1:]
+	command := ""
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command = args[0]
+		args = args[1:]
+	}
+	_ = flag.CommandLine.Parse(args)
+	if command == "" && flag.NArg() > 0 {
+		// The flag package stops at the first non-flag argument
+		command = flag.Arg(0)
+		_ = flag.CommandLine.Parse(flag.Args()[1:])
+	}
+	if command == "" {
+		command = "run"
+	}
+
+	switch command {
+	case "run", "plan", "validate", "schema", "render":
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q (expected run, plan, validate, schema or render)\n", command)
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	if flag.NArg() > 0 {
+		fmt.Fprintf(os.Stderr, "Unexpected arguments after the %s command: %s\n", command, strings.Join(flag.Args(), " "))
+		flag.Usage()
+		os.Exit(exitConfigError)
+	}
+	return command
+}
+
+// configError logs an invalid configuration or option and exits with
+// exitConfigError.
+func configError(msg string, keysAndValues ...interface{}) {
+	zap.S().Errorw(msg, keysAndValues...)
+	_ = zap.L().Sync()
+	os.Exit(exitConfigError)
+}
+
+// exitCode returns the exit code for the status of a finished run.
+func exitCode(status shepherd.Status) int {
+	switch status {
+	case shepherd.StatusSuccess:
+		return exitOK
+	case shepherd.StatusPartialFailure:
+		return exitPartialFailure
+	}
+	return exitTotalFailure
+}
+
+// printProblems writes configuration problems to stderr, one per line.
+func printProblems(problems []config.Problem) {
+	for _, p := range problems {
+		fmt.Fprintln(os.Stderr, p)
+	}
+}
+
+// validate checks a configuration file without connecting to any cloud and
+// returns the exit code: exitConfigError if it has errors, exitOK otherwise.
+func validate(path string) int {
+	problems, err := config.Validate(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return exitConfigError
+	}
+	printProblems(problems)
+
+	errs := 0
+	for _, p := range problems {
+		if !p.Warning {
+			errs++
+		}
+	}
+	if errs > 0 {
+		fmt.Fprintf(os.Stderr, "%s: %d error(s), %d warning(s)\n", path, errs, len(problems)-errs)
+		return exitConfigError
+	}
+	fmt.Printf("%s is valid (%d warning(s))\n", path, len(problems))
+	return exitOK
+}
+
+// render prints the images of a configuration file the way a run sees them
+// and returns the exit code.
+func render(path string) int {
+	c, err := config.Load(path)
+	var invalid *config.ValidationError
+	if errors.As(err, &invalid) {
+		printProblems(invalid.Problems)
+		fmt.Fprintf(os.Stderr, "%s: %d error(s)\n", path, len(invalid.Problems))
+		return exitConfigError
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", path, err)
+		return exitConfigError
+	}
+	out, err := config.Render(c)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error rendering configuration: %s\n", err)
+		return exitTotalFailure
+	}
+	fmt.Print(string(out))
+	return exitOK
+}
+
+// newClients creates the clients of every target that doesn't have them yet,
+// including the compute and block storage clients of the targets in
+// retention. A target whose image client can't be created is left out, so
+// that only the images published to it fail, and is tried again before the
+// next run.
+func newClients(clients map[image.Target]shepherd.Clients, targets []image.Target, retention map[image.Target]bool) {
+	for _, t := range targets {
+		cl := clients[t]
+		if cl.Image == nil {
+			ic, err := client.NewInRegion(t.Cloud, t.Region)
+			if err != nil {
+				zap.S().Errorw("Failed to create OpenStack client; images published to this target will fail", "target", t.String(), "error", err)
+				continue
+			}
+			cl.Image = ic
+			zap.S().Infow("OpenStack client initialized", "service", "image", "target", t.String())
+		}
+		if retention[t] && (cl.Compute == nil || cl.BlockStorage == nil) {
+			// Without them, retention keeps every superseded image
+			var err error
+			if cl.Compute, err = client.NewCompute(t.Cloud, t.Region); err == nil {
+				cl.BlockStorage, err = client.NewBlockStorage(t.Cloud, t.Region)
+			}
+			if err != nil {
+				zap.S().Errorw("Failed to create OpenStack clients for retention; superseded images will be kept", "target", t.String(), "error", err)
+				cl.Compute, cl.BlockStorage = nil, nil
+			}
+		}
+		clients[t] = cl
+	}
+}
+
+// parseSize parses a byte size with an optional K, M, G or T suffix (powers
+// of 1024). An empty string means zero.
+func parseSize(size string) (int64, error) {
+	v := strings.ToUpper(strings.TrimSpace(size))
+	if v == "" {
+		return 0, nil
+	}
+	v = strings.TrimSuffix(strings.TrimSuffix(v, "B"), "I")
+	mult := int64(1)
+	for i, suffix := range []string{"K", "M", "G", "T"} {
+		if n, ok := strings.CutSuffix(v, suffix); ok {
+			v = n
+			mult = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", size)
+	}
+	return n * mult, nil
+}
+
+// multipleTargets reports whether decisions span more than one target, in
+// which case the summaries include a target column.
+func multipleTargets(decisions []shepherd.Decision) bool {
+	for _, d := range decisions {
+		if d.Target != decisions[0].Target {
+			return true
+		}
+	}
+	return false
+}
+
+// imageColumn names the image a line of a summary is about, including the
+// target when there is more than one.
+func imageColumn(d shepherd.Decision, withTarget bool) string {
+	if withTarget {
+		return fmt.Sprintf("%s\t%s", d.Name, d.Target)
+	}
+	return d.Name
+}
+
+// printPlan writes one line per image and target describing what a run would do.
+func printPlan(decisions []shepherd.Decision) {
+	fmt.Printf("\nPlan for %d image(s):\n", len(decisions))
+	withTarget := multipleTargets(decisions)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if withTarget {
+		fmt.Fprintln(w, "  IMAGE\tTARGET\tDECISION\tREASON")
+	} else {
+		fmt.Fprintln(w, "  IMAGE\tDECISION\tREASON")
+	}
+	counts := map[shepherd.Action]int{}
+	for _, d := range decisions {
+		counts[d.Action]++
+		reason := d.Reason
+		if d.Version != "" {
+			reason = fmt.Sprintf("%s (version %s)", reason, d.Version)
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", imageColumn(d, withTarget), d.Action, reason)
+	}
+	_ = w.Flush()
+	fmt.Printf("\n%d to upload, %d to replace, %d unchanged, %d errors\n",
+		counts[shepherd.ActionUploadNew], counts[shepherd.ActionReplace], counts[shepherd.ActionSkipUnchanged], counts[shepherd.ActionError])
+}
+
+// planStatus returns the status of a plan: a failure if no image could be
+// planned, a partial failure if some images couldn't.
+func planStatus(decisions []shepherd.Decision) shepherd.Status {
+	failed := 0
+	for _, d := range decisions {
+		if d.Action == shepherd.ActionError {
+			failed++
+		}
+	}
+	switch {
+	case failed == 0:
+		return shepherd.StatusSuccess
+	case failed < len(decisions):
+		return shepherd.StatusPartialFailure
+	}
+	return shepherd.StatusFailure
+}
+
+// printSummary writes the outcome of every image on every target once all
+// workers have finished.
+func printSummary(results []shepherd.Result) {
+	fmt.Printf("\nResults for %d image(s):\n", len(results))
+	decisions := make([]shepherd.Decision, len(results))
+	for idx, r := range results {
+		decisions[idx] = r.Decision
+	}
+	withTarget := multipleTargets(decisions)
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	if withTarget {
+		fmt.Fprintln(w, "  IMAGE\tTARGET\tDECISION\tRESULT")
+	} else {
+		fmt.Fprintln(w, "  IMAGE\tDECISION\tRESULT")
+	}
+	for _, r := range results {
+		outcome := "ok"
+		switch r.Outcome() {
+		case shepherd.OutcomeFailed:
+			outcome = fmt.Sprintf("failed: %s", r.Err)
+		case shepherd.OutcomeAborted:
+			outcome = "aborted"
+		case shepherd.OutcomeUnchanged:
+			outcome = "unchanged"
+		}
+		if len(r.Pruned) > 0 {
+			outcome = fmt.Sprintf("%s (pruned %d old version(s))", outcome, len(r.Pruned))
+		}
+		fmt.Fprintf(w, "  %s\t%s\t%s\n", imageColumn(r.Decision, withTarget), r.Action, outcome)
+	}
+	_ = w.Flush()
+	s := shepherd.Summarize(results)
+	fmt.Printf("\n%d uploaded, %d unchanged, %d failed, %d aborted, %d pruned\n", s.Uploaded, s.Unchanged, s.Failed, s.Aborted, s.Pruned)
+}
+
 func main() {
-	flag.Parse()
+	command := parseArgs()
+	switch command {
+	case "validate":
+		initLogging()
+		os.Exit(validate(*configFile))
+	case "render":
+		initLogging()
+		os.Exit(render(*configFile))
+	case "schema":
+		schema, err := json.MarshalIndent(config.Schema(), "", "  ")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error generating schema: %s\n", err)
+			os.Exit(exitTotalFailure)
+		}
+		fmt.Println(string(schema))
+		os.Exit(exitOK)
+	}
 
 	// Early startup message so users see something even at default (warn) log level
-	fmt.Printf("Starting image-shepherd\n  config: %s\n  cloud: %s\n  verbose: %t\n  no-color: %t\n  owner-project-id: %s\n  require-protected: %t\n  require-public: %t\n  upload-timeout: %ds\n  download-timeout: %ds\n", *configFile, *cloudName, *verbose, *noColor, *ownerProjectID, *requireProtected, *requirePublic, *uploadTimeout, *downloadTimeout)
+	fmt.Printf("Starting image-shepherd\n  command: %s\n  config: %s\n  cloud: %s\n  verbose: %t\n  no-color: %t\n  owner-project-id: %s\n  require-protected: %t\n  require-public: %t\n  upload-timeout: %ds\n  download-timeout: %ds\n  concurrency: %d\n  cache-dir: %s\n  cache-max-size: %s\n  report: %s\n  fail-fast: %t\n  interval: %s\n  metrics-listen: %s\n  metrics-textfile: %s\n", command, *configFile, *cloudName, *verbose, *noColor, *ownerProjectID, *requireProtected, *requirePublic, *uploadTimeout, *downloadTimeout, *concurrency, *cacheDir, *cacheMaxSize, *reportFile, *failFast, *interval, *metricsListen, *metricsTextfile)
 
 	initLogging()
-	zap.S().Infow("Startup configuration", "config", *configFile, "cloud", *cloudName, "verbose", *verbose, "no_color", *noColor, "owner_project_id", *ownerProjectID, "require_protected", *requireProtected, "require_public", *requirePublic, "upload_timeout_secs", *uploadTimeout, "download_timeout_secs", *downloadTimeout)
+	zap.S().Infow("Startup configuration", "command", command, "config", *configFile, "cloud", *cloudName, "verbose", *verbose, "no_color", *noColor, "owner_project_id", *ownerProjectID, "require_protected", *requireProtected, "require_public", *requirePublic, "upload_timeout_secs", *uploadTimeout, "download_timeout_secs", *downloadTimeout, "concurrency", *concurrency, "cache_dir", *cacheDir, "cache_max_size", *cacheMaxSize, "report", *reportFile, "fail_fast", *failFast, "interval", interval.String(), "metrics_listen", *metricsListen, "metrics_textfile", *metricsTextfile)
 
-	c := config.Load(*configFile)
+	c, err := config.Load(*configFile)
+	if err != nil {
+		var invalid *config.ValidationError
+		if errors.As(err, &invalid) {
+			printProblems(invalid.Problems)
+			configError("Invalid configuration", "path", *configFile, "errors", len(invalid.Problems), "hint", "fix the errors above; image-shepherd validate checks the configuration without running")
+		}
+		configError("Invalid configuration", "path", *configFile, "error", err)
+	}
 	zap.S().Infow("Loaded images configuration", "path", *configFile, "image_count", len(c.Images))
 
-	var sc *gophercloud.ServiceClient = client.New(*cloudName)
-	zap.S().Infow("OpenStack client initialized", "service", "image", "cloud", *cloudName)
+	// One set of clients per target cloud/region, shared by every image published to it
+	targets := c.ResolveTargets(*cloudName)
+	clients := map[image.Target]shepherd.Clients{}
+	newClients(clients, targets, nil)
 	if *ownerProjectID != "" {
 		_ = os.Setenv("IMAGE_SHEPHERD_OWNER_PROJECT_ID", *ownerProjectID)
 		zap.S().Infow("Applied owner constraint", "owner_project_id", *ownerProjectID)
@@ -87,9 +398,145 @@ func main() {
 	_ = os.Setenv("IMAGE_SHEPHERD_DOWNLOAD_TIMEOUT_SECS", strconv.Itoa(*downloadTimeout))
 	zap.S().Infow("Applied upload timeout", "upload_timeout_secs", *uploadTimeout)
 	zap.S().Infow("Applied download timeout", "download_timeout_secs", *downloadTimeout)
+	if *concurrency < 1 {
+		configError("Invalid concurrency", "concurrency", *concurrency, "hint", "must be at least 1")
+	}
+	_ = os.Setenv("IMAGE_SHEPHERD_CONCURRENCY", strconv.Itoa(*concurrency))
+	zap.S().Infow("Applied concurrency", "concurrency", *concurrency)
+	if *failFast {
+		_ = os.Setenv("IMAGE_SHEPHERD_FAIL_FAST", "true")
+		zap.S().Infow("Applied fail-fast", "fail_fast", true)
+	} else {
+		_ = os.Setenv("IMAGE_SHEPHERD_FAIL_FAST", "false")
+	}
+	if *cacheDir != "" {
+		maxBytes, err := parseSize(*cacheMaxSize)
+		if err != nil {
+			configError("Invalid cache size", "cache_max_size", *cacheMaxSize, "error", err)
+		}
+		_ = os.Setenv("IMAGE_SHEPHERD_CACHE_DIR", *cacheDir)
+		_ = os.Setenv("IMAGE_SHEPHERD_CACHE_MAX_BYTES", strconv.FormatInt(maxBytes, 10))
+		zap.S().Infow("Applied download cache", "cache_dir", *cacheDir, "cache_max_bytes", maxBytes)
+	}
+
+	if command == "plan" {
+		decisions, err := shepherd.Plan(clients, c.Images)
+		if err != nil {
+			zap.S().Fatalw("Failed to plan shepherd run", "error", err)
+		}
+		printPlan(decisions)
+		os.Exit(exitCode(planStatus(decisions)))
+	}
+
+	if *interval < 0 {
+		configError("Invalid interval", "interval", interval.String(), "hint", "must not be negative")
+	}
+	if *metricsListen != "" && *interval == 0 {
+		configError("Metrics can only be served with -interval", "metrics_listen", *metricsListen, "hint", "use -metrics-textfile for single runs")
+	}
+
+	m := metrics.New()
+	if *metricsListen != "" {
+		if err := m.Serve(*metricsListen); err != nil {
+			zap.S().Fatalw("Failed to serve metrics", "metrics_listen", *metricsListen, "error", err)
+		}
+	}
+	for first := true; ; first = false {
+		if !first {
+			c, targets = reloadConfig(c, targets)
+		}
+		newClients(clients, targets, retentionTargets(c))
+		code := runOnce(clients, c, m)
+		if *interval == 0 {
+			_ = zap.L().Sync()
+			os.Exit(code)
+		}
+		if !*verbose {
+			zap.S().Warnw("Waiting for next run", "interval", interval.String(), "next_run", time.Now().Add(*interval).Format(time.RFC3339))
+		}
+		time.Sleep(*interval)
+	}
+}
+
+// outputError logs a file that could not be written after a run. It exits
+// for a single run, but a process started with -interval keeps running, so a
+// transient disk problem doesn't also take down the /metrics listener.
+func outputError(msg string, keysAndValues ...any) {
+	if *interval == 0 {
+		zap.S().Fatalw(msg, keysAndValues...)
+	}
+	zap.S().Errorw(msg, keysAndValues...)
+}
 
+// reloadConfig loads the configuration again before a run in -interval mode,
+// so that changes apply without a restart. If the configuration can no longer
+// be loaded, the previous one is kept.
+func reloadConfig(c config.Config, targets []image.Target) (config.Config, []image.Target) {
+	next, err := config.Load(*configFile)
+	if err != nil {
+		zap.S().Errorw("Failed to reload configuration; keeping the previous one", "path", *configFile, "error", err)
+		return c, targets
+	}
+	zap.S().Infow("Reloaded images configuration", "path", *configFile, "image_count", len(next.Images))
+	return next, next.ResolveTargets(*cloudName)
+}
+
+// retentionTargets returns the targets that images with a retention policy are
+// published to, which need clients to check whether superseded images are
+// still in use.
+func retentionTargets(c config.Config) map[image.Target]bool {
+	retention := map[image.Target]bool{}
+	for _, img := range c.Images {
+		if img.Retention == nil {
+			continue
+		}
+		for _, t := range img.Targets {
+			retention[t] = true
+		}
+	}
+	return retention
+}
+
+// runOnce runs the shepherd over every configured image, prints the summary,
+// writes the report and metrics, sends notifications, and returns the exit
+// code of the run. A report or metrics file that can't be written fails the
+// run, and stops a single run right away.
+func runOnce(clients map[image.Target]shepherd.Clients, c config.Config, m *metrics.Metrics) int {
 	if !*verbose {
-		zap.S().Warnw("Starting shepherd run", "image_count", len(c.Images), "hint", "use -verbose for detailed logs")
+		zap.S().Warnw("Starting shepherd run", "image_count", len(c.Images), "target_count", len(clients), "hint", "use -verbose for detailed logs")
+	}
+	started := time.Now()
+	results, runErr := shepherd.Run(clients, c.Images)
+	finished := time.Now()
+	printSummary(results)
+	status := shepherd.RunStatus(results, runErr)
+	report := shepherd.NewReport(results, started, finished)
+	writeFailed := false
+	if *reportFile != "" {
+		if err := report.WriteFile(*reportFile); err != nil {
+			outputError("Failed to write report", "report", *reportFile, "error", err)
+			status, writeFailed = shepherd.StatusFailure, true
+		} else {
+			zap.S().Infow("Wrote report", "report", *reportFile)
+		}
+	}
+	m.Observe(results, status, started, finished)
+	if *metricsTextfile != "" {
+		if err := m.WriteTextfile(*metricsTextfile); err != nil {
+			outputError("Failed to write metrics", "metrics_textfile", *metricsTextfile, "error", err)
+			writeFailed = true
+		} else {
+			zap.S().Infow("Wrote metrics", "metrics_textfile", *metricsTextfile)
+		}
+	}
+	notify.Send(c.Notifications, notify.NewMessage(report, status))
+
+	code := exitCode(status)
+	if writeFailed {
+		code = exitTotalFailure
+	}
+	if runErr != nil {
+		zap.S().Errorw("Shepherd run failed", "exit_code", code, "error", runErr)
 	}
-	shepherd.Run(sc, c.Images)
+	return code
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/HackUCF/image-shepherd/pkg/shepherd"
+)
+
+func TestExitCode(t *testing.T) {
+	tests := []struct {
+		status shepherd.Status
+		want   int
+	}{
+		{shepherd.StatusSuccess, 0},
+		{shepherd.StatusFailure, 1},
+		{shepherd.StatusPartialFailure, 3},
+	}
+	for _, tt := range tests {
+		if got := exitCode(tt.status); got != tt.want {
+			t.Errorf("exitCode(%s) = %d, want %d", tt.status, got, tt.want)
+		}
+	}
+}
+
+func TestPlanStatus(t *testing.T) {
+	upload := shepherd.Decision{Action: shepherd.ActionUploadNew}
+	unchanged := shepherd.Decision{Action: shepherd.ActionSkipUnchanged}
+	failed := shepherd.Decision{Action: shepherd.ActionError}
+	tests := []struct {
+		name      string
+		decisions []shepherd.Decision
+		want      shepherd.Status
+	}{
+		{"no errors", []shepherd.Decision{upload, unchanged}, shepherd.StatusSuccess},
+		{"no images", nil, shepherd.StatusSuccess},
+		{"some errors", []shepherd.Decision{upload, failed}, shepherd.StatusPartialFailure},
+		{"only errors", []shepherd.Decision{failed, failed}, shepherd.StatusFailure},
+	}
+	for _, tt := range tests {
+		if got := planStatus(tt.decisions); got != tt.want {
+			t.Errorf("planStatus(%s) = %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
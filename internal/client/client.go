@@ -2,6 +2,9 @@ package client
 
 import (
 	"context"
+	"fmt"
+	"io"
+	"net/http"
 	"time"
 
 	"github.com/gophercloud/gophercloud/v2"
@@ -12,25 +15,98 @@ import (
 // New creates and returns an OpenStack Image (Glance) service client using
 // gophercloud/v2 and utils/v2. It uses a context with timeout to avoid hanging.
 // The cloudName should match an entry in your clouds.yaml.
-func New(cloudName string) *gophercloud.ServiceClient {
-	zap.S().Infow("Initializing OpenStack image client", "cloud", cloudName)
+func New(cloudName string) (*gophercloud.ServiceClient, error) {
+	return NewInRegion(cloudName, "")
+}
+
+// NewInRegion is like New, but uses the given region instead of the one
+// configured for the cloud in clouds.yaml. An empty region keeps the
+// configured one.
+func NewInRegion(cloudName string, region string) (*gophercloud.ServiceClient, error) {
+	return newServiceClient(cloudName, region, "image")
+}
+
+// NewCompute creates and returns an OpenStack Compute (Nova) service client for
+// the named cloud and region. It is used to check whether images are still used
+// by servers.
+func NewCompute(cloudName string, region string) (*gophercloud.ServiceClient, error) {
+	return newServiceClient(cloudName, region, "compute")
+}
+
+// NewBlockStorage creates and returns an OpenStack Block Storage (Cinder)
+// service client for the named cloud and region. It is used to check whether
+// images are still used by volumes.
+func NewBlockStorage(cloudName string, region string) (*gophercloud.ServiceClient, error) {
+	return newServiceClient(cloudName, region, "volume")
+}
+
+// newServiceClient authenticates and creates a client for a service. It fails
+// if the cloud can't be reached or the credentials are rejected, which only
+// affects the images published to that cloud and region.
+func newServiceClient(cloudName string, region string, service string) (*gophercloud.ServiceClient, error) {
+	zap.S().Infow("Initializing OpenStack client", "cloud", cloudName, "region", region, "service", service)
 
 	opts := &clientconfig.ClientOpts{
-		Cloud: cloudName,
+		Cloud:      cloudName,
+		RegionName: region,
 	}
 
 	// Use a bounded context to avoid indefinite hangs during auth or discovery
 	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
 	defer cancel()
 
-	c, err := clientconfig.NewServiceClient(ctx, "image", opts)
+	c, err := clientconfig.NewServiceClient(ctx, service, opts)
 	if err != nil {
-		zap.S().Fatalw("Failed to create glance client", "cloud", cloudName, "error", err)
+		return nil, fmt.Errorf("create %s client for cloud %s: %w", service, cloudName, err)
 	}
 
-	// Apply an HTTP client timeout for subsequent API calls
-	c.HTTPClient.Timeout = 60 * time.Second
-	zap.S().Infow("OpenStack image client initialized", "cloud", cloudName, "http_timeout_seconds", 60)
+	// Bound subsequent API calls through their context rather than with
+	// HTTPClient.Timeout, so that an upload can take longer by passing a
+	// context with a later deadline
+	base := c.HTTPClient.Transport
+	if base == nil {
+		base = http.DefaultTransport
+	}
+	c.HTTPClient.Timeout = 0
+	c.HTTPClient.Transport = timeoutTransport{base: base, timeout: requestTimeout}
+	zap.S().Infow("OpenStack client initialized", "cloud", cloudName, "region", region, "service", service, "http_timeout_seconds", int(requestTimeout/time.Second))
+
+	return c, nil
+}
+
+// requestTimeout bounds API calls whose context has no deadline.
+const requestTimeout = 60 * time.Second
+
+// timeoutTransport gives requests without a deadline one timeout from now,
+// which covers reading the response body.
+type timeoutTransport struct {
+	base    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t timeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if _, ok := req.Context().Deadline(); ok {
+		return t.base.RoundTrip(req)
+	}
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.base.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request once its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
 
-	return c
+func (b cancelOnClose) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
 }
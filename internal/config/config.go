@@ -1,31 +1,106 @@
 package config
 
 import (
-	"os"
+	"slices"
 
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 
 	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/HackUCF/image-shepherd/pkg/notify"
 )
 
+// Config is the contents of images.yaml.
 type Config struct {
-	Images           []image.Image
+	// Images are the images to manage.
+	Images []image.Image
+	// ImageTemplates expand into more images.
+	ImageTemplates []ImageTemplate `yaml:"image_templates,omitempty"`
+	// Defaults are inherited by every image.
+	Defaults Defaults `yaml:"defaults,omitempty"`
+	// Include lists more files to load images from, as paths or glob
+	// patterns relative to this file such as images.d/*.yaml. Included files
+	// may only contain images and includes.
+	Include []string `yaml:"include,omitempty"`
+	// OwnerProjectID and RequireProtected are accepted but not used. The
+	// -owner-project-id and -require-protected options are.
 	OwnerProjectID   string `yaml:"owner_project_id,omitempty"`
 	RequireProtected bool   `yaml:"require_protected,omitempty"`
+	// Retention is the retention policy for images that don't set their own.
+	Retention *image.Retention `yaml:"retention,omitempty"`
+	// Targets are the clouds and regions that images without their own
+	// targets are published to.
+	Targets []image.Target `yaml:"targets,omitempty"`
+	// TargetFormat and TargetCompressed apply to images that don't set their
+	// own target_format.
+	TargetFormat     string `yaml:"target_format,omitempty"`
+	TargetCompressed bool   `yaml:"target_compressed,omitempty"`
+	// Notifications are sent at the end of each run.
+	Notifications []notify.Notification `yaml:"notifications,omitempty"`
 }
 
-func Load(path string) Config {
-	f, err := os.ReadFile(path)
+// Load reads and validates the images configuration file at path. Warnings
+// are logged, and errors are returned as a *ValidationError.
+func Load(path string) (Config, error) {
+	c, problems, err := parse(path)
 	if err != nil {
-		zap.S().Fatalf("Failed to read config file: %s", err)
+		return Config{}, err
+	}
+	var errs []Problem
+	for _, p := range problems {
+		if p.Warning {
+			zap.S().Warnw("Configuration warning", "file", p.File, "line", p.Line, "column", p.Column, "warning", p.Message)
+			continue
+		}
+		errs = append(errs, p)
+	}
+	if len(errs) > 0 {
+		return Config{}, &ValidationError{Problems: errs}
 	}
 
-	var c Config
-	err = yaml.Unmarshal(f, &c)
-	if err != nil {
-		zap.S().Fatalf("Failed to parse YAML: %s", err)
+	// Images without their own retention policy or targets inherit the global ones
+	for idx := range c.Images {
+		if c.Images[idx].Retention == nil {
+			c.Images[idx].Retention = c.Retention
+		}
+		if len(c.Images[idx].Targets) == 0 {
+			c.Images[idx].Targets = c.Targets
+		}
+		if c.Images[idx].TargetFormat == "" {
+			c.Images[idx].TargetFormat = c.TargetFormat
+			c.Images[idx].TargetCompressed = c.Images[idx].TargetCompressed || c.TargetCompressed
+		}
 	}
 
-	return c
+	return c, nil
+}
+
+// ResolveTargets publishes images without any targets to defaultCloud, fills
+// in defaultCloud for targets that only name a region, and returns every
+// distinct target in the order they first appear.
+func (c *Config) ResolveTargets(defaultCloud string) []image.Target {
+	var all []image.Target
+	seen := map[image.Target]bool{}
+	for idx := range c.Images {
+		img := &c.Images[idx]
+		if len(img.Targets) == 0 {
+			img.Targets = []image.Target{{}}
+		}
+		// Targets may be shared with the global list, so never modify them in place
+		targets := make([]image.Target, 0, len(img.Targets))
+		for _, t := range img.Targets {
+			if t.Cloud == "" {
+				t.Cloud = defaultCloud
+			}
+			if slices.Contains(targets, t) {
+				continue
+			}
+			targets = append(targets, t)
+			if !seen[t] {
+				seen[t] = true
+				all = append(all, t)
+			}
+		}
+		img.Targets = targets
+	}
+	return all
 }
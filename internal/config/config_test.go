@@ -0,0 +1,123 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestGolden loads the images.yaml of each directory in testdata. The
+// problems found in it are compared with problems.golden, and a configuration
+// without errors is rendered and compared with render.golden. Run the tests
+// with -update to rewrite the golden files after an intended change.
+func TestGolden(t *testing.T) {
+	dirs, err := filepath.Glob(filepath.Join("testdata", "*", "images.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dirs) == 0 {
+		t.Fatal("no test configurations in testdata")
+	}
+	for _, path := range dirs {
+		dir := filepath.Dir(path)
+		t.Run(filepath.Base(dir), func(t *testing.T) {
+			problems, err := Validate(path)
+			if err != nil {
+				t.Fatalf("Validate() error = %v", err)
+			}
+			var b strings.Builder
+			valid := true
+			for _, p := range problems {
+				b.WriteString(p.String() + "\n")
+				valid = valid && p.Warning
+			}
+			golden(t, filepath.Join(dir, "problems.golden"), []byte(b.String()))
+
+			renderGolden := filepath.Join(dir, "render.golden")
+			if !valid {
+				if _, err := os.Stat(renderGolden); err == nil {
+					t.Errorf("%s has errors but a %s", path, renderGolden)
+				}
+				return
+			}
+			c, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			rendered, err := Render(c)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			golden(t, renderGolden, rendered)
+		})
+	}
+}
+
+// golden compares got with the contents of a golden file, or rewrites the file
+// with -update.
+func golden(t *testing.T, path string, got []byte) {
+	t.Helper()
+	if *update {
+		if err := os.WriteFile(path, got, 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%s (run the tests with -update to create it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("output differs from %s (run the tests with -update to accept it):\n--- got\n%s--- want\n%s", path, got, want)
+	}
+}
+
+// TestRenderIsValid checks that rendered configurations load again as the
+// same images, so the output of the render command can be used as a
+// configuration file.
+func TestRenderIsValid(t *testing.T) {
+	for _, name := range []string{"defaults", "matrix"} {
+		t.Run(name, func(t *testing.T) {
+			c, err := Load(filepath.Join("testdata", name, "images.yaml"))
+			if err != nil {
+				t.Fatalf("Load() error = %v", err)
+			}
+			rendered, err := Render(c)
+			if err != nil {
+				t.Fatalf("Render() error = %v", err)
+			}
+			path := filepath.Join(t.TempDir(), "images.yaml")
+			if err := os.WriteFile(path, rendered, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			again, err := Load(path)
+			if err != nil {
+				t.Fatalf("Load() of the rendered configuration error = %v", err)
+			}
+
+			// Only the files the images came from differ
+			for idx := range c.Images {
+				c.Images[idx].ConfigFile = ""
+			}
+			for idx := range again.Images {
+				again.Images[idx].ConfigFile = ""
+			}
+			want, err := Render(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := Render(again)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("rendered configuration renders differently:\n--- got\n%s--- want\n%s", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package config
+
+import (
+	"maps"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+)
+
+// Defaults are settings inherited by every image that doesn't set them itself.
+type Defaults struct {
+	// Public and Protected apply to images that don't set public or
+	// protected.
+	Public    bool `yaml:"public,omitempty"`
+	Protected bool `yaml:"protected,omitempty"`
+	// Tags are added to the tags of every image. An image removes an
+	// inherited tag by listing it with a leading "-", like "-official".
+	Tags []string `yaml:"tags,omitempty"`
+	// Properties are added to the properties of every image. An image
+	// overrides an inherited property by setting it, and removes it by
+	// setting it to null.
+	Properties map[string]string `yaml:"properties,omitempty"`
+	// Compression applies to images that don't set compression.
+	Compression string `yaml:"compression,omitempty"`
+	// DownloadTimeout and UploadTimeout apply to images that don't set their
+	// own.
+	DownloadTimeout int `yaml:"download_timeout,omitempty"`
+	UploadTimeout   int `yaml:"upload_timeout,omitempty"`
+}
+
+// inherit merges the defaults into an image configured at n. Whether the
+// image sets a value itself is decided from n, so that an image can override
+// an inherited true with false.
+func (v *validator) inherit(img *image.Image, n *yaml.Node, d Defaults) {
+	if field(n, "public") == nil {
+		img.Public = d.Public
+	}
+	if field(n, "protected") == nil {
+		img.Protected = d.Protected
+	}
+	if field(n, "compression") == nil {
+		img.Compression = d.Compression
+	}
+	if field(n, "download_timeout") == nil {
+		img.DownloadTimeout = d.DownloadTimeout
+	}
+	if field(n, "upload_timeout") == nil {
+		img.UploadTimeout = d.UploadTimeout
+	}
+
+	// Tags with a leading "-" remove inherited tags instead of adding one
+	removed := map[string]bool{}
+	var own []string
+	for idx, tag := range img.Tags {
+		name, ok := strings.CutPrefix(tag, "-")
+		if !ok {
+			own = append(own, tag)
+			continue
+		}
+		if !slices.Contains(d.Tags, name) {
+			v.warnf(item(field(n, "tags"), idx), "tag %q removes no inherited tag", tag)
+		}
+		removed[name] = true
+	}
+	var tags []string
+	for _, tag := range append(slices.Clone(d.Tags), own...) {
+		if !removed[tag] && !slices.Contains(tags, tag) {
+			tags = append(tags, tag)
+		}
+	}
+	img.Tags = tags
+
+	// Properties set to null remove inherited properties
+	properties := maps.Clone(d.Properties)
+	ownProperties := field(n, "properties")
+	for key, val := range img.Properties {
+		if p := field(ownProperties, key); p != nil && p.ShortTag() == "!!null" {
+			if _, ok := d.Properties[key]; !ok {
+				v.warnf(p, "null property %q removes no inherited property", key)
+			}
+			delete(properties, key)
+			continue
+		}
+		if properties == nil {
+			properties = map[string]string{}
+		}
+		properties[key] = val
+	}
+	img.Properties = properties
+}
+
+// field returns the value of key in the mapping n like value, but also finds
+// values merged into n with <<.
+func field(n *yaml.Node, key string) *yaml.Node {
+	if n != nil && n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if v := value(n, key); v != nil {
+		return v
+	}
+	merged := value(n, "<<")
+	if merged == nil {
+		return nil
+	}
+	if merged.Kind == yaml.AliasNode {
+		merged = merged.Alias
+	}
+	sources := []*yaml.Node{merged}
+	if merged.Kind == yaml.SequenceNode {
+		sources = merged.Content
+	}
+	for _, s := range sources {
+		if v := field(s, key); v != nil {
+			return v
+		}
+	}
+	return nil
+}
@@ -0,0 +1,34 @@
+package config
+
+import (
+	"bytes"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+// TestDocsUpToDate regenerates the schema descriptions and compares them with
+// docs.go, so a changed doc comment can't be merged without running go
+// generate.
+func TestDocsUpToDate(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs go run")
+	}
+	generated := filepath.Join(t.TempDir(), "docs.go")
+	out, err := exec.Command("go", "run", "./gendocs", "-o", generated).CombinedOutput()
+	if err != nil {
+		t.Fatalf("go run ./gendocs: %v\n%s", err, out)
+	}
+	got, err := os.ReadFile(generated)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile("docs.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("docs.go is out of date; run go generate ./internal/config")
+	}
+}
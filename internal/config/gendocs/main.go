@@ -0,0 +1,150 @@
+// Command gendocs extracts the doc comments of the configuration types into
+// docs.go in the current directory, where Schema uses them as descriptions.
+// It is run by go generate in internal/config. With -o, it writes them to
+// another file instead, which the tests use to check that docs.go is up to
+// date.
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"log"
+	"os"
+	"sort"
+	"strings"
+)
+
+const module = "github.com/HackUCF/image-shepherd"
+
+// packages are the packages with configuration types, relative to
+// internal/config.
+var packages = map[string]string{
+	".":                module + "/internal/config",
+	"../../pkg/image":  module + "/pkg/image",
+	"../../pkg/notify": module + "/pkg/notify",
+}
+
+var output = flag.String("o", "docs.go", "file to write the docs to")
+
+func main() {
+	flag.Parse()
+	docs := map[string]string{}
+	for dir, importPath := range packages {
+		if err := collect(dir, importPath, docs); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	keys := make([]string, 0, len(docs))
+	for k := range docs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	buf.WriteString("// Code generated by gendocs. DO NOT EDIT.\n\npackage config\n\n")
+	buf.WriteString("// docs are the doc comments of the configuration types and their fields,\n")
+	buf.WriteString("// keyed by import path, type and field, as in \"path/pkg.Type.Field\".\n")
+	buf.WriteString("var docs = map[string]string{\n")
+	for _, k := range keys {
+		fmt.Fprintf(&buf, "\t%q: %q,\n", k, docs[k])
+	}
+	buf.WriteString("}\n")
+
+	src, err := format.Source(buf.Bytes())
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.WriteFile(*output, src, 0o644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// collect adds the docs of every exported struct type in dir that has fields
+// with yaml tags, which are the ones that can appear in a configuration file.
+func collect(dir string, importPath string, docs map[string]string) error {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, dir, func(fi os.FileInfo) bool {
+		return !strings.HasSuffix(fi.Name(), "_test.go") && fi.Name() != "docs.go"
+	}, parser.ParseComments)
+	if err != nil {
+		return err
+	}
+	for _, pkg := range pkgs {
+		if pkg.Name == "main" {
+			continue
+		}
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				gen, ok := decl.(*ast.GenDecl)
+				if !ok || gen.Tok != token.TYPE {
+					continue
+				}
+				for _, spec := range gen.Specs {
+					ts := spec.(*ast.TypeSpec)
+					st, ok := ts.Type.(*ast.StructType)
+					if !ok || !ts.Name.IsExported() || !hasYAMLTags(st) {
+						continue
+					}
+					typeDoc := ts.Doc
+					if typeDoc == nil {
+						typeDoc = gen.Doc
+					}
+					prefix := importPath + "." + ts.Name.Name
+					if text := clean(typeDoc.Text()); text != "" {
+						docs[prefix] = text
+					}
+					collectFields(st, prefix, docs)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// collectFields adds the docs of the exported fields of a struct. A field
+// without a comment of its own shares the comment of the fields before it if
+// that comment names it, as in "Room and Token are ...".
+func collectFields(st *ast.StructType, prefix string, docs map[string]string) {
+	shared := ""
+	for _, f := range st.Fields.List {
+		text := clean(f.Doc.Text())
+		if text == "" {
+			text = clean(f.Comment.Text())
+		}
+		if text != "" {
+			shared = text
+		}
+		for _, name := range f.Names {
+			if !name.IsExported() {
+				continue
+			}
+			switch {
+			case text != "":
+				docs[prefix+"."+name.Name] = text
+			case strings.Contains(shared, name.Name):
+				docs[prefix+"."+name.Name] = shared
+			}
+		}
+	}
+}
+
+// hasYAMLTags reports whether any field of a struct has a yaml tag.
+func hasYAMLTags(st *ast.StructType) bool {
+	for _, f := range st.Fields.List {
+		if f.Tag != nil && strings.Contains(f.Tag.Value, `yaml:"`) {
+			return true
+		}
+	}
+	return false
+}
+
+// clean joins the lines of a comment into a single line.
+func clean(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
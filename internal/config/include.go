@@ -0,0 +1,208 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+)
+
+// loader loads a configuration file along with the files it includes.
+type loader struct {
+	// files are the validators of the loaded files, in load order.
+	files []*validator
+	// loaded holds the absolute paths of the loaded files.
+	loaded map[string]bool
+	// images are the images of every file, in load order.
+	images []loadedImage
+}
+
+// loadedImage is an image along with where it was configured.
+type loadedImage struct {
+	image.Image
+	v    *validator
+	node *yaml.Node
+}
+
+// read reads and parses a YAML file, returning a nil node for an empty file.
+func (l *loader) read(path string) (*yaml.Node, error) {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	l.loaded[abs] = true
+
+	f, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var doc yaml.Node
+	if err := yaml.Unmarshal(f, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse YAML: %w", err)
+	}
+	if len(doc.Content) == 0 {
+		return nil, nil
+	}
+	return doc.Content[0], nil
+}
+
+// validator starts collecting the problems of a file.
+func (l *loader) validator(path string) *validator {
+	v := &validator{file: path}
+	l.files = append(l.files, v)
+	return v
+}
+
+// addImages records the images of a file, which is the main configuration
+// file or an included one, followed by the images expanded from its
+// templates.
+func (l *loader) addImages(v *validator, root *yaml.Node, c Config) {
+	list := value(root, "images")
+	for idx, img := range c.Images {
+		l.addImage(v, or(item(list, idx), list), img)
+	}
+	l.expandTemplates(v, root, c.ImageTemplates)
+}
+
+// addImage records an image configured at n.
+func (l *loader) addImage(v *validator, n *yaml.Node, img image.Image) {
+	img.ConfigFile = v.file
+	l.images = append(l.images, loadedImage{Image: img, v: v, node: n})
+}
+
+// include loads the files matching the include patterns of a file. Patterns
+// are relative to the directory of the file. A file matched more than once is
+// only loaded the first time, which also stops include cycles.
+func (l *loader) include(v *validator, root *yaml.Node, patterns []string) {
+	list := value(root, "include")
+	for idx, pattern := range patterns {
+		n := or(item(list, idx), list)
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(v.file), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		switch {
+		case err != nil:
+			v.errorf(n, "invalid include pattern %q: %s", patterns[idx], err)
+			continue
+		case len(matches) == 0 && !strings.ContainsAny(pattern, `*?[`):
+			v.errorf(n, "included file %s does not exist", pattern)
+			continue
+		case len(matches) == 0:
+			v.warnf(n, "include pattern %q matches no files", patterns[idx])
+			continue
+		}
+		for _, match := range matches {
+			if abs, err := filepath.Abs(match); err == nil && l.loaded[abs] {
+				continue
+			}
+			l.fragment(v, n, match)
+		}
+	}
+}
+
+// fragment loads an included file, which may only contain images, image
+// templates and more includes.
+func (l *loader) fragment(parent *validator, n *yaml.Node, path string) {
+	root, err := l.read(path)
+	if err != nil {
+		parent.errorf(n, "failed to include %s: %s", path, err)
+		return
+	}
+	if root == nil {
+		return
+	}
+
+	v := l.validator(path)
+	var c Config
+	if err := v.decode(root, &c); err != nil {
+		parent.errorf(n, "failed to include %s: %s", path, err)
+		return
+	}
+	if root.Kind == yaml.MappingNode {
+		fields := yamlFields(reflect.TypeOf(c))
+		for idx := 0; idx+1 < len(root.Content); idx += 2 {
+			key := root.Content[idx]
+			if _, ok := fields[key.Value]; ok && key.Value != "images" && key.Value != "image_templates" && key.Value != "include" {
+				v.errorf(key, "%s can only be set in the main configuration file", key.Value)
+			}
+		}
+	}
+	l.addImages(v, root, c)
+	l.include(v, root, c.Include)
+}
+
+// checkDuplicates reports images published to the same target under the same
+// name, or matching the same os_distro/os_version/os_type properties, since
+// they would keep replacing each other.
+func (l *loader) checkDuplicates(c Config) {
+	names := map[string][]loadedImage{}
+	tuples := map[string][]loadedImage{}
+	for _, li := range l.images {
+		overlaps := func(other loadedImage) bool {
+			return slices.ContainsFunc(effectiveTargets(li.Image, c), func(t image.Target) bool {
+				return slices.Contains(effectiveTargets(other.Image, c), t)
+			})
+		}
+
+		if li.Name != "" {
+			if idx := slices.IndexFunc(names[li.Name], overlaps); idx >= 0 {
+				if other := names[li.Name][idx]; li.sameTemplate(other) {
+					li.v.errorf(or(value(li.node, "name"), li.node), "image template expands to the name %q more than once", li.Name)
+				} else {
+					li.v.errorf(or(value(li.node, "name"), li.node), "duplicate image name %q (also at %s)", li.Name, li.position(other))
+				}
+			}
+			names[li.Name] = append(names[li.Name], li)
+		}
+
+		distro, version, osType := li.Properties["os_distro"], li.Properties["os_version"], li.Properties["os_type"]
+		if distro == "" || version == "" || osType == "" {
+			continue
+		}
+		tuple := distro + "/" + version + "/" + osType
+		if idx := slices.IndexFunc(tuples[tuple], overlaps); idx >= 0 {
+			other := tuples[tuple][idx]
+			li.v.errorf(or(value(li.node, "properties"), li.node), "os_distro/os_version/os_type %s is also used by image %q at %s", tuple, other.Name, li.position(other))
+		}
+		tuples[tuple] = append(tuples[tuple], li)
+	}
+}
+
+// position describes where another image was configured, relative to this
+// one.
+func (li loadedImage) position(other loadedImage) string {
+	line := 0
+	if other.node != nil {
+		line = other.node.Line
+	}
+	if other.v == li.v {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", other.v.file, line)
+}
+
+// sameTemplate reports whether both images were expanded from the same image
+// template, whose expansions share its position.
+func (li loadedImage) sameTemplate(other loadedImage) bool {
+	return li.v == other.v && li.node != nil && other.node != nil &&
+		li.node.Line == other.node.Line && li.node.Column == other.node.Column
+}
+
+// effectiveTargets returns the targets an image is published to, with the
+// default target standing for the cloud selected on the command line.
+func effectiveTargets(img image.Image, c Config) []image.Target {
+	if len(img.Targets) > 0 {
+		return img.Targets
+	}
+	if len(c.Targets) > 0 {
+		return c.Targets
+	}
+	return []image.Target{{}}
+}
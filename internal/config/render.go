@@ -0,0 +1,44 @@
+package config
+
+import (
+	"bytes"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+)
+
+// Render returns the images of a loaded configuration as YAML, the way a run
+// sees them: with included files loaded, templates expanded, and defaults and
+// global settings applied. Each image is preceded by a comment naming the file
+// it came from.
+func Render(c Config) ([]byte, error) {
+	images := c.Images
+	if images == nil {
+		images = []image.Image{}
+	}
+	var list yaml.Node
+	if err := list.Encode(images); err != nil {
+		return nil, err
+	}
+	for idx, n := range list.Content {
+		if f := images[idx].ConfigFile; f != "" {
+			n.HeadComment = "from " + f
+		}
+	}
+
+	doc := &yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{
+		{Kind: yaml.ScalarNode, Value: "images"},
+		&list,
+	}}
+	var b bytes.Buffer
+	enc := yaml.NewEncoder(&b)
+	enc.SetIndent(2)
+	if err := enc.Encode(doc); err != nil {
+		return nil, err
+	}
+	if err := enc.Close(); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
@@ -0,0 +1,150 @@
+package config
+
+//go:generate go run ./gendocs
+
+import (
+	"reflect"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/HackUCF/image-shepherd/pkg/notify"
+)
+
+// enums returns the valid values of string fields, and of the items of string
+// list fields, keyed like docs. Every one of them is also accepted in any case
+// and with surrounding spaces, which a JSON Schema enum can't express, so the
+// schema only allows the lower case values and says so in the description.
+func enums() map[string][]string {
+	imagePkg := reflect.TypeOf(image.Image{}).PkgPath()
+	notifyPkg := reflect.TypeOf(notify.Notification{}).PkgPath()
+	configPkg := reflect.TypeOf(Config{}).PkgPath()
+	return map[string][]string{
+		configPkg + ".Config.TargetFormat":  image.TargetFormats,
+		configPkg + ".Defaults.Compression": image.Compressions(),
+		imagePkg + ".Image.SourceFormat":    image.SourceFormats,
+		imagePkg + ".Image.Compression":     image.Compressions(),
+		imagePkg + ".Image.Source":          image.Sources,
+		imagePkg + ".Image.UploadMethod":    image.UploadMethods,
+		imagePkg + ".Image.TargetFormat":    image.TargetFormats,
+		imagePkg + ".Checksum.Algorithm":    image.ChecksumAlgorithms,
+		imagePkg + ".Checksum.Format":       image.ChecksumFormats,
+		notifyPkg + ".Notification.Type":    {notify.TypeWebhook, notify.TypeSlack, notify.TypeMatrix},
+		notifyPkg + ".Notification.On":      {notify.OnChange, notify.OnFailure, notify.OnAlways},
+	}
+}
+
+// knownProperties describes the image properties that Image Shepherd uses or
+// sets by default.
+var knownProperties = map[string]string{
+	"os_distro":       "Distribution, e.g. ubuntu. Images are matched by os_distro, os_version and os_type if all of them are set.",
+	"os_version":      "Distribution version, e.g. \"24.04\". Quote it so it stays a string.",
+	"os_type":         "Operating system type, e.g. linux.",
+	"architecture":    "CPU architecture. Defaults to x86_64.",
+	"hypervisor_type": "Hypervisor type. Defaults to qemu.",
+	"vm_mode":         "Virtual machine mode. Defaults to hvm.",
+	"image_family":    "Family used to find superseded versions of the image. Defaults to the image name.",
+}
+
+// Schema returns a JSON Schema of configuration files, generated from the
+// Config type and the doc comments of its fields. Fields with a yaml tag
+// without omitempty are required.
+func Schema() map[string]any {
+	b := &schemaBuilder{defs: map[string]any{}, enums: enums()}
+	t := reflect.TypeOf(Config{})
+	root := b.object(t)
+	root["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	root["title"] = "image-shepherd configuration"
+	root["$defs"] = b.defs
+	return root
+}
+
+// schemaBuilder builds the schemas of types, collecting struct types other than
+// the root in defs.
+type schemaBuilder struct {
+	defs  map[string]any
+	enums map[string][]string
+}
+
+// object returns the schema of a struct type.
+func (b *schemaBuilder) object(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	for name, f := range yamlFields(t) {
+		key := f.owner.PkgPath() + "." + f.owner.Name() + "." + f.Name
+		s := b.schema(f.Type, b.enums[key])
+		if d := docs[key]; d != "" {
+			s["description"] = d
+		}
+		if len(b.enums[key]) > 0 {
+			note := "Image Shepherd also accepts these values in any case and with surrounding spaces, but the schema only allows them in lower case."
+			if d, ok := s["description"].(string); ok {
+				note = d + " " + note
+			}
+			s["description"] = note
+		}
+		if f.Name == "Properties" {
+			// Images can remove inherited properties by setting them to null
+			var valueType any = "string"
+			if f.owner == reflect.TypeOf(image.Image{}) {
+				valueType = []string{"string", "null"}
+			}
+			known := map[string]any{}
+			for p, d := range knownProperties {
+				known[p] = map[string]any{"type": valueType, "description": d}
+			}
+			s["properties"] = known
+			s["additionalProperties"] = map[string]any{"type": valueType}
+		}
+		properties[name] = s
+		if f.required {
+			required = append(required, name)
+		}
+	}
+
+	s := map[string]any{
+		"type":                 "object",
+		"properties":           properties,
+		"additionalProperties": false,
+	}
+	if d := docs[t.PkgPath()+"."+t.Name()]; d != "" {
+		s["description"] = d
+	}
+	if len(required) > 0 {
+		s["required"] = required
+	}
+	return s
+}
+
+// schema returns the schema of a type, with enum as the valid values of
+// strings.
+func (b *schemaBuilder) schema(t reflect.Type, enum []string) map[string]any {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.String:
+		s := map[string]any{"type": "string"}
+		if len(enum) > 0 {
+			s["enum"] = enum
+		}
+		return s
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]any{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.Slice, reflect.Array:
+		return map[string]any{"type": "array", "items": b.schema(t.Elem(), enum)}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": b.schema(t.Elem(), nil)}
+	case reflect.Struct:
+		if _, ok := b.defs[t.Name()]; !ok {
+			// Reserve the name first, in case the type refers to itself
+			b.defs[t.Name()] = nil
+			b.defs[t.Name()] = b.object(t)
+		}
+		return map[string]any{"$ref": "#/$defs/" + t.Name()}
+	}
+	return map[string]any{}
+}
@@ -0,0 +1,123 @@
+package config
+
+import (
+	"maps"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+)
+
+// ImageTemplate is an image whose string values are Go templates, expanded
+// into one image for each combination of the values of its matrix.
+type ImageTemplate struct {
+	// Matrix maps variable names to their values. Templates refer to the
+	// variables as {{.name}}.
+	Matrix      map[string][]string `yaml:"matrix,omitempty"`
+	image.Image `yaml:",inline"`
+}
+
+// expandTemplates adds the images expanded from the templates of a file.
+func (l *loader) expandTemplates(v *validator, root *yaml.Node, templates []ImageTemplate) {
+	list := value(root, "image_templates")
+	for idx := range templates {
+		l.expand(v, or(item(list, idx), list))
+	}
+}
+
+// expand adds an image for each combination of the values of the matrix of a
+// template. The variables of the first matrix entry change slowest, so
+// images are in the order their variables are listed.
+func (l *loader) expand(v *validator, n *yaml.Node) {
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	if n.Kind != yaml.MappingNode {
+		return
+	}
+
+	combinations := []map[string]string{{}}
+	if matrix := value(n, "matrix"); matrix != nil && matrix.Kind == yaml.MappingNode {
+		for idx := 0; idx+1 < len(matrix.Content); idx += 2 {
+			key := matrix.Content[idx]
+			var values []string
+			if err := matrix.Content[idx+1].Decode(&values); err != nil {
+				// Reported when decoding the configuration
+				return
+			}
+			if len(values) == 0 {
+				v.warnf(key, "matrix variable %q has no values, so no images are expanded", key.Value)
+			}
+			var next []map[string]string
+			for _, vars := range combinations {
+				for _, val := range values {
+					vars := maps.Clone(vars)
+					vars[key.Value] = val
+					next = append(next, vars)
+				}
+			}
+			combinations = next
+		}
+	}
+
+	for _, vars := range combinations {
+		rendered := *n
+		rendered.Content = nil
+		for idx := 0; idx+1 < len(n.Content); idx += 2 {
+			if n.Content[idx].Value == "matrix" {
+				continue
+			}
+			val, ok := v.render(n.Content[idx+1], vars)
+			if !ok {
+				// Stop at the first error, which every combination would repeat
+				return
+			}
+			rendered.Content = append(rendered.Content, n.Content[idx], val)
+		}
+
+		var img image.Image
+		if err := rendered.Decode(&img); err != nil {
+			// Type errors were reported when decoding the template
+			continue
+		}
+		l.addImage(v, &rendered, img)
+	}
+}
+
+// render returns a copy of n with the templates in its scalars executed with
+// vars. It reports template errors and fails on them.
+func (v *validator) render(n *yaml.Node, vars map[string]string) (*yaml.Node, bool) {
+	if n.Kind == yaml.AliasNode {
+		return v.render(n.Alias, vars)
+	}
+	rendered := *n
+	if n.Kind == yaml.ScalarNode {
+		if !strings.Contains(n.Value, "{{") {
+			return &rendered, true
+		}
+		tmpl, err := template.New("value").Option("missingkey=error").Parse(n.Value)
+		if err != nil {
+			v.errorf(n, "invalid template: %s", err)
+			return nil, false
+		}
+		var b strings.Builder
+		if err := tmpl.Execute(&b, vars); err != nil {
+			v.errorf(n, "invalid template: %s", err)
+			return nil, false
+		}
+		rendered.Value = b.String()
+		return &rendered, true
+	}
+
+	rendered.Content = make([]*yaml.Node, len(n.Content))
+	for idx, child := range n.Content {
+		c, ok := v.render(child, vars)
+		if !ok {
+			return nil, false
+		}
+		rendered.Content[idx] = c
+	}
+	return &rendered, true
+}
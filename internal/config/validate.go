@@ -0,0 +1,444 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"net/url"
+	"reflect"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+)
+
+// Problem is an error or a warning at a position in a configuration file.
+type Problem struct {
+	File    string
+	Line    int
+	Column  int
+	Message string
+	// Warning is set for problems that don't make the configuration invalid.
+	Warning bool
+}
+
+// String formats the problem like a compiler message, as file:line:column:
+// message.
+func (p Problem) String() string {
+	pos := p.File
+	if p.Line > 0 {
+		pos += ":" + strconv.Itoa(p.Line)
+		if p.Column > 0 {
+			pos += ":" + strconv.Itoa(p.Column)
+		}
+	}
+	if p.Warning {
+		return fmt.Sprintf("%s: warning: %s", pos, p.Message)
+	}
+	return fmt.Sprintf("%s: %s", pos, p.Message)
+}
+
+// ValidationError is returned by Load for a configuration with errors.
+type ValidationError struct {
+	Problems []Problem
+}
+
+func (e *ValidationError) Error() string {
+	msgs := make([]string, len(e.Problems))
+	for idx, p := range e.Problems {
+		msgs[idx] = p.String()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Validate checks the configuration file at path and returns every error and
+// warning found in it, in file order. It fails only if the file can't be read
+// or isn't YAML at all.
+func Validate(path string) ([]Problem, error) {
+	_, problems, err := parse(path)
+	return problems, err
+}
+
+// parse reads and decodes a configuration file and the files it includes,
+// collecting every problem with them.
+func parse(path string) (Config, []Problem, error) {
+	l := &loader{loaded: map[string]bool{}}
+	root, err := l.read(path)
+	if err != nil || root == nil {
+		return Config{}, nil, err
+	}
+
+	v := l.validator(path)
+	var c Config
+	if err := v.decode(root, &c); err != nil {
+		return Config{}, nil, err
+	}
+	v.check(root, c)
+	l.addImages(v, root, c)
+	l.include(v, root, c.Include)
+
+	c.Images = make([]image.Image, len(l.images))
+	for idx := range l.images {
+		li := &l.images[idx]
+		li.v.checkImage(li.node, li.Image, c)
+		li.v.inherit(&li.Image, li.node, c.Defaults)
+		c.Images[idx] = li.Image
+	}
+	l.checkDuplicates(c)
+
+	var problems []Problem
+	for _, v := range l.files {
+		sort.SliceStable(v.problems, func(a, b int) bool {
+			pa, pb := v.problems[a], v.problems[b]
+			return pa.Line < pb.Line || (pa.Line == pb.Line && pa.Column < pb.Column)
+		})
+		// Values shared by several images, like those of defaults and image
+		// templates, can cause the same problem more than once
+		problems = append(problems, slices.Compact(v.problems)...)
+	}
+	return c, problems, nil
+}
+
+// validator collects the problems of a configuration file.
+type validator struct {
+	file     string
+	problems []Problem
+}
+
+// errorf records an error at a node, which may be nil if the position is
+// unknown.
+func (v *validator) errorf(n *yaml.Node, format string, args ...any) {
+	v.add(n, fmt.Sprintf(format, args...), false)
+}
+
+// warnf records a warning at a node.
+func (v *validator) warnf(n *yaml.Node, format string, args ...any) {
+	v.add(n, fmt.Sprintf(format, args...), true)
+}
+
+func (v *validator) add(n *yaml.Node, msg string, warning bool) {
+	p := Problem{File: v.file, Message: msg, Warning: warning}
+	if n != nil {
+		p.Line, p.Column = n.Line, n.Column
+	}
+	v.problems = append(v.problems, p)
+}
+
+var typeErrorLine = regexp.MustCompile(`^line (\d+): (.*)$`)
+
+// decode decodes a YAML document into c, recording type errors and unknown
+// fields. It fails only if the document can't be decoded at all.
+func (v *validator) decode(root *yaml.Node, c *Config) error {
+	if err := root.Decode(c); err != nil {
+		var te *yaml.TypeError
+		if !errors.As(err, &te) {
+			return fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		for _, msg := range te.Errors {
+			v.typeError(msg)
+		}
+	}
+	v.walk(root, reflect.TypeOf(*c))
+	return nil
+}
+
+// typeError records an error reported by the YAML decoder, which only knows
+// the line.
+func (v *validator) typeError(msg string) {
+	p := Problem{File: v.file, Message: msg}
+	if m := typeErrorLine.FindStringSubmatch(msg); m != nil {
+		p.Line, _ = strconv.Atoi(m[1])
+		p.Message = m[2]
+	}
+	v.problems = append(v.problems, p)
+}
+
+// yamlField is a field of a struct type as it appears in YAML.
+type yamlField struct {
+	owner reflect.Type
+	reflect.StructField
+	// required is set for fields with a yaml tag without omitempty
+	required bool
+}
+
+// yamlFields returns the fields of a struct type by their keys in YAML.
+// Fields without a yaml tag use the lowercased field name.
+func yamlFields(t reflect.Type) map[string]yamlField {
+	fields := map[string]yamlField{}
+	for idx := range t.NumField() {
+		f := t.Field(idx)
+		if !f.IsExported() {
+			continue
+		}
+		tag, hasTag := f.Tag.Lookup("yaml")
+		name, opts, _ := strings.Cut(tag, ",")
+		switch {
+		case name == "-":
+			continue
+		case strings.Contains(opts, "inline"):
+			maps.Copy(fields, yamlFields(f.Type))
+			continue
+		case name == "":
+			name = strings.ToLower(f.Name)
+		}
+		fields[name] = yamlField{owner: t, StructField: f, required: hasTag && !strings.Contains(opts, "omitempty")}
+	}
+	return fields
+}
+
+// walk reports keys in n that don't match a field of t, recursively.
+func (v *validator) walk(n *yaml.Node, t reflect.Type) {
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	if n.Kind == yaml.AliasNode {
+		n = n.Alias
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		if n.Kind != yaml.MappingNode {
+			return
+		}
+		fields := yamlFields(t)
+		for idx := 0; idx+1 < len(n.Content); idx += 2 {
+			key, value := n.Content[idx], n.Content[idx+1]
+			if key.Value == "<<" {
+				continue
+			}
+			f, ok := fields[key.Value]
+			if !ok {
+				v.errorf(key, "unknown field %q%s", key.Value, suggest(key.Value, fields))
+				continue
+			}
+			v.walk(value, f.Type)
+		}
+	case reflect.Slice:
+		if n.Kind == yaml.SequenceNode {
+			for _, item := range n.Content {
+				v.walk(item, t.Elem())
+			}
+		}
+	case reflect.Map:
+		if n.Kind == yaml.MappingNode {
+			for idx := 1; idx < len(n.Content); idx += 2 {
+				v.walk(n.Content[idx], t.Elem())
+			}
+		}
+	}
+}
+
+// suggest returns a hint naming the known field closest to an unknown one, if
+// any is close enough to be a typo.
+func suggest(key string, fields map[string]yamlField) string {
+	normalize := func(s string) string {
+		return strings.Map(func(r rune) rune {
+			if r == '_' || r == '-' {
+				return -1
+			}
+			return unicode.ToLower(r)
+		}, s)
+	}
+	best, bestDist := "", 3
+	for name := range fields {
+		d := distance(normalize(key), normalize(name))
+		if d < bestDist || (d == bestDist && best != "" && name < best) {
+			best, bestDist = name, d
+		}
+	}
+	if best == "" {
+		return ""
+	}
+	return fmt.Sprintf(" (did you mean %q?)", best)
+}
+
+// distance returns the Levenshtein distance between two strings.
+func distance(a string, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur := make([]int, len(b)+1)
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev = cur
+	}
+	return prev[len(b)]
+}
+
+// value returns the value of key in the mapping n, or nil.
+func value(n *yaml.Node, key string) *yaml.Node {
+	if n == nil || n.Kind != yaml.MappingNode {
+		return nil
+	}
+	for idx := 0; idx+1 < len(n.Content); idx += 2 {
+		if n.Content[idx].Value == key {
+			return n.Content[idx+1]
+		}
+	}
+	return nil
+}
+
+// item returns the idx-th item of the sequence n, or nil.
+func item(n *yaml.Node, idx int) *yaml.Node {
+	if n == nil || n.Kind != yaml.SequenceNode || idx >= len(n.Content) {
+		return nil
+	}
+	return n.Content[idx]
+}
+
+// or returns a if it isn't nil, and b otherwise.
+func or(a *yaml.Node, b *yaml.Node) *yaml.Node {
+	if a != nil {
+		return a
+	}
+	return b
+}
+
+// oneOf reports whether a configured value is one of the valid values,
+// ignoring case and surrounding spaces.
+func oneOf(configured string, valid []string) bool {
+	return slices.Contains(valid, strings.ToLower(strings.TrimSpace(configured)))
+}
+
+// check validates the settings of a decoded configuration other than its
+// images.
+func (v *validator) check(root *yaml.Node, c Config) {
+	if c.TargetFormat != "" && !oneOf(c.TargetFormat, image.TargetFormats) {
+		v.errorf(value(root, "target_format"), "invalid target_format %q (expected one of %s)", c.TargetFormat, strings.Join(image.TargetFormats, ", "))
+	}
+	v.checkRetention(value(root, "retention"), c.Retention)
+
+	defaults := value(root, "defaults")
+	if c.Defaults.Compression != "" && !oneOf(c.Defaults.Compression, image.Compressions()) {
+		v.errorf(value(defaults, "compression"), "invalid compression %q (expected one of %s)", c.Defaults.Compression, strings.Join(image.Compressions(), ", "))
+	}
+	v.checkTimeouts(defaults, c.Defaults.DownloadTimeout, c.Defaults.UploadTimeout)
+
+	notifications := value(root, "notifications")
+	for idx, n := range c.Notifications {
+		if err := n.Validate(); err != nil {
+			v.errorf(or(item(notifications, idx), notifications), "invalid notification: %s", err)
+		}
+	}
+}
+
+// checkImage validates a single image.
+func (v *validator) checkImage(n *yaml.Node, img image.Image, c Config) {
+	if strings.TrimSpace(img.Name) == "" {
+		v.errorf(n, "image has no name")
+	}
+
+	source := strings.ToLower(strings.TrimSpace(img.Source))
+	switch {
+	case source != "" && !slices.Contains(image.Sources, source):
+		v.errorf(value(n, "source"), "invalid source %q (expected one of %s)", img.Source, strings.Join(image.Sources, ", "))
+	case source == image.SourceDiscover && img.Discover == nil:
+		v.errorf(value(n, "source"), "source %q needs a discover block", source)
+	case source == image.SourceSimpleStreams && (img.SimpleStreams == nil || img.SimpleStreams.URL == ""):
+		v.errorf(value(n, "source"), "source %q needs a simplestreams block with a url", source)
+	case (source == "" || source == image.SourceURL) && img.Url == "":
+		v.errorf(n, "image %q has no url", img.Name)
+	}
+	v.checkURL(value(n, "url"), img.Url)
+	if ck := img.Checksum; ck != nil {
+		checksum := value(n, "checksum")
+		if ck.Algorithm != "" && !oneOf(ck.Algorithm, image.ChecksumAlgorithms) {
+			v.errorf(value(checksum, "algorithm"), "invalid checksum algorithm %q (expected one of %s)", ck.Algorithm, strings.Join(image.ChecksumAlgorithms, ", "))
+		}
+		if ck.Format != "" && !oneOf(ck.Format, image.ChecksumFormats) {
+			v.errorf(value(checksum, "format"), "invalid checksum format %q (expected one of %s)", ck.Format, strings.Join(image.ChecksumFormats, ", "))
+		}
+		v.checkURL(value(checksum, "url"), ck.URL)
+		v.checkURL(value(checksum, "signature_url"), ck.SignatureURL)
+	}
+	if img.Discover != nil {
+		v.checkURL(value(value(n, "discover"), "index_url"), img.Discover.IndexURL)
+	}
+	if img.Stream != nil {
+		v.checkURL(value(value(n, "stream"), "url"), img.Stream.URL)
+	}
+	if img.SimpleStreams != nil {
+		v.checkURL(value(value(n, "simplestreams"), "url"), img.SimpleStreams.URL)
+	}
+
+	if img.SourceFormat != "" && !oneOf(img.SourceFormat, image.SourceFormats) {
+		v.errorf(value(n, "source_format"), "invalid source_format %q (expected one of %s)", img.SourceFormat, strings.Join(image.SourceFormats, ", "))
+	}
+	if img.Compression != "" && !oneOf(img.Compression, image.Compressions()) {
+		v.errorf(value(n, "compression"), "invalid compression %q (expected one of %s)", img.Compression, strings.Join(image.Compressions(), ", "))
+	}
+	if img.TargetFormat != "" && !oneOf(img.TargetFormat, image.TargetFormats) {
+		v.errorf(value(n, "target_format"), "invalid target_format %q (expected one of %s)", img.TargetFormat, strings.Join(image.TargetFormats, ", "))
+	}
+	targetFormat, compressed := img.TargetFormat, img.TargetCompressed
+	if targetFormat == "" {
+		targetFormat, compressed = c.TargetFormat, compressed || c.TargetCompressed
+	}
+	// The format of as-is output is only known once the image is downloaded
+	if compressed && !oneOf(targetFormat, []string{image.TargetFormatQCOW2, image.TargetFormatAsIs}) {
+		v.errorf(or(value(n, "target_compressed"), n), "invalid target_compressed for image %q: only qcow2 or as-is output can be compressed", img.Name)
+	}
+	if img.UploadMethod != "" && !oneOf(img.UploadMethod, image.UploadMethods) {
+		v.errorf(value(n, "upload_method"), "invalid upload_method %q (expected one of %s)", img.UploadMethod, strings.Join(image.UploadMethods, ", "))
+	}
+	v.checkRetention(value(n, "retention"), img.Retention)
+	v.checkTimeouts(n, img.DownloadTimeout, img.UploadTimeout)
+
+	// A version that doesn't appear in a name with a version in it is most
+	// likely a typo in one of them
+	if version := img.Properties["os_version"]; version != "" && strings.ContainsAny(img.Name, "0123456789") && !strings.Contains(img.Name, version) {
+		v.warnf(value(value(n, "properties"), "os_version"), "os_version %q does not appear in the name %q", version, img.Name)
+	}
+}
+
+// checkTimeouts validates the timeouts of an image or of the defaults.
+func (v *validator) checkTimeouts(n *yaml.Node, download int, upload int) {
+	if download < 0 {
+		v.errorf(value(n, "download_timeout"), "invalid download_timeout %d (expected a number of seconds)", download)
+	}
+	if upload < 0 {
+		v.errorf(value(n, "upload_timeout"), "invalid upload_timeout %d (expected a number of seconds)", upload)
+	}
+}
+
+// checkRetention validates the global retention policy or that of an image,
+// configured at n.
+func (v *validator) checkRetention(n *yaml.Node, r *image.Retention) {
+	if r == nil {
+		return
+	}
+	if r.Keep < 0 {
+		v.errorf(or(value(n, "keep"), n), "invalid retention keep %d (expected a number of versions, or 0 for no limit)", r.Keep)
+	}
+	if _, err := r.MaxAgeDuration(); err != nil {
+		v.errorf(n, "invalid retention: %s", err)
+	}
+}
+
+// checkURL validates an optional URL.
+func (v *validator) checkURL(n *yaml.Node, raw string) {
+	if raw == "" {
+		return
+	}
+	u, err := url.Parse(raw)
+	if err != nil {
+		v.errorf(n, "invalid URL %q: %s", raw, errors.Unwrap(err))
+		return
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		v.errorf(n, "invalid URL %q (expected an absolute http or https URL)", raw)
+	}
+}
@@ -0,0 +1,186 @@
+// Package metrics exports the results of shepherd runs as Prometheus metrics,
+// either served over HTTP or written to a node_exporter textfile.
+package metrics
+
+import (
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+
+	"github.com/HackUCF/image-shepherd/pkg/shepherd"
+)
+
+const namespace = "image_shepherd"
+
+// Metrics holds the metrics of every run of a process.
+type Metrics struct {
+	registry *prometheus.Registry
+
+	lastSuccess        *prometheus.GaugeVec
+	lastRefresh        *prometheus.GaugeVec
+	sourceLastModified *prometheus.GaugeVec
+	downloadedBytes    *prometheus.CounterVec
+	uploadedBytes      *prometheus.CounterVec
+	phaseDuration      *prometheus.GaugeVec
+	failures           *prometheus.CounterVec
+
+	runs            *prometheus.CounterVec
+	lastRun         prometheus.Gauge
+	lastRunDuration prometheus.Gauge
+	lastRunImages   *prometheus.GaugeVec
+}
+
+// New creates and registers the metrics.
+func New() *Metrics {
+	imageLabels := []string{"image", "target"}
+	m := &Metrics{
+		registry: prometheus.NewRegistry(),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "image_last_success_timestamp_seconds",
+			Help:      "When the image was last uploaded or found unchanged.",
+		}, imageLabels),
+		lastRefresh: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "image_last_refresh_timestamp_seconds",
+			Help:      "When the current version of the image was uploaded.",
+		}, imageLabels),
+		sourceLastModified: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "source_last_modified_timestamp_seconds",
+			Help:      "Last-Modified time of the image source when it was last checked.",
+		}, imageLabels),
+		downloadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "downloaded_bytes_total",
+			Help:      "Bytes downloaded from the image source.",
+		}, []string{"image"}),
+		uploadedBytes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "uploaded_bytes_total",
+			Help:      "Bytes of image data uploaded to Glance.",
+		}, imageLabels),
+		phaseDuration: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "phase_duration_seconds",
+			Help:      "How long each phase took the last time it ran: download, decompress (part of download), convert and upload.",
+		}, []string{"image", "target", "phase"}),
+		failures: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "image_failures_total",
+			Help:      "Runs in which the image could not be managed.",
+		}, imageLabels),
+		runs: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace,
+			Name:      "runs_total",
+			Help:      "Finished runs by status: success, partial-failure or failure.",
+		}, []string{"status"}),
+		lastRun: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_timestamp_seconds",
+			Help:      "When the last run finished.",
+		}),
+		lastRunDuration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_duration_seconds",
+			Help:      "How long the last run took.",
+		}),
+		lastRunImages: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_run_images",
+			Help:      "Images on each target in the last run by outcome.",
+		}, []string{"outcome"}),
+	}
+	m.registry.MustRegister(m.lastSuccess, m.lastRefresh, m.sourceLastModified, m.downloadedBytes, m.uploadedBytes,
+		m.phaseDuration, m.failures, m.runs, m.lastRun, m.lastRunDuration, m.lastRunImages)
+	return m
+}
+
+// Observe records the results of a run that started and finished at the given
+// times.
+func (m *Metrics) Observe(results []shepherd.Result, status shepherd.Status, started time.Time, finished time.Time) {
+	m.runs.WithLabelValues(string(status)).Inc()
+	m.lastRun.Set(float64(finished.Unix()))
+	m.lastRunDuration.Set(finished.Sub(started).Seconds())
+	s := shepherd.Summarize(results)
+	for outcome, n := range map[shepherd.Outcome]int{
+		shepherd.OutcomeUploaded:  s.Uploaded,
+		shepherd.OutcomeUnchanged: s.Unchanged,
+		shepherd.OutcomeFailed:    s.Failed,
+		shepherd.OutcomeAborted:   s.Aborted,
+	} {
+		m.lastRunImages.WithLabelValues(string(outcome)).Set(float64(n))
+	}
+
+	// An image is downloaded once however many targets it is published to
+	downloaded := map[string]bool{}
+	for _, r := range results {
+		labels := prometheus.Labels{"image": r.Name, "target": r.Target.String()}
+		done := r.Started.Add(r.Duration)
+
+		// Created up front so every image has a failure count, even if it is 0
+		failures := m.failures.With(labels)
+		switch r.Outcome() {
+		case shepherd.OutcomeFailed:
+			failures.Inc()
+		case shepherd.OutcomeUploaded, shepherd.OutcomeUnchanged:
+			m.lastSuccess.With(labels).Set(float64(done.Unix()))
+		}
+
+		switch {
+		case r.NewID != "":
+			m.lastRefresh.With(labels).Set(float64(done.Unix()))
+		case r.CurrentID != "" && !r.CurrentCreatedAt.IsZero():
+			m.lastRefresh.With(labels).Set(float64(r.CurrentCreatedAt.Unix()))
+		}
+		if lm, err := http.ParseTime(r.Meta.LastModified); err == nil {
+			m.sourceLastModified.With(labels).Set(float64(lm.Unix()))
+		}
+
+		if r.Build.DownloadedBytes > 0 && !downloaded[r.Name] {
+			downloaded[r.Name] = true
+			m.downloadedBytes.WithLabelValues(r.Name).Add(float64(r.Build.DownloadedBytes))
+		}
+		if r.NewID != "" {
+			m.uploadedBytes.With(labels).Add(float64(r.Build.ImageBytes))
+		}
+		for phase, d := range map[string]time.Duration{"download": r.Build.Download, "decompress": r.Build.Decompress, "convert": r.Build.Convert, "upload": r.Upload} {
+			if d > 0 {
+				m.phaseDuration.WithLabelValues(r.Name, r.Target.String(), phase).Set(d.Seconds())
+			}
+		}
+	}
+}
+
+// Serve serves the metrics, along with Go runtime and process metrics, at
+// /metrics on addr in the background. It fails only if addr can't be listened
+// on.
+func (m *Metrics) Serve(addr string) error {
+	m.registry.MustRegister(collectors.NewGoCollector(), collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}))
+
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{}))
+	srv := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+	go func() {
+		if err := srv.Serve(l); err != nil {
+			zap.S().Errorw("Metrics server stopped", "address", addr, "error", err)
+		}
+	}()
+	zap.S().Infow("Serving metrics", "address", l.Addr().String(), "path", "/metrics")
+	return nil
+}
+
+// WriteTextfile atomically writes the metrics to a file for the node_exporter
+// textfile collector.
+func (m *Metrics) WriteTextfile(path string) error {
+	return prometheus.WriteToTextfile(path, m.registry)
+}
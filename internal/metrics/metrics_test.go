@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/HackUCF/image-shepherd/pkg/shepherd"
+)
+
+func TestObserve(t *testing.T) {
+	started := time.Unix(1_760_600_000, 0)
+	east := image.Target{Cloud: "prod", Region: "east"}
+	west := image.Target{Cloud: "prod", Region: "west"}
+	build := image.BuildStats{DownloadedBytes: 1000, ImageBytes: 4000, Download: 20 * time.Second, Decompress: 5 * time.Second}
+
+	// debian-13 is downloaded once and published to two targets
+	results := []shepherd.Result{
+		{
+			Decision: shepherd.Decision{Name: "debian-13", Target: east, Action: shepherd.ActionReplace},
+			NewID:    "new-east", Build: build, Upload: 30 * time.Second, Started: started, Duration: time.Minute,
+		},
+		{
+			Decision: shepherd.Decision{Name: "debian-13", Target: west, Action: shepherd.ActionUploadNew},
+			NewID:    "new-west", Build: build, Upload: 40 * time.Second, Started: started, Duration: time.Minute,
+		},
+		{
+			Decision: shepherd.Decision{
+				Name: "fedora-42", Target: east, Action: shepherd.ActionSkipUnchanged,
+				CurrentID: "current", CurrentCreatedAt: started.Add(-24 * time.Hour),
+				Meta: image.SourceMeta{LastModified: "Wed, 15 Oct 2025 08:00:00 GMT"},
+			},
+			Started: started, Duration: time.Second,
+		},
+		{
+			Decision: shepherd.Decision{Name: "alpine-3.22", Target: east, Action: shepherd.ActionUploadNew},
+			Err:      errors.New("download failed: 404 Not Found"), Started: started, Duration: time.Second,
+		},
+	}
+
+	m := New()
+	m.Observe(results, shepherd.StatusPartialFailure, started, started.Add(90*time.Second))
+	m.Observe(results[2:], shepherd.StatusPartialFailure, started, started.Add(90*time.Second))
+
+	want := `
+# HELP image_shepherd_downloaded_bytes_total Bytes downloaded from the image source.
+# TYPE image_shepherd_downloaded_bytes_total counter
+image_shepherd_downloaded_bytes_total{image="debian-13"} 1000
+# HELP image_shepherd_image_failures_total Runs in which the image could not be managed.
+# TYPE image_shepherd_image_failures_total counter
+image_shepherd_image_failures_total{image="alpine-3.22",target="prod/east"} 2
+image_shepherd_image_failures_total{image="debian-13",target="prod/east"} 0
+image_shepherd_image_failures_total{image="debian-13",target="prod/west"} 0
+image_shepherd_image_failures_total{image="fedora-42",target="prod/east"} 0
+# HELP image_shepherd_image_last_refresh_timestamp_seconds When the current version of the image was uploaded.
+# TYPE image_shepherd_image_last_refresh_timestamp_seconds gauge
+image_shepherd_image_last_refresh_timestamp_seconds{image="debian-13",target="prod/east"} 1.76060006e+09
+image_shepherd_image_last_refresh_timestamp_seconds{image="debian-13",target="prod/west"} 1.76060006e+09
+image_shepherd_image_last_refresh_timestamp_seconds{image="fedora-42",target="prod/east"} 1.7605136e+09
+# HELP image_shepherd_last_run_images Images on each target in the last run by outcome.
+# TYPE image_shepherd_last_run_images gauge
+image_shepherd_last_run_images{outcome="aborted"} 0
+image_shepherd_last_run_images{outcome="failed"} 1
+image_shepherd_last_run_images{outcome="unchanged"} 1
+image_shepherd_last_run_images{outcome="uploaded"} 0
+# HELP image_shepherd_phase_duration_seconds How long each phase took the last time it ran: download, decompress (part of download), convert and upload.
+# TYPE image_shepherd_phase_duration_seconds gauge
+image_shepherd_phase_duration_seconds{image="debian-13",phase="decompress",target="prod/east"} 5
+image_shepherd_phase_duration_seconds{image="debian-13",phase="decompress",target="prod/west"} 5
+image_shepherd_phase_duration_seconds{image="debian-13",phase="download",target="prod/east"} 20
+image_shepherd_phase_duration_seconds{image="debian-13",phase="download",target="prod/west"} 20
+image_shepherd_phase_duration_seconds{image="debian-13",phase="upload",target="prod/east"} 30
+image_shepherd_phase_duration_seconds{image="debian-13",phase="upload",target="prod/west"} 40
+# HELP image_shepherd_runs_total Finished runs by status: success, partial-failure or failure.
+# TYPE image_shepherd_runs_total counter
+image_shepherd_runs_total{status="partial-failure"} 2
+# HELP image_shepherd_source_last_modified_timestamp_seconds Last-Modified time of the image source when it was last checked.
+# TYPE image_shepherd_source_last_modified_timestamp_seconds gauge
+image_shepherd_source_last_modified_timestamp_seconds{image="fedora-42",target="prod/east"} 1.7605152e+09
+# HELP image_shepherd_uploaded_bytes_total Bytes of image data uploaded to Glance.
+# TYPE image_shepherd_uploaded_bytes_total counter
+image_shepherd_uploaded_bytes_total{image="debian-13",target="prod/east"} 4000
+image_shepherd_uploaded_bytes_total{image="debian-13",target="prod/west"} 4000
+`
+	if err := testutil.GatherAndCompare(m.registry, strings.NewReader(want),
+		"image_shepherd_downloaded_bytes_total",
+		"image_shepherd_image_failures_total",
+		"image_shepherd_image_last_refresh_timestamp_seconds",
+		"image_shepherd_last_run_images",
+		"image_shepherd_phase_duration_seconds",
+		"image_shepherd_runs_total",
+		"image_shepherd_source_last_modified_timestamp_seconds",
+		"image_shepherd_uploaded_bytes_total",
+	); err != nil {
+		t.Error(err)
+	}
+}
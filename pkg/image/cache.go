@@ -0,0 +1,361 @@
+package image
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Cache is a persistent download cache. Downloaded files are stored once per
+// content digest under blobs/, and an index entry per source URL records the
+// ETag and Last-Modified the content was downloaded with, so later runs can
+// revalidate the cached copy with a conditional GET instead of downloading it
+// again.
+type Cache struct {
+	dir string
+	// maxBytes limits the total size of cached files. Zero means no limit.
+	maxBytes int64
+
+	mu sync.Mutex
+	// inUse counts the callers holding each blob, which eviction skips
+	inUse map[string]int
+}
+
+// cacheEntry is the index record for one source URL.
+type cacheEntry struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	SHA256       string `json:"sha256"`
+	Filename     string `json:"filename"`
+	Size         int64  `json:"size"`
+}
+
+// OpenCache opens or creates a download cache in dir.
+func OpenCache(dir string, maxBytes int64) (*Cache, error) {
+	c := &Cache{dir: dir, maxBytes: maxBytes, inUse: map[string]int{}}
+	for _, sub := range []string{"index", "blobs", "tmp"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0o755); err != nil {
+			return nil, err
+		}
+	}
+
+	// Remove downloads abandoned by runs that were killed
+	if tmps, err := os.ReadDir(filepath.Join(dir, "tmp")); err == nil {
+		for _, t := range tmps {
+			if info, err := t.Info(); err == nil && time.Since(info.ModTime()) > 24*time.Hour {
+				_ = os.RemoveAll(filepath.Join(dir, "tmp", t.Name()))
+			}
+		}
+	}
+	return c, nil
+}
+
+var (
+	sharedCacheOnce sync.Once
+	sharedCacheInst *Cache
+)
+
+// sharedCache returns the cache configured through IMAGE_SHEPHERD_CACHE_DIR
+// and IMAGE_SHEPHERD_CACHE_MAX_BYTES, or nil when caching is disabled.
+func sharedCache() *Cache {
+	sharedCacheOnce.Do(func() {
+		dir := os.Getenv("IMAGE_SHEPHERD_CACHE_DIR")
+		if dir == "" {
+			return
+		}
+		var maxBytes int64
+		if v := os.Getenv("IMAGE_SHEPHERD_CACHE_MAX_BYTES"); v != "" {
+			if n, err := strconv.ParseInt(v, 10, 64); err == nil && n > 0 {
+				maxBytes = n
+			}
+		}
+		c, err := OpenCache(dir, maxBytes)
+		if err != nil {
+			zap.S().Warnw("Failed to open download cache; caching disabled", "dir", dir, "error", err)
+			return
+		}
+		sharedCacheInst = c
+	})
+	return sharedCacheInst
+}
+
+func urlKey(srcURL string) string {
+	sum := sha256.Sum256([]byte(srcURL))
+	return hex.EncodeToString(sum[:])
+}
+
+func (c *Cache) indexPath(key string) string {
+	return filepath.Join(c.dir, "index", key+".json")
+}
+
+func (c *Cache) blobPath(e cacheEntry) string {
+	return filepath.Join(c.dir, "blobs", e.SHA256, e.Filename)
+}
+
+// lookup returns the index entry for key if its blob is still present, and
+// marks the blob as in use so it isn't evicted while it is revalidated.
+func (c *Cache) lookup(key string) (cacheEntry, bool) {
+	var e cacheEntry
+	data, err := os.ReadFile(c.indexPath(key))
+	if err != nil {
+		return e, false
+	}
+	if err := json.Unmarshal(data, &e); err != nil || e.SHA256 == "" || e.Filename == "" {
+		return e, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.present(e) {
+		return e, false
+	}
+	c.inUse[e.SHA256]++
+	return e, true
+}
+
+// present reports whether the blob of e is in the cache.
+func (c *Cache) present(e cacheEntry) bool {
+	info, err := os.Stat(c.blobPath(e))
+	return err == nil && info.Size() == e.Size
+}
+
+// store moves a completed download into the cache and records it for srcURL,
+// marking its blob as in use.
+func (c *Cache) store(key string, srcURL string, file string, etag string, lastModified string) (cacheEntry, error) {
+	digest, err := hashFile(file, "sha256")
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	e := cacheEntry{
+		URL:          srcURL,
+		ETag:         etag,
+		LastModified: lastModified,
+		SHA256:       digest,
+		Filename:     filepath.Base(file),
+		Size:         info.Size(),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Identical content from another URL is stored only once
+	blobDir := filepath.Join(c.dir, "blobs", digest)
+	if existing, err := os.ReadDir(blobDir); err == nil && len(existing) > 0 {
+		e.Filename = existing[0].Name()
+	} else {
+		if err := os.MkdirAll(blobDir, 0o755); err != nil {
+			return cacheEntry{}, err
+		}
+		if err := os.Rename(file, c.blobPath(e)); err != nil {
+			return cacheEntry{}, err
+		}
+	}
+
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return cacheEntry{}, err
+	}
+	tmp := c.indexPath(key) + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return cacheEntry{}, err
+	}
+	if err := os.Rename(tmp, c.indexPath(key)); err != nil {
+		return cacheEntry{}, err
+	}
+	c.inUse[e.SHA256]++
+	return e, nil
+}
+
+// touch marks the entry for key as recently used.
+func (c *Cache) touch(key string) {
+	now := time.Now()
+	_ = os.Chtimes(c.indexPath(key), now, now)
+}
+
+func (c *Cache) release(e cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.inUse[e.SHA256]--; c.inUse[e.SHA256] <= 0 {
+		delete(c.inUse, e.SHA256)
+	}
+}
+
+// Fetch returns the path of a cached copy of srcURL, downloading it first if
+// the cache has no copy or the cached copy is no longer current. The returned
+// file must not be modified, and release must be called once it is no longer
+// needed. timeout bounds each download attempt.
+func (c *Cache) Fetch(srcURL string, meta SourceMeta, timeout time.Duration) (string, func(), error) {
+	key := urlKey(srcURL)
+	tmpDir, err := os.MkdirTemp(filepath.Join(c.dir, "tmp"), key[:16]+"-")
+	if err != nil {
+		return "", nil, err
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The cached copy is held while it is revalidated, so it can't be evicted
+	// between the lookup and its use
+	d := newDownload(srcURL, tmpDir, meta, timeout)
+	cached, ok := c.lookup(key)
+	if ok && (cached.ETag != "" || cached.LastModified != "") {
+		d.ifNoneMatch = cached.ETag
+		d.ifModifiedSince = cached.LastModified
+		zap.S().Infow("Revalidating cached download", "url", srcURL, "etag", cached.ETag, "last_modified", cached.LastModified)
+	}
+
+	file, err := d.run()
+	if errors.Is(err, errNotModified) && ok {
+		if c.present(cached) {
+			zap.S().Infow("Using cached download", "url", srcURL, "file", c.blobPath(cached), "sha256", cached.SHA256)
+			c.touch(key)
+			c.evict()
+			return c.blobPath(cached), func() { c.release(cached) }, nil
+		}
+		// Removed by something other than this process since the lookup
+		zap.S().Warnw("Cached download is gone; downloading it again", "url", srcURL, "file", c.blobPath(cached))
+		d = newDownload(srcURL, tmpDir, meta, timeout)
+		file, err = d.run()
+	}
+	if ok {
+		c.release(cached)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+
+	e, err := c.store(key, srcURL, file, d.etag, d.lastModified)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to store download in cache: %w", err)
+	}
+	zap.S().Infow("Stored download in cache", "url", srcURL, "file", c.blobPath(e), "sha256", e.SHA256, "size", e.Size)
+	c.touch(key)
+	c.evict()
+	return c.blobPath(e), func() { c.release(e) }, nil
+}
+
+// Discard removes the cached copy of srcURL returned by Fetch as file, such as
+// when it failed checksum verification, so the next Fetch downloads it again
+// instead of revalidating it. It must be called before the copy is released.
+// The blob itself is only removed once no other caller holds it.
+func (c *Cache) Discard(srcURL string, file string) {
+	key := urlKey(srcURL)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var e cacheEntry
+	data, err := os.ReadFile(c.indexPath(key))
+	if err != nil || json.Unmarshal(data, &e) != nil || c.blobPath(e) != file {
+		// Already replaced by a newer download
+		return
+	}
+	if err := os.Remove(c.indexPath(key)); err != nil && !os.IsNotExist(err) {
+		zap.S().Warnw("Failed to remove cached download", "url", srcURL, "error", err)
+		return
+	}
+	zap.S().Infow("Removed cached download", "url", srcURL, "file", file, "sha256", e.SHA256)
+	if c.inUse[e.SHA256] > 1 {
+		return
+	}
+	if err := os.RemoveAll(filepath.Dir(file)); err != nil {
+		zap.S().Warnw("Failed to remove cached download", "url", srcURL, "file", file, "error", err)
+	}
+}
+
+// evict removes the least recently used blobs until the cache fits in
+// maxBytes. Blobs in use by this process are never removed.
+func (c *Cache) evict() {
+	if c.maxBytes <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	type blob struct {
+		digest   string
+		size     int64
+		lastUsed time.Time
+		index    []string
+	}
+	blobs := map[string]*blob{}
+	var total int64
+
+	dirs, err := os.ReadDir(filepath.Join(c.dir, "blobs"))
+	if err != nil {
+		zap.S().Warnw("Failed to read download cache", "dir", c.dir, "error", err)
+		return
+	}
+	for _, d := range dirs {
+		b := &blob{digest: d.Name()}
+		files, _ := os.ReadDir(filepath.Join(c.dir, "blobs", d.Name()))
+		for _, f := range files {
+			if info, err := f.Info(); err == nil {
+				b.size += info.Size()
+			}
+		}
+		blobs[b.digest] = b
+		total += b.size
+	}
+	if total <= c.maxBytes {
+		return
+	}
+
+	// A blob was last used when any URL pointing at it was
+	indexes, _ := os.ReadDir(filepath.Join(c.dir, "index"))
+	for _, ix := range indexes {
+		name := filepath.Join(c.dir, "index", ix.Name())
+		data, err := os.ReadFile(name)
+		if err != nil {
+			continue
+		}
+		var e cacheEntry
+		if json.Unmarshal(data, &e) != nil {
+			continue
+		}
+		b, found := blobs[e.SHA256]
+		if !found {
+			continue
+		}
+		b.index = append(b.index, name)
+		if info, err := ix.Info(); err == nil && info.ModTime().After(b.lastUsed) {
+			b.lastUsed = info.ModTime()
+		}
+	}
+
+	order := make([]*blob, 0, len(blobs))
+	for _, b := range blobs {
+		order = append(order, b)
+	}
+	sort.Slice(order, func(a, b int) bool { return order[a].lastUsed.Before(order[b].lastUsed) })
+
+	for _, b := range order {
+		if total <= c.maxBytes {
+			break
+		}
+		if c.inUse[b.digest] > 0 {
+			continue
+		}
+		for _, name := range b.index {
+			_ = os.Remove(name)
+		}
+		if err := os.RemoveAll(filepath.Join(c.dir, "blobs", b.digest)); err != nil {
+			zap.S().Warnw("Failed to evict cached download", "sha256", b.digest, "error", err)
+			continue
+		}
+		total -= b.size
+		zap.S().Infow("Evicted cached download", "sha256", b.digest, "size", b.size, "cache_size", total)
+	}
+}
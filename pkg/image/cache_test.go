@@ -0,0 +1,220 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+// mirror serves files by path with an ETag per version, answering conditional
+// requests with 304 Not Modified.
+type mirror struct {
+	mu      sync.Mutex
+	files   map[string]string
+	version int
+	// conditional counts the requests with If-None-Match and downloads those
+	// that transferred a body
+	conditional int
+	downloads   int
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	content, ok := m.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Header.Get("If-None-Match") != "" {
+		m.conditional++
+	}
+	rec := httptest.NewRecorder()
+	rec.Header().Set("ETag", fmt.Sprintf(`"%s@%d"`, r.URL.Path, m.version))
+	http.ServeContent(rec, r, "", time.Time{}, bytes.NewReader([]byte(content)))
+	if rec.Code == http.StatusOK {
+		m.downloads++
+	}
+	for k, v := range rec.Header() {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(rec.Code)
+	_, _ = w.Write(rec.Body.Bytes())
+}
+
+func (m *mirror) set(path string, content string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.files[path] = content
+	m.version++
+}
+
+func readFile(t *testing.T, name string) string {
+	t.Helper()
+	data, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatalf("read cached file: %v", err)
+	}
+	return string(data)
+}
+
+func TestCacheFetch(t *testing.T) {
+	m := &mirror{files: map[string]string{"/debian-13.qcow2": "version 1"}}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	c, err := OpenCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/debian-13.qcow2"
+
+	first, release, err := c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	release()
+	if got := readFile(t, first); got != "version 1" {
+		t.Errorf("first Fetch() content = %q, want %q", got, "version 1")
+	}
+
+	// Unchanged: revalidated and reused
+	second, release, err := c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	release()
+	if second != first {
+		t.Errorf("revalidated Fetch() = %s, want cached %s", second, first)
+	}
+	if m.conditional != 1 || m.downloads != 1 {
+		t.Errorf("made %d conditional requests and %d downloads, want 1 and 1", m.conditional, m.downloads)
+	}
+
+	// Changed: downloaded again
+	m.set("/debian-13.qcow2", "version 2")
+	third, release, err := c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	release()
+	if got := readFile(t, third); got != "version 2" {
+		t.Errorf("changed Fetch() content = %q, want %q", got, "version 2")
+	}
+	if m.downloads != 2 {
+		t.Errorf("made %d downloads, want 2", m.downloads)
+	}
+}
+
+func TestCacheDiscard(t *testing.T) {
+	m := &mirror{files: map[string]string{"/debian-13.qcow2": "corrupted"}}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	c, err := OpenCache(t.TempDir(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	url := srv.URL + "/debian-13.qcow2"
+
+	// Held by another caller: only the index entry goes
+	file, release, err := c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	_, releaseOther, err := c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	c.Discard(url, file)
+	release()
+	if _, err := os.Stat(file); err != nil {
+		t.Errorf("%s was removed while in use: %v", file, err)
+	}
+	releaseOther()
+
+	// Not revalidated, as the failed copy must not be reused
+	file, release, err = c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	if m.conditional != 1 || m.downloads != 2 {
+		t.Errorf("made %d conditional requests and %d downloads, want 1 and 2", m.conditional, m.downloads)
+	}
+	c.Discard(url, file)
+	release()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Errorf("%s was not removed: %v", file, err)
+	}
+
+	m.set("/debian-13.qcow2", "version 1")
+	file, release, err = c.Fetch(url, SourceMeta{}, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Fetch() error = %v", err)
+	}
+	release()
+	if got := readFile(t, file); got != "version 1" {
+		t.Errorf("Fetch() content = %q, want %q", got, "version 1")
+	}
+	if m.conditional != 1 || m.downloads != 3 {
+		t.Errorf("made %d conditional requests and %d downloads, want 1 and 3", m.conditional, m.downloads)
+	}
+}
+
+func TestCacheEvict(t *testing.T) {
+	m := &mirror{files: map[string]string{
+		"/a.qcow2": "aaaaaaaaaa",
+		"/b.qcow2": "bbbbbbbbbb",
+		"/c.qcow2": "cccccccccc",
+	}}
+	srv := httptest.NewServer(m)
+	defer srv.Close()
+	// Room for two of the three images
+	c, err := OpenCache(t.TempDir(), 25)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fetch := func(name string) (string, func()) {
+		t.Helper()
+		file, release, err := c.Fetch(srv.URL+"/"+name, SourceMeta{}, 5*time.Second)
+		if err != nil {
+			t.Fatalf("Fetch(%s) error = %v", name, err)
+		}
+		return file, release
+	}
+	present := func(file string) bool {
+		_, err := os.Stat(file)
+		return err == nil
+	}
+
+	a, releaseA := fetch("a.qcow2")
+	b, releaseB := fetch("b.qcow2")
+	releaseB()
+	cf, releaseC := fetch("c.qcow2")
+	defer releaseC()
+
+	// a is the least recently used, but still in use
+	if !present(a) {
+		t.Errorf("%s was evicted while in use", a)
+	}
+	if present(b) {
+		t.Errorf("%s was not evicted", b)
+	}
+	if !present(cf) {
+		t.Errorf("%s was evicted right after being fetched", cf)
+	}
+
+	// Once released, a goes next
+	releaseA()
+	b, releaseB = fetch("b.qcow2")
+	releaseB()
+	if present(a) {
+		t.Errorf("%s was not evicted once released", a)
+	}
+	if !present(b) || !present(cf) {
+		t.Errorf("%s or %s was evicted", b, cf)
+	}
+}
@@ -0,0 +1,266 @@
+package image
+
+import (
+	"bufio"
+	"context"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Checksum describes how to verify a downloaded image. At least one of Value,
+// URL or Uncompressed must be set.
+type Checksum struct {
+	// Algorithm is the digest algorithm: sha256 (default), sha512, sha1 or md5,
+	// which may also be written sha-256, sha-512 and sha-1.
+	Algorithm string `yaml:"algorithm,omitempty"`
+	// Value is the literal hex digest of the downloaded file.
+	Value string `yaml:"value,omitempty"`
+	// Uncompressed is the literal hex digest of the image after decompression.
+	Uncompressed string `yaml:"uncompressed,omitempty"`
+	// URL points to a checksum file published next to the image.
+	URL string `yaml:"url,omitempty"`
+	// Format is the checksum file format: gnu (sha256sum output), bsd
+	// (`SHA256 (file) = digest`) or fedora (BSD-style lines in a CHECKSUM file).
+	// Empty means any of them.
+	Format string `yaml:"format,omitempty"`
+	// File is the entry to look up in the checksum file. It defaults to the
+	// file name in the image URL.
+	File string `yaml:"file,omitempty"`
+	// SignatureURL points to a detached OpenPGP signature of the checksum file.
+	SignatureURL string `yaml:"signature_url,omitempty"`
+	// Keyring is the path to an armored OpenPGP public key file. When set, the
+	// checksum file must be signed by one of its keys, either through
+	// SignatureURL or by being clearsigned.
+	Keyring string `yaml:"keyring,omitempty"`
+}
+
+// ChecksumAlgorithms lists the valid values of checksum.algorithm, including
+// the spellings with a hyphen used by some checksum files.
+var ChecksumAlgorithms = []string{"sha256", "sha512", "sha1", "md5", "sha-256", "sha-512", "sha-1"}
+
+// ChecksumFormats lists the valid values of checksum.format.
+var ChecksumFormats = []string{"gnu", "bsd", "fedora"}
+
+var hexDigest = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+
+// bsdLine matches `SHA256 (name) = digest` as written by BSD tools and Fedora.
+var bsdLine = regexp.MustCompile(`^([A-Za-z0-9-]+) ?\((.+)\) ?= ?([0-9a-fA-F]+)$`)
+
+// algorithm returns the normalized algorithm name.
+func (c Checksum) algorithm() string {
+	switch a := strings.ToLower(strings.TrimSpace(c.Algorithm)); a {
+	case "":
+		return "sha256"
+	case "sha-256", "sha-512", "sha-1":
+		return strings.ReplaceAll(a, "-", "")
+	default:
+		return a
+	}
+}
+
+// newHash returns a hash for the named algorithm.
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "md5":
+		return md5.New(), nil
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm %q", algorithm)
+	}
+}
+
+// hashFile returns the hex digest of a file.
+func hashFile(name string, algorithm string) (string, error) {
+	h, err := newHash(algorithm)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// entryName returns the name to look up in the checksum file.
+func (c Checksum) entryName(imageURL string) string {
+	if c.File != "" {
+		return c.File
+	}
+	if u, err := url.Parse(imageURL); err == nil {
+		return path.Base(u.Path)
+	}
+	return path.Base(imageURL)
+}
+
+// Expected returns the digest the image downloaded from imageURL must have,
+// fetching and parsing the checksum file if needed. It returns an empty digest
+// if only the uncompressed image is to be verified.
+func (c Checksum) Expected(imageURL string) (string, error) {
+	if _, err := newHash(c.algorithm()); err != nil {
+		return "", err
+	}
+	if u := strings.TrimSpace(c.Uncompressed); u != "" && !hexDigest.MatchString(u) {
+		return "", fmt.Errorf("uncompressed checksum %q is not a hex digest", u)
+	}
+	if v := strings.TrimSpace(c.Value); v != "" {
+		if c.SignatureURL != "" || c.Keyring != "" {
+			return "", fmt.Errorf("a literal checksum value can't be signature-verified; use url instead")
+		}
+		if !hexDigest.MatchString(v) {
+			return "", fmt.Errorf("checksum value %q is not a hex digest", v)
+		}
+		return strings.ToLower(v), nil
+	}
+	if c.URL == "" {
+		if c.Uncompressed != "" {
+			return "", nil
+		}
+		return "", fmt.Errorf("checksum needs a value, a url or an uncompressed digest")
+	}
+
+	zap.S().Infow("Fetching checksum file", "url", c.URL, "format", c.Format)
+	body, err := fetchSmall(c.URL)
+	if err != nil {
+		return "", err
+	}
+	signed, err := c.verifySigned(body)
+	if err != nil {
+		return "", err
+	}
+	return c.parse(signed, c.entryName(imageURL))
+}
+
+// parse finds the digest of name in the contents of a checksum file.
+func (c Checksum) parse(body []byte, name string) (string, error) {
+	format := strings.ToLower(strings.TrimSpace(c.Format))
+	switch format {
+	case "", "gnu", "bsd", "fedora":
+	default:
+		return "", fmt.Errorf("unsupported checksum format %q", c.Format)
+	}
+	algorithm := c.algorithm()
+
+	var lone []string
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		// Comments, and the armor of clearsigned files such as Fedora's CHECKSUM
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "-----") || strings.HasPrefix(line, "Hash:") {
+			continue
+		}
+
+		if format != "gnu" {
+			if m := bsdLine.FindStringSubmatch(line); m != nil {
+				algo := strings.ToLower(strings.ReplaceAll(m[1], "-", ""))
+				if algo == algorithm && path.Base(m[2]) == name {
+					return strings.ToLower(m[3]), nil
+				}
+				continue
+			}
+		}
+
+		if format == "" || format == "gnu" {
+			fields := strings.Fields(line)
+			if len(fields) == 1 && hexDigest.MatchString(fields[0]) {
+				lone = append(lone, fields[0])
+				continue
+			}
+			if len(fields) >= 2 && hexDigest.MatchString(fields[0]) {
+				// `digest  name` or `digest *name` (binary mode)
+				entry := strings.TrimPrefix(strings.Join(fields[1:], " "), "*")
+				if path.Base(entry) == name {
+					return strings.ToLower(fields[0]), nil
+				}
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+
+	// A checksum file published for a single image may hold just the digest
+	if len(lone) == 1 {
+		return strings.ToLower(lone[0]), nil
+	}
+	return "", fmt.Errorf("no %s checksum for %q found in checksum file", algorithm, name)
+}
+
+// Verify checks a downloaded file against the expected digest.
+func (c Checksum) Verify(file string, expected string) error {
+	got, err := hashFile(file, c.algorithm())
+	if err != nil {
+		return err
+	}
+	return c.verifyDigest(file, got, expected)
+}
+
+// verifyDigest checks the digest of a file that was hashed while it was read
+// against the expected digest.
+func (c Checksum) verifyDigest(file string, got string, expected string) error {
+	algorithm := c.algorithm()
+	if !strings.EqualFold(got, expected) {
+		return fmt.Errorf("%s checksum mismatch for %s: expected %s, got %s", algorithm, path.Base(file), expected, got)
+	}
+	zap.S().Infow("Checksum verified", "file", file, "algorithm", algorithm, "digest", got)
+	return nil
+}
+
+// fetchSmall downloads a small text resource such as a checksum file.
+func fetchSmall(srcURL string) ([]byte, error) {
+	return fetchLimited(srcURL, 16<<20)
+}
+
+// fetchLimited downloads a resource into memory, refusing anything larger
+// than limit bytes.
+func fetchLimited(srcURL string, limit int64) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", srcURL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	client := &http.Client{Timeout: 120 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return nil, fmt.Errorf("GET %s failed: %s", srcURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(body)) > limit {
+		return nil, fmt.Errorf("GET %s: response larger than %d bytes", srcURL, limit)
+	}
+	return body, nil
+}
@@ -0,0 +1,497 @@
+package image
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/armor"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"github.com/ProtonMail/go-crypto/openpgp/packet"
+)
+
+// The checksum files in testdata copy the layout and file names of the files
+// published by Ubuntu, Debian, Fedora and FreeBSD. Their digests are
+// placeholders.
+
+func readTestdata(t *testing.T, name string) []byte {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return body
+}
+
+func TestChecksumParse(t *testing.T) {
+	tests := []struct {
+		name      string
+		file      string
+		checksum  Checksum
+		entry     string
+		want      string
+		wantError string
+	}{
+		{
+			name:  "ubuntu binary mode",
+			file:  "ubuntu-SHA256SUMS",
+			entry: "noble-server-cloudimg-amd64.img",
+			want:  "b776fcff89bf96258076898779565c53842c1b2cc0e2a89a89e329892aae638e",
+		},
+		{
+			name:     "ubuntu as gnu",
+			file:     "ubuntu-SHA256SUMS",
+			checksum: Checksum{Format: "gnu"},
+			entry:    "noble-server-cloudimg-arm64.img",
+			want:     "cf29744aa133c010f88ed6ed114ecac915b66e6bc5c0181a96bf19a6170c7a90",
+		},
+		{
+			name:      "ubuntu as bsd",
+			file:      "ubuntu-SHA256SUMS",
+			checksum:  Checksum{Format: "bsd"},
+			entry:     "noble-server-cloudimg-amd64.img",
+			wantError: `no sha256 checksum for "noble-server-cloudimg-amd64.img" found`,
+		},
+		{
+			name:      "ubuntu missing entry",
+			file:      "ubuntu-SHA256SUMS",
+			entry:     "noble-server-cloudimg-amd64.qcow2",
+			wantError: `no sha256 checksum for "noble-server-cloudimg-amd64.qcow2" found`,
+		},
+		{
+			name:     "debian sha512 text mode",
+			file:     "debian-SHA512SUMS",
+			checksum: Checksum{Algorithm: "SHA-512"},
+			entry:    "debian-13-generic-amd64.qcow2",
+			want:     "1791c20df9074eb283782b9b5818ef4a31af8d4eaf58afe9b8f0861c1f544e5fffa2a07da97752edad4deb04027d4477eb3e7b444e7be742342927cc3ab44ca6",
+		},
+		{
+			name:     "fedora",
+			file:     "fedora-CHECKSUM",
+			checksum: Checksum{Format: "fedora"},
+			entry:    "Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2",
+			want:     "cca784b04c09bd3bcdf114b762bcd8fb46a5734b2124a96f9617a08c213e7ceb",
+		},
+		{
+			name:  "fedora detected",
+			file:  "fedora-CHECKSUM",
+			entry: "Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2",
+			want:  "cca784b04c09bd3bcdf114b762bcd8fb46a5734b2124a96f9617a08c213e7ceb",
+		},
+		{
+			name:      "fedora as gnu",
+			file:      "fedora-CHECKSUM",
+			checksum:  Checksum{Format: "gnu"},
+			entry:     "Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2",
+			wantError: "no sha256 checksum",
+		},
+		{
+			name:      "fedora other algorithm",
+			file:      "fedora-CHECKSUM",
+			checksum:  Checksum{Algorithm: "sha512"},
+			entry:     "Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2",
+			wantError: "no sha512 checksum",
+		},
+		{
+			name:     "freebsd",
+			file:     "freebsd-CHECKSUM.SHA256",
+			checksum: Checksum{Format: "bsd"},
+			entry:    "FreeBSD-14.3-RELEASE-amd64-BASIC-CLOUDINIT-zfs.qcow2.xz",
+			want:     "eb807600a781a030a384ba17345923c4313ce6b83e40b9511f884e171e6d635d",
+		},
+		{
+			name:      "unsupported format",
+			file:      "ubuntu-SHA256SUMS",
+			checksum:  Checksum{Format: "md5sum"},
+			entry:     "noble-server-cloudimg-amd64.img",
+			wantError: `unsupported checksum format "md5sum"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.checksum.parse(readTestdata(t, tt.file), tt.entry)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("parse() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parse() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumParseLines(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		entry string
+		want  string
+	}{
+		{
+			name:  "entry in a directory",
+			body:  "0a1b  images/disk.img\nffee  other.img\n",
+			entry: "disk.img",
+			want:  "0a1b",
+		},
+		{
+			name:  "upper case digest",
+			body:  "SHA256 (disk.img) = 0A1B\n",
+			entry: "disk.img",
+			want:  "0a1b",
+		},
+		{
+			name:  "bsd without spaces",
+			body:  "SHA256(disk.img)= 0a1b\n",
+			entry: "disk.img",
+			want:  "0a1b",
+		},
+		{
+			name:  "name with spaces",
+			body:  "0a1b  my disk.img\n",
+			entry: "my disk.img",
+			want:  "0a1b",
+		},
+		{
+			name:  "lone digest",
+			body:  "# published for disk.img\n0a1b\n",
+			entry: "disk.img",
+			want:  "0a1b",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Checksum{}.parse([]byte(tt.body), tt.entry)
+			if err != nil {
+				t.Fatalf("parse() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("parse() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := (Checksum{}).parse([]byte("0a1b\nffee\n"), "disk.img"); err == nil {
+		t.Error("parse() of several lone digests succeeded, want an error")
+	}
+}
+
+func TestChecksumEntryName(t *testing.T) {
+	tests := []struct {
+		checksum Checksum
+		url      string
+		want     string
+	}{
+		{url: "https://cloud-images.ubuntu.com/noble/current/noble-server-cloudimg-amd64.img", want: "noble-server-cloudimg-amd64.img"},
+		{url: "https://example.com/images/disk.qcow2?token=abc#top", want: "disk.qcow2"},
+		{checksum: Checksum{File: "disk.raw.xz"}, url: "https://example.com/latest", want: "disk.raw.xz"},
+	}
+	for _, tt := range tests {
+		if got := tt.checksum.entryName(tt.url); got != tt.want {
+			t.Errorf("entryName(%q) = %s, want %s", tt.url, got, tt.want)
+		}
+	}
+}
+
+func TestChecksumExpected(t *testing.T) {
+	srv := httptest.NewServer(http.FileServer(http.Dir("testdata")))
+	defer srv.Close()
+
+	tests := []struct {
+		name      string
+		checksum  Checksum
+		url       string
+		want      string
+		wantError string
+	}{
+		{
+			name:     "value",
+			checksum: Checksum{Value: " 0A1B "},
+			want:     "0a1b",
+		},
+		{
+			name:      "value not hex",
+			checksum:  Checksum{Value: "sha256:0a1b"},
+			wantError: "is not a hex digest",
+		},
+		{
+			name:      "value with keyring",
+			checksum:  Checksum{Value: "0a1b", Keyring: "key.asc"},
+			wantError: "can't be signature-verified",
+		},
+		{
+			name:     "uncompressed only",
+			checksum: Checksum{Uncompressed: "0a1b"},
+			want:     "",
+		},
+		{
+			name:      "nothing",
+			checksum:  Checksum{},
+			wantError: "checksum needs a value, a url or an uncompressed digest",
+		},
+		{
+			name:      "unsupported algorithm",
+			checksum:  Checksum{Algorithm: "crc32", Value: "0a1b"},
+			wantError: `unsupported checksum algorithm "crc32"`,
+		},
+		{
+			name:     "url",
+			checksum: Checksum{URL: srv.URL + "/ubuntu-SHA256SUMS"},
+			url:      "https://cloud-images.ubuntu.com/noble/current/noble-server-cloudimg-amd64.img",
+			want:     "b776fcff89bf96258076898779565c53842c1b2cc0e2a89a89e329892aae638e",
+		},
+		{
+			name:     "url with file",
+			checksum: Checksum{URL: srv.URL + "/fedora-CHECKSUM", File: "Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2"},
+			url:      "https://example.com/fedora/latest",
+			want:     "cca784b04c09bd3bcdf114b762bcd8fb46a5734b2124a96f9617a08c213e7ceb",
+		},
+		{
+			name:      "url not found",
+			checksum:  Checksum{URL: srv.URL + "/SHA256SUMS"},
+			url:       "https://example.com/disk.img",
+			wantError: "404 Not Found",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.checksum.Expected(tt.url)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Expected() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+// signer is an OpenPGP key for signing checksum files in tests, along with a
+// keyring file holding its public key.
+type signer struct {
+	entity  *openpgp.Entity
+	keyring string
+}
+
+func newSigner(t *testing.T, name string) signer {
+	t.Helper()
+	config := &packet.Config{Algorithm: packet.PubKeyAlgoEdDSA}
+	e, err := openpgp.NewEntity(name, "", name+"@example.com", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var b bytes.Buffer
+	w, err := armor.Encode(&b, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	keyring := filepath.Join(t.TempDir(), name+".asc")
+	if err := os.WriteFile(keyring, b.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return signer{entity: e, keyring: keyring}
+}
+
+func (s signer) clearsign(t *testing.T, body []byte) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	w, err := clearsign.Encode(&b, s.entity.PrivateKey, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := w.Write(body); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func (s signer) detach(t *testing.T, body []byte, armored bool) []byte {
+	t.Helper()
+	var b bytes.Buffer
+	sign := openpgp.DetachSign
+	if armored {
+		sign = openpgp.ArmoredDetachSign
+	}
+	if err := sign(&b, s.entity, bytes.NewReader(body), nil); err != nil {
+		t.Fatal(err)
+	}
+	return b.Bytes()
+}
+
+func TestChecksumSignature(t *testing.T) {
+	fedora := readTestdata(t, "fedora-CHECKSUM")
+	ubuntu := readTestdata(t, "ubuntu-SHA256SUMS")
+	release := newSigner(t, "release")
+	other := newSigner(t, "other")
+
+	tampered := release.clearsign(t, fedora)
+	tampered = bytes.Replace(tampered, []byte("cca784b0"), []byte("00000000"), 1)
+
+	files := map[string][]byte{
+		"/CHECKSUM":             release.clearsign(t, fedora),
+		"/CHECKSUM.other":       other.clearsign(t, fedora),
+		"/CHECKSUM.tampered":    tampered,
+		"/SHA256SUMS":           ubuntu,
+		"/SHA256SUMS.gpg":       release.detach(t, ubuntu, false),
+		"/SHA256SUMS.asc":       release.detach(t, ubuntu, true),
+		"/SHA256SUMS.other.gpg": other.detach(t, ubuntu, false),
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		_, _ = w.Write(body)
+	}))
+	defer srv.Close()
+
+	const (
+		fedoraImage = "https://download.fedoraproject.org/pub/fedora/linux/releases/41/Cloud/x86_64/images/Fedora-Cloud-Base-Generic-41-1.4.x86_64.qcow2"
+		fedoraSum   = "cca784b04c09bd3bcdf114b762bcd8fb46a5734b2124a96f9617a08c213e7ceb"
+		ubuntuImage = "https://cloud-images.ubuntu.com/noble/current/noble-server-cloudimg-amd64.img"
+		ubuntuSum   = "b776fcff89bf96258076898779565c53842c1b2cc0e2a89a89e329892aae638e"
+	)
+	tests := []struct {
+		name      string
+		checksum  Checksum
+		url       string
+		want      string
+		wantError string
+	}{
+		{
+			name:     "clearsigned",
+			checksum: Checksum{URL: srv.URL + "/CHECKSUM", Format: "fedora", Keyring: release.keyring},
+			url:      fedoraImage,
+			want:     fedoraSum,
+		},
+		{
+			name:     "clearsigned without keyring",
+			checksum: Checksum{URL: srv.URL + "/CHECKSUM", Format: "fedora"},
+			url:      fedoraImage,
+			want:     fedoraSum,
+		},
+		{
+			name:      "clearsigned by another key",
+			checksum:  Checksum{URL: srv.URL + "/CHECKSUM.other", Keyring: release.keyring},
+			url:       fedoraImage,
+			wantError: "invalid signature for checksum file",
+		},
+		{
+			name:      "clearsigned and tampered with",
+			checksum:  Checksum{URL: srv.URL + "/CHECKSUM.tampered", Keyring: release.keyring},
+			url:       fedoraImage,
+			wantError: "invalid signature for checksum file",
+		},
+		{
+			name:     "detached",
+			checksum: Checksum{URL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/SHA256SUMS.gpg", Keyring: release.keyring},
+			url:      ubuntuImage,
+			want:     ubuntuSum,
+		},
+		{
+			name:     "detached armored",
+			checksum: Checksum{URL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/SHA256SUMS.asc", Keyring: release.keyring},
+			url:      ubuntuImage,
+			want:     ubuntuSum,
+		},
+		{
+			name:      "detached by another key",
+			checksum:  Checksum{URL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/SHA256SUMS.other.gpg", Keyring: release.keyring},
+			url:       ubuntuImage,
+			wantError: "invalid signature for checksum file",
+		},
+		{
+			name:      "detached signature of another file",
+			checksum:  Checksum{URL: srv.URL + "/CHECKSUM", SignatureURL: srv.URL + "/SHA256SUMS.gpg", Keyring: release.keyring},
+			url:       fedoraImage,
+			wantError: "invalid signature for checksum file",
+		},
+		{
+			name:      "not signed",
+			checksum:  Checksum{URL: srv.URL + "/SHA256SUMS", Keyring: release.keyring},
+			url:       ubuntuImage,
+			wantError: "is not clearsigned and no signature_url is set",
+		},
+		{
+			name:      "signature without keyring",
+			checksum:  Checksum{URL: srv.URL + "/SHA256SUMS", SignatureURL: srv.URL + "/SHA256SUMS.gpg"},
+			url:       ubuntuImage,
+			wantError: "signature_url requires a keyring",
+		},
+		{
+			name:      "missing keyring",
+			checksum:  Checksum{URL: srv.URL + "/CHECKSUM", Keyring: filepath.Join(t.TempDir(), "missing.asc")},
+			url:       fedoraImage,
+			wantError: "open keyring",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.checksum.Expected(tt.url)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Expected() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Expected() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("Expected() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestChecksumVerify(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "disk.img")
+	if err := os.WriteFile(file, []byte("disk image\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		checksum  Checksum
+		expected  string
+		wantError string
+	}{
+		{checksum: Checksum{}, expected: "c8885b679757df10e37e1e4100ee519611f492dea2734540cbb8fe2f45a39833"},
+		{checksum: Checksum{}, expected: "C8885B679757DF10E37E1E4100EE519611F492DEA2734540CBB8FE2F45A39833"},
+		{checksum: Checksum{Algorithm: "md5"}, expected: "26c8ca2d49c24ed3f673bfd2dc3b6dc9"},
+		{checksum: Checksum{}, expected: "26c8ca2d49c24ed3f673bfd2dc3b6dc9", wantError: "sha256 checksum mismatch for disk.img"},
+	}
+	for _, tt := range tests {
+		err := tt.checksum.Verify(file, tt.expected)
+		if tt.wantError == "" && err != nil {
+			t.Errorf("Verify(%s) error = %v", tt.expected, err)
+		}
+		if tt.wantError != "" && (err == nil || !strings.Contains(err.Error(), tt.wantError)) {
+			t.Errorf("Verify(%s) error = %v, want %q", tt.expected, err, tt.wantError)
+		}
+	}
+}
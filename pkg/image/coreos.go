@@ -0,0 +1,118 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// coreOSStreamBase is where Fedora CoreOS publishes its stream metadata.
+const coreOSStreamBase = "https://builds.coreos.fedoraproject.org/streams/"
+
+// Stream selects an artifact from CoreOS stream metadata.
+type Stream struct {
+	// Name is the stream to follow, e.g. stable, testing or next. It is ignored
+	// if URL is set.
+	Name string `yaml:"name,omitempty"`
+	// URL overrides the stream metadata URL.
+	URL string `yaml:"url,omitempty"`
+	// Architecture defaults to the image's architecture property.
+	Architecture string `yaml:"architecture,omitempty"`
+	// Platform defaults to openstack.
+	Platform string `yaml:"platform,omitempty"`
+	// Format defaults to qcow2.xz.
+	Format string `yaml:"format,omitempty"`
+}
+
+// coreOSStream is the subset of the stream metadata format that is needed to
+// pick a disk image.
+type coreOSStream struct {
+	Stream        string `json:"stream"`
+	Architectures map[string]struct {
+		Artifacts map[string]struct {
+			Release string `json:"release"`
+			Formats map[string]struct {
+				Disk *struct {
+					Location           string `json:"location"`
+					Sha256             string `json:"sha256"`
+					UncompressedSha256 string `json:"uncompressed-sha256"`
+				} `json:"disk"`
+			} `json:"formats"`
+		} `json:"artifacts"`
+	} `json:"architectures"`
+}
+
+// streamURL returns the stream metadata URL.
+func (s Stream) streamURL() string {
+	if s.URL != "" {
+		return s.URL
+	}
+	name := s.Name
+	if name == "" {
+		name = "stable"
+	}
+	return coreOSStreamBase + name + ".json"
+}
+
+// resolveCoreOSStream points the image at the current artifact of its CoreOS
+// stream, verified with the digests published in the stream.
+func (i *Image) resolveCoreOSStream() error {
+	s := Stream{}
+	if i.Stream != nil {
+		s = *i.Stream
+	}
+	arch := s.Architecture
+	if arch == "" {
+		arch = i.Properties["architecture"]
+	}
+	platform := s.Platform
+	if platform == "" {
+		platform = "openstack"
+	}
+	format := s.Format
+	if format == "" {
+		format = "qcow2.xz"
+	}
+
+	streamURL := s.streamURL()
+	zap.S().Infow("Fetching CoreOS stream metadata", "url", streamURL, "architecture", arch, "platform", platform, "format", format)
+	body, err := fetchSmall(streamURL)
+	if err != nil {
+		return err
+	}
+	var meta coreOSStream
+	if err := json.Unmarshal(body, &meta); err != nil {
+		return fmt.Errorf("parse stream metadata %s: %w", streamURL, err)
+	}
+
+	artifact, ok := meta.Architectures[arch].Artifacts[platform]
+	if !ok {
+		return fmt.Errorf("stream %s has no %s artifact for %s", streamURL, platform, arch)
+	}
+	f, ok := artifact.Formats[format]
+	if !ok || f.Disk == nil || f.Disk.Location == "" {
+		return fmt.Errorf("stream %s has no %s disk for the %s %s artifact", streamURL, format, arch, platform)
+	}
+
+	// Trust the digests in the stream unless the config provides its own
+	if i.Checksum == nil {
+		i.Checksum = &Checksum{Value: f.Disk.Sha256, Uncompressed: f.Disk.UncompressedSha256}
+	}
+	if i.Compression == "" && strings.Contains(format, ".") {
+		i.Compression = format[strings.LastIndex(format, ".")+1:]
+	}
+	if i.SourceFormat == "" {
+		i.SourceFormat = strings.SplitN(format, ".", 2)[0]
+	}
+
+	// os_version is left unset, since the major version of the release would
+	// make each Fedora release a different image instead of the next version
+	// of this one
+	if meta.Stream != "" {
+		i.Properties["coreos_stream"] = meta.Stream
+	}
+	i.setResolved(f.Disk.Location, artifact.Release)
+	return nil
+}
@@ -0,0 +1,124 @@
+package image
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveCoreOSStream(t *testing.T) {
+	// coreos-stable.json has the layout of the stable stream metadata, trimmed
+	// to a few artifacts
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFile(w, r, "testdata/coreos-stable.json")
+	}))
+	defer srv.Close()
+
+	const builds = "https://builds.coreos.fedoraproject.org/prod/streams/stable/builds/42.20250929.3.0/"
+	tests := []struct {
+		name         string
+		stream       Stream
+		architecture string
+		checksum     *Checksum
+		wantURL      string
+		wantComp     string
+		wantFormat   string
+		wantChecksum string
+		wantError    string
+	}{
+		{
+			name:         "defaults",
+			wantURL:      builds + "x86_64/fedora-coreos-42.20250929.3.0-openstack.x86_64.qcow2.xz",
+			wantComp:     "xz",
+			wantFormat:   "qcow2",
+			wantChecksum: "04706c460c5962c11f1dd9f829fdbafbbd0527ae83e17af96babfd777c6be466",
+		},
+		{
+			name:         "architecture from properties",
+			architecture: "aarch64",
+			wantURL:      builds + "aarch64/fedora-coreos-42.20250929.3.0-openstack.aarch64.qcow2.xz",
+			wantComp:     "xz",
+			wantFormat:   "qcow2",
+		},
+		{
+			name:       "platform and format",
+			stream:     Stream{Platform: "metal", Format: "raw.xz"},
+			wantURL:    builds + "x86_64/fedora-coreos-42.20250929.3.0-metal.x86_64.raw.xz",
+			wantComp:   "xz",
+			wantFormat: "raw",
+		},
+		{
+			name:       "uncompressed format",
+			stream:     Stream{Platform: "metal", Format: "iso"},
+			wantURL:    builds + "x86_64/fedora-coreos-42.20250929.3.0-live.x86_64.iso",
+			wantComp:   "",
+			wantFormat: "iso",
+		},
+		{
+			name:       "configured checksum",
+			checksum:   &Checksum{URL: "https://example.com/CHECKSUM"},
+			wantURL:    builds + "x86_64/fedora-coreos-42.20250929.3.0-openstack.x86_64.qcow2.xz",
+			wantComp:   "xz",
+			wantFormat: "qcow2",
+		},
+		{
+			name:      "no artifact for the platform",
+			stream:    Stream{Platform: "azure"},
+			wantError: "has no azure artifact for x86_64",
+		},
+		{
+			name:         "no artifact for the architecture",
+			architecture: "s390x",
+			wantError:    "has no openstack artifact for s390x",
+		},
+		{
+			name:      "no disk in the format",
+			stream:    Stream{Format: "vmdk"},
+			wantError: "has no vmdk disk for the x86_64 openstack artifact",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stream := tt.stream
+			stream.URL = srv.URL + "/streams/stable.json"
+			i := Image{Name: "Fedora CoreOS", Source: SourceCoreOSStream, Stream: &stream, Checksum: tt.checksum}
+			if tt.architecture != "" {
+				i.Properties = map[string]string{"architecture": tt.architecture}
+			}
+			i.Init()
+
+			err := i.Resolve()
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Resolve() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if i.Url != tt.wantURL {
+				t.Errorf("url = %s, want %s", i.Url, tt.wantURL)
+			}
+			if i.Compression != tt.wantComp || i.SourceFormat != tt.wantFormat {
+				t.Errorf("compression, source_format = %q, %q, want %q, %q", i.Compression, i.SourceFormat, tt.wantComp, tt.wantFormat)
+			}
+			for key, want := range map[string]string{"source_version": "42.20250929.3.0", "os_version": "", "coreos_stream": "stable"} {
+				if got := i.Properties[key]; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+			switch {
+			case tt.checksum != nil:
+				if i.Checksum != tt.checksum {
+					t.Errorf("checksum = %+v, want the configured one", i.Checksum)
+				}
+			case i.Checksum == nil || i.Checksum.Value == "" || i.Checksum.Uncompressed == "":
+				t.Errorf("checksum = %+v, want the digests of the stream", i.Checksum)
+			case tt.wantChecksum != "" && i.Checksum.Value != tt.wantChecksum:
+				t.Errorf("checksum = %s, want %s", i.Checksum.Value, tt.wantChecksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,417 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+	"go.uber.org/zap"
+)
+
+// Normalized compression values. Archives are "tar", optionally combined
+// with a stream compression as in "tar.xz", or "zip".
+const (
+	compressionNone = ""
+	compressionXZ   = "xz"
+	compressionGzip = "gz"
+	compressionZstd = "zst"
+	compressionBz2  = "bz2"
+	compressionTar  = "tar"
+	compressionZip  = "zip"
+)
+
+// compressionAliases maps the accepted values of the compression setting to
+// their normalized form.
+var compressionAliases = map[string]string{
+	"none":     compressionNone,
+	"xz":       compressionXZ,
+	"gz":       compressionGzip,
+	"gzip":     compressionGzip,
+	"zst":      compressionZstd,
+	"zstd":     compressionZstd,
+	"bz2":      compressionBz2,
+	"bzip2":    compressionBz2,
+	"tar":      compressionTar,
+	"tar.xz":   "tar.xz",
+	"txz":      "tar.xz",
+	"tar.gz":   "tar.gz",
+	"tgz":      "tar.gz",
+	"tar.zst":  "tar.zst",
+	"tar.zstd": "tar.zst",
+	"tzst":     "tar.zst",
+	"tar.bz2":  "tar.bz2",
+	"tbz2":     "tar.bz2",
+	"zip":      compressionZip,
+}
+
+// Compressions lists the valid values of compression.
+func Compressions() []string {
+	return slices.Sorted(maps.Keys(compressionAliases))
+}
+
+// compressionSuffixes infers the compression from a file name, longest
+// suffixes first.
+var compressionSuffixes = []struct{ suffix, compression string }{
+	{".tar.xz", "tar.xz"},
+	{".tar.gz", "tar.gz"},
+	{".tar.zst", "tar.zst"},
+	{".tar.bz2", "tar.bz2"},
+	{".txz", "tar.xz"},
+	{".tgz", "tar.gz"},
+	{".tzst", "tar.zst"},
+	{".tbz2", "tar.bz2"},
+	{".tar", compressionTar},
+	{".zip", compressionZip},
+	{".xz", compressionXZ},
+	{".gz", compressionGzip},
+	{".zst", compressionZstd},
+	{".bz2", compressionBz2},
+}
+
+// compressionFor returns the normalized compression of a downloaded file,
+// from the configured value or, if that is unset, from the file name.
+func compressionFor(configured string, name string) string {
+	comp := strings.ToLower(strings.TrimSpace(configured))
+	if comp != "" {
+		if normalized, ok := compressionAliases[comp]; ok {
+			return normalized
+		}
+		zap.S().Warnf("Unknown compression value %q; attempting to infer by extension", comp)
+	}
+
+	l := strings.ToLower(name)
+	for _, s := range compressionSuffixes {
+		if strings.HasSuffix(l, s.suffix) {
+			return s.compression
+		}
+	}
+	return compressionNone
+}
+
+// decompressReader wraps r in a reader for a stream compression.
+func decompressReader(compression string, r io.Reader) (io.ReadCloser, error) {
+	switch compression {
+	case compressionNone:
+		return io.NopCloser(r), nil
+	case compressionXZ:
+		xr, err := xz.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return io.NopCloser(xr), nil
+	case compressionGzip:
+		return gzip.NewReader(r)
+	case compressionZstd:
+		// A single decoder decompresses in the calling goroutine, which keeps
+		// decompressor timings meaningful
+		zr, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case compressionBz2:
+		return io.NopCloser(bzip2.NewReader(r)), nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", compression)
+}
+
+// compressionMagic lists the magic bytes that start a compressed file.
+var compressionMagic = []struct {
+	compression string
+	magic       []byte
+}{
+	{compressionXZ, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+	{compressionGzip, []byte{0x1f, 0x8b}},
+	{compressionZstd, []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{compressionBz2, []byte("BZh")},
+	{compressionZip, []byte("PK\x03\x04")},
+}
+
+// sniffLen is how much of a file is read to detect its compression. POSIX tar
+// archives have their magic at offset 257.
+const sniffLen = 512
+
+// isTar reports whether head is the start of a POSIX tar archive.
+func isTar(head []byte) bool {
+	return len(head) >= 262 && bytes.Equal(head[257:262], []byte("ustar"))
+}
+
+// sniffCompression detects the compression of a file from its first bytes.
+func sniffCompression(head []byte) string {
+	for _, m := range compressionMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.compression
+		}
+	}
+	if isTar(head) {
+		return compressionTar
+	}
+	return compressionNone
+}
+
+// compressionLabel returns a compression for logging.
+func compressionLabel(compression string) string {
+	if compression == compressionNone {
+		return "none"
+	}
+	return compression
+}
+
+// decompressor decompresses a download as it is read. The compression is
+// detected from the magic bytes of the download, which take precedence over
+// the configured compression and the file name.
+type decompressor struct {
+	// compression is the normalized compression of the download
+	compression string
+	// raw reads the download itself and r its decompressed content. Zip
+	// archives can't be read as a stream, so for them r is nil.
+	raw    *bufio.Reader
+	r      io.Reader
+	closer io.Closer
+	// decoding is the time spent reading r, or extracting a zip archive, and
+	// reading the part of it spent waiting for the download.
+	decoding time.Duration
+	reading  time.Duration
+}
+
+// timedReader adds the time spent reading r to total.
+type timedReader struct {
+	r     io.Reader
+	total *time.Duration
+}
+
+func (t timedReader) Read(p []byte) (int, error) {
+	start := time.Now()
+	n, err := t.r.Read(p)
+	*t.total += time.Since(start)
+	return n, err
+}
+
+// newDecompressor starts decompressing in, which was downloaded as name.
+func newDecompressor(in io.Reader, configured string, name string) (*decompressor, error) {
+	d := &decompressor{raw: bufio.NewReaderSize(in, 64*1024)}
+	d.r = d.raw
+	head, err := d.raw.Peek(sniffLen)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+
+	detected := sniffCompression(head)
+	switch detected {
+	case compressionXZ, compressionGzip, compressionZstd, compressionBz2:
+		dr, err := decompressReader(detected, timedReader{d.raw, &d.reading})
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+		d.closer = dr
+		br := bufio.NewReaderSize(timedReader{dr, &d.decoding}, 64*1024)
+		inner, err := br.Peek(sniffLen)
+		if err != nil && err != io.EOF {
+			_ = dr.Close()
+			return nil, fmt.Errorf("failed to decompress %s: %w", name, err)
+		}
+		if isTar(inner) {
+			detected = compressionTar + "." + detected
+		}
+		d.r = br
+	case compressionZip:
+		d.r = nil
+	}
+	d.compression = reconcileCompression(configured, name, detected)
+	return d, nil
+}
+
+// reconcileCompression decides between the compression configured for or
+// inferred from the name of a download and the one detected from its content.
+func reconcileCompression(configured string, name string, detected string) string {
+	want := compressionFor(configured, name)
+	switch {
+	case want == detected:
+		return want
+	case want == compressionTar && detected == compressionNone, want == compressionTar+"."+detected:
+		// Tar archives older than POSIX have no magic bytes
+		return want
+	case strings.TrimSpace(configured) != "":
+		zap.S().Warnw("Detected compression differs from configured compression; using detected", "file", name, "configured", configured, "detected", compressionLabel(detected))
+	case want != compressionNone:
+		zap.S().Warnw("Detected compression differs from file name; using detected", "file", name, "inferred", compressionLabel(want), "detected", compressionLabel(detected))
+	default:
+		zap.S().Infow("Detected compression from file content", "file", name, "detected", compressionLabel(detected))
+	}
+	return detected
+}
+
+// elapsed returns how long decompressing took, not counting the time spent
+// waiting for the download.
+func (d *decompressor) elapsed() time.Duration {
+	return max(0, d.decoding-d.reading)
+}
+
+// Close stops decompressing.
+func (d *decompressor) Close() error {
+	if d.closer == nil {
+		return nil
+	}
+	return d.closer.Close()
+}
+
+// unpack writes the decompressed content r of a download named name into
+// workDir and returns the path of the disk image. Tar archives are searched
+// for the most likely disk image as described at imageRank. Zip archives
+// can't be read as a stream; use unpackZip for them.
+func unpack(compression string, r io.Reader, name string, workDir string) (string, error) {
+	if compression == compressionNone {
+		outName := filepath.Join(workDir, name)
+		return outName, writeFile(outName, r)
+	}
+
+	zap.S().Infow("Decompressing image", "compression", compression, "input", name)
+	if strings.HasPrefix(compression, compressionTar) {
+		return extractTar(r, name, workDir)
+	}
+
+	outName := filepath.Join(workDir, strings.TrimSuffix(name, filepath.Ext(name)))
+	if err := writeFile(outName, r); err != nil {
+		return "", err
+	}
+	zap.S().Infow("Decompression complete", "compression", compression, "input", name, "output", outName)
+	return outName, nil
+}
+
+// writeFile writes r to a new file, removing it again if that fails.
+func writeFile(name string, r io.Reader) error {
+	out, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, r)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(name)
+	}
+	return err
+}
+
+// imageRank ranks an archive member by how likely it is to be the disk
+// image: a member named "disk.raw" first, then by extension in priority
+// order .raw, .qcow2, .img, .vmdk, .vdi, and then any other file. Lower is
+// better.
+func imageRank(member string) int {
+	if strings.EqualFold(filepath.Base(member), "disk.raw") {
+		return 0
+	}
+	for idx, ext := range []string{".raw", ".qcow2", ".img", ".vmdk", ".vdi"} {
+		if strings.EqualFold(filepath.Ext(member), ext) {
+			return idx + 1
+		}
+	}
+	return 6
+}
+
+// memberPath returns where an archive member is extracted to.
+func memberPath(member string, workDir string) string {
+	outName := filepath.Base(member)
+	if outName == "" || outName == "." || outName == "/" {
+		outName = "extracted-image"
+	}
+	return filepath.Join(workDir, outName)
+}
+
+// extractTar extracts the most likely disk image from a tar stream in a
+// single pass. Whenever a better candidate than the one extracted so far
+// comes along, it replaces it.
+func extractTar(r io.Reader, name string, workDir string) (string, error) {
+	tr := tar.NewReader(r)
+	best, bestRank, bestPath := "", imageRank("")+1, ""
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			if bestPath != "" {
+				_ = os.Remove(bestPath)
+			}
+			return "", fmt.Errorf("failed to read tar archive %s: %w", name, err)
+		}
+		if !isRegular(hdr) || imageRank(hdr.Name) >= bestRank {
+			continue
+		}
+
+		outName := memberPath(hdr.Name, workDir)
+		if bestPath != "" {
+			_ = os.Remove(bestPath)
+		}
+		zap.S().Infow("Extracting member from tar archive", "archive", name, "member", hdr.Name, "output", outName)
+		if err := writeFile(outName, tr); err != nil {
+			return "", err
+		}
+		best, bestRank, bestPath = hdr.Name, imageRank(hdr.Name), outName
+	}
+	if best == "" {
+		return "", fmt.Errorf("no suitable image file found in tar archive %s", name)
+	}
+	zap.S().Infow("Extraction complete", "archive", name, "member", best, "output", bestPath)
+	return bestPath, nil
+}
+
+// isRegular reports whether a tar member is a regular file. The holes of GNU
+// sparse files are filled in by the tar reader.
+func isRegular(hdr *tar.Header) bool {
+	switch hdr.Typeflag {
+	case tar.TypeReg, tar.TypeRegA, tar.TypeGNUSparse:
+		return true
+	}
+	return false
+}
+
+// unpackZip extracts the most likely disk image from a zip archive into
+// workDir and returns its path.
+func unpackZip(archive string, workDir string) (string, error) {
+	zr, err := zip.OpenReader(archive)
+	if err != nil {
+		return "", fmt.Errorf("failed to read zip archive %s: %w", filepath.Base(archive), err)
+	}
+	defer zr.Close()
+
+	var best *zip.File
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		if best == nil || imageRank(f.Name) < imageRank(best.Name) {
+			best = f
+		}
+	}
+	if best == nil {
+		return "", fmt.Errorf("no suitable image file found in zip archive %s", filepath.Base(archive))
+	}
+
+	outName := memberPath(best.Name, workDir)
+	zap.S().Infow("Extracting member from zip archive", "archive", archive, "member", best.Name, "output", outName)
+	rc, err := best.Open()
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+	if err := writeFile(outName, rc); err != nil {
+		return "", err
+	}
+	zap.S().Infow("Extraction complete", "archive", archive, "member", best.Name, "output", outName)
+	return outName, nil
+}
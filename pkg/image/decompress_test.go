@@ -0,0 +1,212 @@
+package image
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// payload is the disk image inside the compressed fixtures.
+var payload = bytes.Repeat([]byte("disk image\n"), 4)
+
+// bzip2Payload is payload compressed with bzip2, which the standard library
+// can only decompress.
+var bzip2Payload = []byte("\x42\x5a\x68\x39\x31\x41\x59\x26\x53\x59\x19\x92\x46\xe4\x00\x00\x07\xd1\x80\x00\x10\x40\x00\x26\xaa\x08\x00\x20\x00\x31\x00\x30\x0a\xa8\x0d\xa9\xa7\x08\x78\xd9\x0a\x28\x85\x96\x3e\x2e\xe4\x8a\x70\xa1\x20\x33\x24\x8d\xc8")
+
+func compressXZ(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressGzip(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, _ = w.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func compressZstd(t *testing.T, data []byte) []byte {
+	t.Helper()
+	w, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+	return w.EncodeAll(data, nil)
+}
+
+// tarOf returns a tar archive of the given members, in order.
+func tarOf(t *testing.T, members ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := tar.NewWriter(&buf)
+	for _, name := range members {
+		content := []byte(name + " content")
+		if name == "disk.raw" {
+			content = payload
+		}
+		if err := w.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(content)), Format: tar.FormatUSTAR}); err != nil {
+			t.Fatal(err)
+		}
+		_, _ = w.Write(content)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// zipOf returns a zip archive of the given members, in order.
+func zipOf(t *testing.T, members ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for _, name := range members {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if name == "disk.raw" {
+			_, _ = f.Write(payload)
+		} else {
+			_, _ = f.Write([]byte(name + " content"))
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestNewDecompressor(t *testing.T) {
+	archive := tarOf(t, "README", "disk.vmdk", "disk.raw")
+	tests := []struct {
+		name       string
+		data       []byte
+		configured string
+		file       string
+		want       string
+		// wantData is what the decompressor reads, unless the download is a zip
+		// archive
+		wantData []byte
+	}{
+		{"xz", compressXZ(t, payload), "", "image.raw.xz", compressionXZ, payload},
+		{"gzip", compressGzip(t, payload), "", "image.raw.gz", compressionGzip, payload},
+		{"zstd", compressZstd(t, payload), "", "image.raw.zst", compressionZstd, payload},
+		{"bzip2", bzip2Payload, "", "image.raw.bz2", compressionBz2, payload},
+		{"uncompressed", payload, "", "image.raw", compressionNone, payload},
+		{"tar", archive, "", "image.tar", compressionTar, archive},
+		{"tar.xz", compressXZ(t, archive), "", "image.tar.xz", "tar.xz", archive},
+		{"tar.gz named tgz", compressGzip(t, archive), "", "image.tgz", "tar.gz", archive},
+		{"tar.zst", compressZstd(t, archive), "zstd", "image", "tar.zst", archive},
+		{"zip", zipOf(t, "disk.raw"), "", "image.zip", compressionZip, nil},
+		{"configured tar.xz without ustar magic", compressXZ(t, payload), "tar.xz", "image.tar.xz", "tar.xz", payload},
+		{"configured xz is tar.xz", compressXZ(t, archive), "xz", "image.xz", "tar.xz", archive},
+		{"configured none is gzip", compressGzip(t, payload), "none", "image.raw", compressionGzip, payload},
+		{"named xz but uncompressed", payload, "", "image.raw.xz", compressionNone, payload},
+		{"configured tar without ustar magic", payload, "tar", "image", compressionTar, payload},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d, err := newDecompressor(bytes.NewReader(tt.data), tt.configured, tt.file)
+			if err != nil {
+				t.Fatalf("newDecompressor() error = %v", err)
+			}
+			defer d.Close()
+			if d.compression != tt.want {
+				t.Errorf("compression = %q, want %q", d.compression, tt.want)
+			}
+			if tt.want == compressionZip {
+				if d.r != nil {
+					t.Errorf("zip archive is read as a stream")
+				}
+				return
+			}
+			got, err := io.ReadAll(d.r)
+			if err != nil {
+				t.Fatalf("read error = %v", err)
+			}
+			if !bytes.Equal(got, tt.wantData) {
+				t.Errorf("read %q, want %q", got, tt.wantData)
+			}
+		})
+	}
+}
+
+func TestUnpackArchives(t *testing.T) {
+	dir := t.TempDir()
+
+	d, err := newDecompressor(bytes.NewReader(compressXZ(t, tarOf(t, "README", "image.qcow2", "disk.raw", "disk.img"))), "", "image.tar.xz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	got, err := unpack(d.compression, d.r, "image.tar.xz", dir)
+	if err != nil {
+		t.Fatalf("unpack() error = %v", err)
+	}
+	if filepath.Base(got) != "disk.raw" {
+		t.Errorf("unpack() = %s, want disk.raw", got)
+	}
+	if data, _ := os.ReadFile(got); !bytes.Equal(data, payload) {
+		t.Errorf("unpack() extracted %q, want %q", data, payload)
+	}
+
+	archive := filepath.Join(dir, "image.zip")
+	if err := os.WriteFile(archive, zipOf(t, "README", "disk.raw", "disk.vmdk"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	zipDir := filepath.Join(dir, "zip")
+	if err := os.Mkdir(zipDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	got, err = unpackZip(archive, zipDir)
+	if err != nil {
+		t.Fatalf("unpackZip() error = %v", err)
+	}
+	if data, _ := os.ReadFile(got); filepath.Base(got) != "disk.raw" || !bytes.Equal(data, payload) {
+		t.Errorf("unpackZip() = %s containing %q, want disk.raw containing %q", got, data, payload)
+	}
+
+	// gnu-sparse.tar was written by tar --format=gnu -S: disk.raw is the
+	// payload, a 1 MiB hole and the payload again
+	sparse, err := os.Open("testdata/gnu-sparse.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sparse.Close()
+	sparseDir := filepath.Join(dir, "sparse")
+	if err := os.Mkdir(sparseDir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	got, err = extractTar(sparse, "gnu-sparse.tar", sparseDir)
+	if err != nil {
+		t.Fatalf("extractTar() error = %v", err)
+	}
+	want := append(append(slices.Clone(payload), make([]byte, 1<<20-len(payload))...), payload...)
+	if data, _ := os.ReadFile(got); filepath.Base(got) != "disk.raw" || !bytes.Equal(data, want) {
+		t.Errorf("extractTar() = %s with %d bytes, want disk.raw with %d bytes", got, len(data), len(want))
+	}
+}
@@ -0,0 +1,139 @@
+package image
+
+import (
+	"fmt"
+	"html"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Discover finds the latest version of an image in an HTML or autoindex
+// directory listing.
+type Discover struct {
+	// IndexURL is the URL of the directory listing.
+	IndexURL string `yaml:"index_url"`
+	// Pattern is a regular expression matched against every link in the
+	// listing. The version is taken from the group named "version", or the
+	// first group if there is no such group.
+	Pattern string `yaml:"pattern"`
+}
+
+var hrefAttr = regexp.MustCompile(`(?i)href\s*=\s*["']([^"'#?]+)`)
+
+// Latest returns the download URL and version of the highest version linked
+// from the listing. If urlTemplate is set, "{version}" in it is replaced by the
+// version; otherwise the matching link itself is used.
+func (d Discover) Latest(urlTemplate string) (string, string, error) {
+	if d.IndexURL == "" || d.Pattern == "" {
+		return "", "", fmt.Errorf("discover needs both index_url and pattern")
+	}
+	re, err := regexp.Compile(d.Pattern)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid discover pattern: %w", err)
+	}
+	group := re.SubexpIndex("version")
+	if group < 0 {
+		if re.NumSubexp() < 1 {
+			return "", "", fmt.Errorf("discover pattern %q has no version capture group", d.Pattern)
+		}
+		group = 1
+	}
+	base, err := url.Parse(d.IndexURL)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid index_url: %w", err)
+	}
+
+	zap.S().Infow("Fetching directory listing", "url", d.IndexURL, "pattern", d.Pattern)
+	body, err := fetchSmall(d.IndexURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	var bestVersion, bestLink string
+	for _, m := range hrefAttr.FindAllStringSubmatch(string(body), -1) {
+		link := strings.TrimPrefix(html.UnescapeString(m[1]), "./")
+		if unescaped, err := url.PathUnescape(link); err == nil {
+			link = unescaped
+		}
+		sub := re.FindStringSubmatch(link)
+		if sub == nil || sub[group] == "" {
+			continue
+		}
+		if bestLink == "" || compareVersions(sub[group], bestVersion) > 0 {
+			bestVersion, bestLink = sub[group], link
+		}
+	}
+	if bestLink == "" {
+		return "", "", fmt.Errorf("no link in %s matches %q", d.IndexURL, d.Pattern)
+	}
+
+	if urlTemplate != "" {
+		return strings.ReplaceAll(urlTemplate, "{version}", bestVersion), bestVersion, nil
+	}
+	ref, err := url.Parse(bestLink)
+	if err != nil {
+		return "", "", fmt.Errorf("invalid link %q in %s: %w", bestLink, d.IndexURL, err)
+	}
+	return base.ResolveReference(ref).String(), bestVersion, nil
+}
+
+// versionChunks splits a version into alternating runs of digits and
+// non-digits.
+var versionChunks = regexp.MustCompile(`\d+|\D+`)
+
+// compareVersions orders versions naturally, so numeric parts compare as
+// numbers ("3.10" > "3.9") and semver pre-releases sort before their release
+// ("1.0.0-rc1" < "1.0.0"). It returns -1, 0 or 1.
+func compareVersions(a, b string) int {
+	a = strings.TrimPrefix(strings.TrimPrefix(a, "v"), "V")
+	b = strings.TrimPrefix(strings.TrimPrefix(b, "v"), "V")
+	ac := versionChunks.FindAllString(a, -1)
+	bc := versionChunks.FindAllString(b, -1)
+	for idx := 0; idx < len(ac) && idx < len(bc); idx++ {
+		x, y := ac[idx], bc[idx]
+		xn, xErr := strconv.ParseUint(x, 10, 64)
+		yn, yErr := strconv.ParseUint(y, 10, 64)
+		switch {
+		case xErr == nil && yErr == nil:
+			if xn != yn {
+				if xn < yn {
+					return -1
+				}
+				return 1
+			}
+		case x != y:
+			// A pre-release marker sorts before anything else at this position
+			xPre := strings.HasPrefix(x, "-") || strings.HasPrefix(x, "~")
+			yPre := strings.HasPrefix(y, "-") || strings.HasPrefix(y, "~")
+			if xPre != yPre {
+				if xPre {
+					return -1
+				}
+				return 1
+			}
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	switch {
+	case len(ac) == len(bc):
+		return 0
+	case len(ac) > len(bc):
+		// "1.0.0-rc1" is older than "1.0.0", but "1.0.1" is newer than "1.0"
+		if strings.HasPrefix(ac[len(bc)], "-") || strings.HasPrefix(ac[len(bc)], "~") {
+			return -1
+		}
+		return 1
+	default:
+		if strings.HasPrefix(bc[len(ac)], "-") || strings.HasPrefix(bc[len(ac)], "~") {
+			return 1
+		}
+		return -1
+	}
+}
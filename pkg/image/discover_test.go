@@ -0,0 +1,148 @@
+package image
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	tests := []struct {
+		a, b string
+		want int
+	}{
+		{"3.10", "3.9", 1},
+		{"3.9", "3.10", -1},
+		{"3.10", "3.10", 0},
+		{"v3.10", "3.10", 0},
+		{"V2", "v1", 1},
+		{"1.0.0-rc1", "1.0.0", -1},
+		{"1.0.0", "1.0.0-rc1", 1},
+		{"1.0.0-rc2", "1.0.0-rc10", -1},
+		{"1.0.0-rc1", "1.0.0-beta", 1},
+		{"1.0.0~rc1", "1.0.0", -1},
+		{"1.0.1", "1.0", 1},
+		{"1.0", "1.0.1", -1},
+		{"1.0.0-rc1", "0.9.9", 1},
+		{"2025.3a", "2025.3", 1},
+		{"2025.3", "2025.3a", -1},
+		{"2025.3a", "2025.3b", -1},
+		{"2025.3a", "2025.4", -1},
+		{"2025.10", "2025.3a", 1},
+		{"20250115", "20241231", 1},
+		{"18446744073709551615", "1", 1},
+	}
+	for _, tt := range tests {
+		if got := compareVersions(tt.a, tt.b); got != tt.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tt.a, tt.b, got, tt.want)
+		}
+	}
+}
+
+// alpineListing is an autoindex listing like the one of Alpine's cloud images.
+const alpineListing = `<html>
+<head><title>Index of /alpine/v3.22/releases/cloud/</title></head>
+<body>
+<h1>Index of /alpine/v3.22/releases/cloud/</h1><hr><pre><a href="../">../</a>
+<a href="generic_alpine-3.22.0-x86_64-bios-cloudinit-r0.qcow2">generic_alpine-3.22.0-x86_64-bios-cloudinit-r0.qcow2</a>     30-May-2025 12:08    178M
+<a href="generic_alpine-3.22.0-x86_64-bios-cloudinit-r0.qcow2.sha512">generic_alpine-3.22.0-x86_64-bios-cloudinit-r0.qcow2.sha512</a> 30-May-2025 12:08     129
+<a href="generic_alpine-3.22.2-x86_64-bios-cloudinit-r0.qcow2">generic_alpine-3.22.2-x86_64-bios-cloudinit-r0.qcow2</a>     08-Oct-2025 10:15    181M
+<a href="generic_alpine-3.22.10-x86_64-bios-cloudinit-r0.qcow2">generic_alpine-3.22.10-x86_64-bios-cloudinit-r0.qcow2</a>   08-Oct-2026 10:15    181M
+<a href="generic_alpine-3.22.11_rc1-x86_64-bios-cloudinit-r0.qcow2">generic_alpine-3.22.11_rc1-x86_64-bios-cloudinit-r0.qcow2</a> 08-Oct-2026 10:15    181M
+<a href="./nocloud_alpine-3.22.3-x86_64-bios-tiny-r0.qcow2">nocloud_alpine-3.22.3-x86_64-bios-tiny-r0.qcow2</a>         08-Oct-2025 10:15    143M
+<a href="generic_alpine-3.22.2-aarch64-uefi-cloudinit-r0.qcow2">generic_alpine-3.22.2-aarch64-uefi-cloudinit-r0.qcow2</a>   08-Oct-2025 10:15    179M
+</pre><hr></body>
+</html>
+`
+
+func TestDiscoverLatest(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/alpine/v3.22/releases/cloud/" {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, alpineListing)
+	}))
+	defer srv.Close()
+	index := srv.URL + "/alpine/v3.22/releases/cloud/"
+
+	tests := []struct {
+		name        string
+		pattern     string
+		template    string
+		wantURL     string
+		wantVersion string
+		wantError   string
+	}{
+		{
+			name:        "first group",
+			pattern:     `^generic_alpine-([\d.]+)-x86_64-bios-cloudinit-r0\.qcow2$`,
+			wantURL:     index + "generic_alpine-3.22.10-x86_64-bios-cloudinit-r0.qcow2",
+			wantVersion: "3.22.10",
+		},
+		{
+			name:        "version group",
+			pattern:     `^(generic|nocloud)_alpine-(?P<version>[\d.]+)-(x86_64)-bios-.*\.qcow2$`,
+			wantURL:     index + "generic_alpine-3.22.10-x86_64-bios-cloudinit-r0.qcow2",
+			wantVersion: "3.22.10",
+		},
+		{
+			name:        "first group is not the version",
+			pattern:     `^(generic|nocloud)_alpine-[\d.]+-x86_64-bios-.*\.qcow2$`,
+			wantURL:     index + "nocloud_alpine-3.22.3-x86_64-bios-tiny-r0.qcow2",
+			wantVersion: "nocloud",
+		},
+		{
+			name:        "link relative to the listing",
+			pattern:     `^nocloud_alpine-(?P<version>[\d.]+)-x86_64-bios-tiny-r0\.qcow2$`,
+			wantURL:     index + "nocloud_alpine-3.22.3-x86_64-bios-tiny-r0.qcow2",
+			wantVersion: "3.22.3",
+		},
+		{
+			name:        "url template",
+			pattern:     `^generic_alpine-(?P<version>[\d.]+)-aarch64-uefi-cloudinit-r0\.qcow2$`,
+			template:    "https://mirror.example.com/alpine/generic_alpine-{version}-aarch64-uefi-cloudinit-r0.qcow2",
+			wantURL:     "https://mirror.example.com/alpine/generic_alpine-3.22.2-aarch64-uefi-cloudinit-r0.qcow2",
+			wantVersion: "3.22.2",
+		},
+		{
+			name:      "no group",
+			pattern:   `^generic_alpine-[\d.]+-x86_64-bios-cloudinit-r0\.qcow2$`,
+			wantError: "has no version capture group",
+		},
+		{
+			name:      "invalid pattern",
+			pattern:   `^generic_alpine-([\d.]+`,
+			wantError: "invalid discover pattern",
+		},
+		{
+			name:      "no match",
+			pattern:   `^generic_alpine-([\d.]+)-ppc64le-.*\.qcow2$`,
+			wantError: "no link in",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := Discover{IndexURL: index, Pattern: tt.pattern}
+			gotURL, gotVersion, err := d.Latest(tt.template)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Latest() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Latest() error = %v", err)
+			}
+			if gotURL != tt.wantURL || gotVersion != tt.wantVersion {
+				t.Errorf("Latest() = %s, %s, want %s, %s", gotURL, gotVersion, tt.wantURL, tt.wantVersion)
+			}
+		})
+	}
+
+	if _, _, err := (Discover{IndexURL: srv.URL + "/missing/", Pattern: `(\d+)`}).Latest(""); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("Latest() of a missing listing error = %v, want a 404", err)
+	}
+}
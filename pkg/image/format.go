@@ -0,0 +1,165 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Values of target_format.
+const (
+	TargetFormatRaw   = "raw"
+	TargetFormatQCOW2 = "qcow2"
+	TargetFormatVMDK  = "vmdk"
+	TargetFormatVHD   = "vhd"
+	// TargetFormatAsIs uploads the image in its source format without
+	// converting it.
+	TargetFormatAsIs = "as-is"
+)
+
+// TargetFormats lists the valid values of target_format.
+var TargetFormats = []string{TargetFormatRaw, TargetFormatQCOW2, TargetFormatVMDK, TargetFormatVHD, TargetFormatAsIs}
+
+// SourceFormats lists the valid values of source_format.
+var SourceFormats = []string{"raw", "qcow2", "vmdk", "vhd", "vhdx", "vdi", "iso", "ploop"}
+
+// targetFormat returns the format the image is converted to before it is
+// uploaded, raw unless configured otherwise.
+func (i Image) targetFormat() string {
+	if f := strings.ToLower(strings.TrimSpace(i.TargetFormat)); f != "" {
+		return f
+	}
+	return TargetFormatRaw
+}
+
+// qemuFormat returns the qemu-img name of a disk format. Only VHD is named
+// differently, as "vpc".
+func qemuFormat(format string) string {
+	if format == "vhd" {
+		return "vpc"
+	}
+	return format
+}
+
+// glanceDiskFormat returns the Glance disk_format of a qemu-img format.
+func glanceDiskFormat(format string) (string, error) {
+	switch format {
+	case "vpc", "vhd":
+		return "vhd", nil
+	case "raw", "qcow2", "vmdk", "vhdx", "vdi", "iso", "ploop":
+		return format, nil
+	}
+	return "", fmt.Errorf("image format %q can't be uploaded to Glance as-is", format)
+}
+
+// formatMagic lists the magic bytes at the start of a disk image.
+var formatMagic = []struct {
+	format string
+	magic  []byte
+}{
+	{"qcow2", []byte("QFI\xfb")},
+	{"vmdk", []byte("KDMV")},
+	{"vhdx", []byte("vhdxfile")},
+	{"vhd", []byte("conectix")},
+}
+
+// Offsets of the ISO 9660 volume descriptor identifier and the VHD footer,
+// which is all a fixed VHD has to identify it.
+const (
+	isoMagicOffset = 32769
+	vhdFooterLen   = 512
+)
+
+// sniffHead detects the disk format of an image from its first bytes. It
+// returns an empty string for raw images and formats it doesn't know.
+func sniffHead(head []byte) string {
+	for _, m := range formatMagic {
+		if bytes.HasPrefix(head, m.magic) {
+			return m.format
+		}
+	}
+	if len(head) >= isoMagicOffset+5 && string(head[isoMagicOffset:isoMagicOffset+5]) == "CD001" {
+		return "iso"
+	}
+	return ""
+}
+
+// sniffFormat detects the disk format of an image file from its magic bytes.
+// Unlike sniffHead, it also recognizes fixed VHD images by their footer.
+func sniffFormat(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	head := make([]byte, isoMagicOffset+5)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return "", err
+	}
+	if format := sniffHead(head[:n]); format != "" {
+		return format, nil
+	}
+
+	if info, err := f.Stat(); err == nil && info.Size() >= vhdFooterLen {
+		footer := make([]byte, 8)
+		if _, err := f.ReadAt(footer, info.Size()-vhdFooterLen); err == nil && string(footer) == "conectix" {
+			return "vhd", nil
+		}
+	}
+	return "", nil
+}
+
+// resolveFormat decides between the detected format of an image and its
+// source_format. It returns an empty string if neither is known.
+func (i Image) resolveFormat(detected string, file string) string {
+	sf := strings.ToLower(strings.TrimSpace(i.SourceFormat))
+	switch {
+	case detected != "" && sf != "" && qemuFormat(detected) != qemuFormat(sf):
+		zap.S().Warnw("Detected source format differs from configured source_format; using detected", "file", file, "configured", sf, "detected", detected)
+	case detected != "":
+		zap.S().Infow("Detected source format", "format", detected, "file", file)
+	case sf != "":
+		if sniffable(sf) {
+			zap.S().Warnw("Source file does not look like the configured source_format", "file", file, "configured", sf)
+		}
+		zap.S().Infow("Using source format from config", "format", sf, "file", file)
+		return sf
+	}
+	return detected
+}
+
+// outputFormat returns the qemu-img format an image in the given source
+// format is uploaded in, and whether it has to be converted to it first.
+func (i Image) outputFormat(format string) (string, bool) {
+	out := qemuFormat(i.targetFormat())
+	if out == TargetFormatAsIs {
+		out = qemuFormat(format)
+	}
+	// ISO images are raw data, so they are also uploaded as they are for raw
+	same := qemuFormat(format) == out || qemuInputFormat(format) == out
+	return out, !same || i.TargetCompressed
+}
+
+// sniffable reports whether sniffFormat can recognize a format.
+func sniffable(format string) bool {
+	switch qemuFormat(format) {
+	case "qcow2", "vmdk", "vhdx", "vpc", "iso":
+		return true
+	}
+	return false
+}
+
+// qemuInputFormat returns the qemu-img driver that reads a source format.
+// qemu-img has no driver for ISO images, which are read as raw.
+func qemuInputFormat(format string) string {
+	if format == "iso" {
+		return "raw"
+	}
+	return qemuFormat(format)
+}
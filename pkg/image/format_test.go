@@ -0,0 +1,208 @@
+package image
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// diskImage returns a fake disk image of size bytes with magic at offset.
+func diskImage(size int, offset int, magic string) []byte {
+	data := bytes.Repeat([]byte{0}, size)
+	copy(data[offset:], magic)
+	return data
+}
+
+func TestSniffFormat(t *testing.T) {
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"qcow2", diskImage(4096, 0, "QFI\xfb\x00\x00\x00\x03"), "qcow2"},
+		{"vmdk", diskImage(4096, 0, "KDMV\x01\x00\x00\x00"), "vmdk"},
+		{"vhdx", diskImage(4096, 0, "vhdxfile"), "vhdx"},
+		{"dynamic vhd", diskImage(4096, 0, "conectix"), "vhd"},
+		{"fixed vhd", diskImage(4096, 4096-vhdFooterLen, "conectix"), "vhd"},
+		{"iso", diskImage(isoMagicOffset+2048, isoMagicOffset, "CD001"), "iso"},
+		{"raw", diskImage(isoMagicOffset+2048, 0, "\xeb\x63\x90"), ""},
+		{"smaller than a vhd footer", []byte("tiny"), ""},
+	}
+	dir := t.TempDir()
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(dir, "disk")
+			if err := os.WriteFile(file, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := sniffFormat(file)
+			if err != nil {
+				t.Fatalf("sniffFormat() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sniffFormat() = %q, want %q", got, tt.want)
+			}
+			// A fixed VHD can only be recognized by its footer, which a stream
+			// doesn't have yet
+			if head := sniffHead(tt.data); head != tt.want && tt.name != "fixed vhd" {
+				t.Errorf("sniffHead() = %q, want %q", head, tt.want)
+			}
+		})
+	}
+}
+
+func TestSniffCompression(t *testing.T) {
+	tests := []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"xz", compressXZ(t, payload), compressionXZ},
+		{"gzip", compressGzip(t, payload), compressionGzip},
+		{"zstd", compressZstd(t, payload), compressionZstd},
+		{"bzip2", bzip2Payload, compressionBz2},
+		{"zip", zipOf(t, "disk.raw"), compressionZip},
+		{"tar", tarOf(t, "disk.raw"), compressionTar},
+		{"qcow2", diskImage(512, 0, "QFI\xfb"), compressionNone},
+		{"empty", nil, compressionNone},
+	}
+	for _, tt := range tests {
+		if got := sniffCompression(tt.head); got != tt.want {
+			t.Errorf("sniffCompression(%s) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestReconcileCompression(t *testing.T) {
+	tests := []struct {
+		configured string
+		file       string
+		detected   string
+		want       string
+	}{
+		{"", "image.raw.xz", compressionXZ, compressionXZ},
+		{"xz", "image.raw", compressionXZ, compressionXZ},
+		{"txz", "image", "tar.xz", "tar.xz"},
+		// The archive inside may be a tar without ustar magic
+		{"tar.xz", "image.tar.xz", compressionXZ, "tar.xz"},
+		{"", "image.tar.xz", compressionXZ, "tar.xz"},
+		{"tar", "image", compressionNone, compressionTar},
+		// Otherwise, the content wins
+		{"xz", "image.raw.xz", compressionGzip, compressionGzip},
+		{"tar.xz", "image.tar.xz", "tar.gz", "tar.gz"},
+		{"", "image.raw.gz", compressionNone, compressionNone},
+		{"none", "image.raw", compressionZstd, compressionZstd},
+		{"", "image.raw", compressionBz2, compressionBz2},
+		{"tar.gz", "image.tar.gz", compressionNone, compressionNone},
+		{"unknown", "image.zst", compressionZstd, compressionZstd},
+	}
+	for _, tt := range tests {
+		if got := reconcileCompression(tt.configured, tt.file, tt.detected); got != tt.want {
+			t.Errorf("reconcileCompression(%q, %q, %q) = %q, want %q", tt.configured, tt.file, tt.detected, got, tt.want)
+		}
+	}
+}
+
+func TestResolveFormat(t *testing.T) {
+	tests := []struct {
+		sourceFormat string
+		detected     string
+		want         string
+	}{
+		{"", "qcow2", "qcow2"},
+		{"qcow2", "qcow2", "qcow2"},
+		{" QCOW2 ", "", "qcow2"},
+		// The content wins over source_format
+		{"raw", "qcow2", "qcow2"},
+		{"vmdk", "vhd", "vhd"},
+		{"vhd", "", "vhd"},
+		// Raw images and formats without magic bytes can't be detected
+		{"raw", "", "raw"},
+		{"vdi", "", "vdi"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		i := Image{SourceFormat: tt.sourceFormat}
+		if got := i.resolveFormat(tt.detected, "disk"); got != tt.want {
+			t.Errorf("resolveFormat(%q) with source_format %q = %q, want %q", tt.detected, tt.sourceFormat, got, tt.want)
+		}
+	}
+}
+
+func TestOutputFormat(t *testing.T) {
+	tests := []struct {
+		targetFormat string
+		compressed   bool
+		format       string
+		want         string
+		wantConvert  bool
+	}{
+		{"", false, "raw", "raw", false},
+		{"", false, "qcow2", "raw", true},
+		{"qcow2", false, "qcow2", "qcow2", false},
+		{" QCOW2 ", false, "raw", "qcow2", true},
+		{"vhd", false, "vhd", "vpc", false},
+		{"vmdk", false, "vhd", "vmdk", true},
+		// ISO images are raw data
+		{"raw", false, "iso", "raw", false},
+		{"as-is", false, "vmdk", "vmdk", false},
+		{"as-is", false, "vhd", "vpc", false},
+		{"as-is", false, "iso", "iso", false},
+		// Compressing a qcow2 image means converting it, even to qcow2
+		{"qcow2", true, "qcow2", "qcow2", true},
+		{"as-is", true, "qcow2", "qcow2", true},
+		{"as-is", true, "vmdk", "vmdk", true},
+	}
+	for _, tt := range tests {
+		i := Image{TargetFormat: tt.targetFormat, TargetCompressed: tt.compressed}
+		got, convert := i.outputFormat(tt.format)
+		if got != tt.want || convert != tt.wantConvert {
+			t.Errorf("outputFormat(%q) with target_format %q and target_compressed %v = %q, %v, want %q, %v",
+				tt.format, tt.targetFormat, tt.compressed, got, convert, tt.want, tt.wantConvert)
+		}
+	}
+}
+
+func TestGlanceDiskFormat(t *testing.T) {
+	tests := []struct {
+		format    string
+		want      string
+		wantError bool
+	}{
+		{"raw", "raw", false},
+		{"qcow2", "qcow2", false},
+		{"vpc", "vhd", false},
+		{"vhd", "vhd", false},
+		{"iso", "iso", false},
+		{"vhdx", "vhdx", false},
+		{"qed", "", true},
+		{"", "", true},
+	}
+	for _, tt := range tests {
+		got, err := glanceDiskFormat(tt.format)
+		if got != tt.want || (err != nil) != tt.wantError {
+			t.Errorf("glanceDiskFormat(%q) = %q, %v, want %q (error: %v)", tt.format, got, err, tt.want, tt.wantError)
+		}
+	}
+}
+
+func TestBuildTargetCompressed(t *testing.T) {
+	vmdk := diskImage(4096, 0, "KDMV\x01\x00\x00\x00")
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(vmdk)
+	}))
+	defer srv.Close()
+
+	// qemu-img can only compress qcow2 images, so an as-is vmdk fails before
+	// it is converted
+	i := Image{Name: "appliance", Url: srv.URL + "/appliance.vmdk", TargetFormat: TargetFormatAsIs, TargetCompressed: true}
+	i.Init()
+	_, err := i.buildOnce(SourceMeta{}, t.TempDir(), false)
+	if err == nil || !strings.Contains(err.Error(), "target_compressed needs qcow2 output, but the image would be uploaded as vmdk") {
+		t.Errorf("buildOnce() error = %v, want target_compressed to need qcow2", err)
+	}
+}
@@ -3,8 +3,11 @@ package image
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"maps"
 	"mime"
 	"net/http"
 	"os"
@@ -17,6 +20,7 @@ import (
 
 	"github.com/gophercloud/gophercloud/v2"
 	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/imagedata"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/imageimport"
 	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
 	"go.uber.org/zap"
 )
@@ -28,6 +32,8 @@ type SourceMeta struct {
 	LastModified string
 	// ContentLength is the size in bytes reported by the server, if any.
 	ContentLength int64
+	// AcceptRanges reports whether the server supports byte range requests.
+	AcceptRanges bool
 }
 
 // FetchSourceMeta issues an HTTP HEAD request to retrieve metadata about the source URL
@@ -63,20 +69,120 @@ func FetchSourceMeta(srcURL string) (SourceMeta, error) {
 		ETag:          resp.Header.Get("ETag"),
 		LastModified:  resp.Header.Get("Last-Modified"),
 		ContentLength: cl,
+		AcceptRanges:  strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes"),
 	}, nil
 }
 
 const uploadedFmt = "02-Jan-2006"
 
+// ProtectedProperty is set to "true" on images that Image Shepherd created
+// protected, so that only their protection is ever removed again.
+const ProtectedProperty = "image_shepherd_protected"
+
+// Image is a cloud image managed by Image Shepherd, as configured in
+// images.yaml.
 type Image struct {
-	Name         string
-	Url          string
-	Public       bool
-	Protected    bool `yaml:"protected,omitempty"`
-	Tags         []string
-	Properties   map[string]string
+	// Name is the name of the image in Glance.
+	Name string `yaml:"name"`
+	// Url is where the image is downloaded from. For discover sources, it may
+	// contain {version}.
+	Url string
+	// Public makes the image visible to every project.
+	Public bool
+	// Protected prevents the image from being deleted.
+	Protected bool `yaml:"protected,omitempty"`
+	// Tags are added to the image in Glance.
+	Tags []string
+	// Properties are added to the image in Glance. Images are matched by
+	// their os_distro, os_version and os_type properties if all of them are
+	// set, and by name otherwise.
+	Properties map[string]string
+	// SourceFormat is the disk format of the source image. It is detected from
+	// the image if possible.
 	SourceFormat string `yaml:"source_format,omitempty"`
-	Compression  string `yaml:"compression,omitempty"`
+	// Compression is how the source image is compressed or archived. It is
+	// detected from the image and its file name if unset.
+	Compression string `yaml:"compression,omitempty"`
+	// Retention overrides the global retention policy for superseded
+	// versions.
+	Retention *Retention `yaml:"retention,omitempty"`
+	// Checksum verifies the downloaded image.
+	Checksum *Checksum `yaml:"checksum,omitempty"`
+	// Source selects how the download URL is found: url (the default),
+	// discover, coreos-stream or simplestreams.
+	Source string `yaml:"source,omitempty"`
+	// Discover, Stream and SimpleStreams configure the discover,
+	// coreos-stream and simplestreams sources.
+	Discover      *Discover      `yaml:"discover,omitempty"`
+	Stream        *Stream        `yaml:"stream,omitempty"`
+	SimpleStreams *SimpleStreams `yaml:"simplestreams,omitempty"`
+	// Targets are the clouds and regions the image is published to, instead
+	// of the global targets.
+	Targets []Target `yaml:"targets,omitempty"`
+	// UploadMethod is how the image is published: upload (the default),
+	// web-download or glance-direct.
+	UploadMethod string `yaml:"upload_method,omitempty"`
+	// TargetFormat is the disk format the image is uploaded in, instead of
+	// the global target_format.
+	TargetFormat string `yaml:"target_format,omitempty"`
+	// TargetCompressed compresses qcow2 output.
+	TargetCompressed bool `yaml:"target_compressed,omitempty"`
+	// DownloadTimeout and UploadTimeout are the seconds allowed for each
+	// download attempt and for uploading or importing the image, instead of
+	// the -download-timeout and -upload-timeout options.
+	DownloadTimeout int `yaml:"download_timeout,omitempty"`
+	UploadTimeout   int `yaml:"upload_timeout,omitempty"`
+	// ConfigFile is the configuration file the image was loaded from, for
+	// messages and reports. It is set when loading, not in YAML.
+	ConfigFile string `yaml:"-"`
+}
+
+// Target is a cloud from clouds.yaml, and optionally one of its regions, that
+// an image is published to.
+type Target struct {
+	// Cloud is the name of the cloud in clouds.yaml. Empty means the cloud
+	// selected with -os-cloud.
+	Cloud string `yaml:"cloud,omitempty"`
+	// Region overrides the region configured for the cloud in clouds.yaml.
+	Region string `yaml:"region,omitempty"`
+}
+
+func (t Target) String() string {
+	if t.Region == "" {
+		return t.Cloud
+	}
+	return t.Cloud + "/" + t.Region
+}
+
+// Retention controls how many superseded (renamed and hidden) versions of an
+// image are kept in Glance. A hidden version is deleted once it falls outside
+// the newest Keep versions or becomes older than MaxAge.
+type Retention struct {
+	// Keep is the number of hidden versions to keep. Zero means no limit.
+	Keep int `yaml:"keep,omitempty"`
+	// MaxAge is the maximum age of a hidden version, as a Go duration or a
+	// number of days such as "90d". Empty means no limit.
+	MaxAge string `yaml:"max_age,omitempty"`
+}
+
+// MaxAgeDuration parses MaxAge. It returns zero if no maximum age is set.
+func (r Retention) MaxAgeDuration() (time.Duration, error) {
+	v := strings.TrimSpace(r.MaxAge)
+	if v == "" {
+		return 0, nil
+	}
+	if days, ok := strings.CutSuffix(v, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("invalid max_age %q", r.MaxAge)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("invalid max_age %q", r.MaxAge)
+	}
+	return d, nil
 }
 
 func setDefault(properties *map[string]string, key string, value string) {
@@ -85,7 +191,13 @@ func setDefault(properties *map[string]string, key string, value string) {
 	}
 }
 
-func (i Image) Init() {
+// Init fills in default properties. It copies the properties first, so the
+// same configuration can be managed again by a later run.
+func (i *Image) Init() {
+	i.Properties = maps.Clone(i.Properties)
+	if i.Properties == nil {
+		i.Properties = map[string]string{}
+	}
 	setDefault(&i.Properties, "architecture", "x86_64")
 	setDefault(&i.Properties, "hypervisor_type", "qemu")
 	setDefault(&i.Properties, "vm_mode", "hvm")
@@ -93,411 +205,376 @@ func (i Image) Init() {
 	setDefault(&i.Properties, "image_family", i.Name)
 }
 
-// downloadToCwd downloads the URL to the current working directory and returns the filename.
-func downloadToCwd(srcURL string) (string, error) {
-	// Resolve configurable timeout (seconds) from environment, default 300s
-	timeoutSecs := 300
-	if v := os.Getenv("IMAGE_SHEPHERD_DOWNLOAD_TIMEOUT_SECS"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			timeoutSecs = n
+// resumeValidator returns the value to send in If-Range when resuming a
+// download. If-Range requires a strong validator, so weak ETags are skipped in
+// favour of Last-Modified.
+func resumeValidator(meta SourceMeta) string {
+	if meta.ETag != "" && !strings.HasPrefix(meta.ETag, "W/") {
+		return meta.ETag
+	}
+	return meta.LastModified
+}
+
+// download tracks a file being downloaded across attempts, so that an
+// interrupted attempt can be resumed instead of starting from zero.
+type download struct {
+	url       string
+	dir       string
+	validator string
+	canResume bool
+	// timeout bounds each attempt
+	timeout time.Duration
+
+	// ifNoneMatch and ifModifiedSince make the first request conditional, so a
+	// cached copy can be revalidated without transferring the body
+	ifNoneMatch     string
+	ifModifiedSince string
+
+	// filename is decided by the first response and kept for resumed attempts
+	filename string
+	written  int64
+
+	// etag and lastModified are the validators of the downloaded content
+	etag         string
+	lastModified string
+}
+
+// filenameFor picks the local file name for a response.
+func (d *download) filenameFor(resp *http.Response) string {
+	return filepath.Join(d.dir, responseFilename(resp))
+}
+
+// responseFilename picks the name of the file a response downloads, without
+// any directory.
+func responseFilename(resp *http.Response) string {
+	// Prefer filename from Content-Disposition if present
+	filename := ""
+	if cd := resp.Header.Get("Content-Disposition"); cd != "" {
+		if _, params, err := mime.ParseMediaType(cd); err == nil {
+			if fn, ok := params["filename"]; ok && fn != "" {
+				filename = fn
+			}
 		}
 	}
 
-	// HTTP client with timeout (per-attempt)
-	client := &http.Client{Timeout: time.Duration(timeoutSecs) * time.Second}
+	// Fallback: use the basename from the final request URL path
+	if filename == "" && resp.Request != nil && resp.Request.URL != nil {
+		filename = path.Base(resp.Request.URL.Path)
+	}
+	if filename == "" || filename == "." || filename == "/" {
+		filename = "downloaded-image"
+	}
 
-	maxAttempts := 3
-	backoff := 2 * time.Second
+	// Sanitize to avoid path traversal
+	return filepath.Base(filename)
+}
 
-	var lastErr error
-	for attempt := 1; attempt <= maxAttempts; attempt++ {
-		// Context deadline for this attempt
-		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(timeoutSecs)*time.Second)
-		req, err := http.NewRequestWithContext(ctx, "GET", srcURL, nil)
-		if err != nil {
-			cancel()
-			return "", err
+// attempt makes a single download request, resuming the partial file from a
+// previous attempt when the server supports it.
+func (d *download) attempt(ctx context.Context, client *http.Client) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", d.url, nil)
+	if err != nil {
+		return err
+	}
+	resuming := d.filename != "" && d.written > 0 && d.canResume && d.validator != ""
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", d.written))
+		req.Header.Set("If-Range", d.validator)
+		zap.S().Infow("Resuming download", "url", d.url, "file", d.filename, "offset", d.written)
+	} else if d.filename == "" {
+		if d.ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", d.ifNoneMatch)
+		}
+		if d.ifModifiedSince != "" {
+			req.Header.Set("If-Modified-Since", d.ifModifiedSince)
 		}
+	}
 
-		resp, err := client.Do(req)
-		if err != nil {
-			cancel()
-			lastErr = err
-			if attempt < maxAttempts {
-				time.Sleep(backoff)
-				backoff *= 2
-				continue
-			}
-			return "", lastErr
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	switch {
+	case resp.StatusCode == http.StatusNotModified && d.filename == "":
+		return errNotModified
+	case resp.StatusCode == http.StatusPartialContent && resuming:
+		// Make sure the server resumed exactly where we stopped
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != d.written {
+			d.written = 0
+			return fmt.Errorf("download resumed at unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+		flags = os.O_WRONLY | os.O_APPEND
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		d.written = 0
+		return fmt.Errorf("download failed: %s", resp.Status)
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		return fmt.Errorf("download failed: %s", resp.Status)
+	default:
+		if resuming {
+			// The server ignored the range because the validator changed
+			zap.S().Warnw("Source changed since the previous attempt; restarting download", "url", d.url, "validator", d.validator)
 		}
+		if d.filename == "" {
+			d.filename = d.filenameFor(resp)
+		}
+		d.etag = resp.Header.Get("ETag")
+		d.lastModified = resp.Header.Get("Last-Modified")
+		if d.validator == "" {
+			d.validator = resumeValidator(SourceMeta{ETag: d.etag, LastModified: d.lastModified})
+		}
+		if !d.canResume {
+			d.canResume = strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+		}
+		d.written = 0
+	}
 
-		// Ensure response body closed for each attempt
-		func() {
-			defer resp.Body.Close()
-			if resp.StatusCode < 200 || resp.StatusCode > 299 {
-				lastErr = fmt.Errorf("download failed: %s", resp.Status)
-				return
-			}
+	out, err := os.OpenFile(d.filename, flags, 0o644)
+	if err != nil {
+		return err
+	}
+	n, copyErr := io.Copy(out, resp.Body)
+	d.written += n
+	if err := out.Close(); err != nil && copyErr == nil {
+		copyErr = err
+	}
+	return copyErr
+}
 
-			// Prefer filename from Content-Disposition if present
-			filename := ""
-			if cd := resp.Header.Get("Content-Disposition"); cd != "" {
-				if _, params, err := mime.ParseMediaType(cd); err == nil {
-					if fn, ok := params["filename"]; ok && fn != "" {
-						filename = fn
-					}
-				}
-			}
+// errNotModified is returned by a conditional download when the server
+// answers 304 Not Modified.
+var errNotModified = errors.New("not modified")
 
-			// Fallback: use the basename from the final request URL path
-			if filename == "" && resp.Request != nil && resp.Request.URL != nil {
-				filename = path.Base(resp.Request.URL.Path)
-			}
-			if filename == "" || filename == "." || filename == "/" {
-				filename = "downloaded-image"
-			}
+// newDownload prepares a download of srcURL into dir. An interrupted download
+// is resumed with a Range request if the server advertises Accept-Ranges, as
+// long as the source still matches the ETag or Last-Modified in meta.
+func newDownload(srcURL string, dir string, meta SourceMeta, timeout time.Duration) *download {
+	return &download{url: srcURL, dir: dir, validator: resumeValidator(meta), canResume: meta.AcceptRanges, timeout: timeout}
+}
 
-			// Sanitize to avoid path traversal
-			filename = filepath.Base(filename)
+// run downloads with retries and returns the path of the downloaded file. It
+// returns errNotModified without retrying if a conditional request matched.
+func (d *download) run() (string, error) {
+	// HTTP client with timeout (per-attempt)
+	timeout := d.timeout
+	client := &http.Client{Timeout: timeout}
 
-			out, err := os.Create(filename)
-			if err != nil {
-				lastErr = err
-				return
-			}
-			defer func() {
-				_ = out.Close()
-				// On error, remove the partial file
-				if lastErr != nil {
-					_ = os.Remove(filename)
-				}
-			}()
-
-			if _, err := io.Copy(out, resp.Body); err != nil {
-				lastErr = err
-				return
-			}
+	maxAttempts := 3
+	backoff := 2 * time.Second
 
-			// Success: clear context cancel and set lastErr nil
-			lastErr = nil
-			// Return filename via outer scope by replacing function return using panic/defer is messy;
-			// instead, shadow the function return by writing to a named variable.
-			// To keep minimal changes, we capture via a closure result.
-			// We'll assign to a package-local variable via named return not available here,
-			// so set a sentinel by writing to a temporary file and re-opening after loop.
-			// Simpler: reuse filename by setting it on the request context (not ideal).
-			// Instead, set lastErr to a sentinel nil and write filename to header for retrieval outside.
-			req.Header.Set("X-Image-Shepherd-Filename", filename)
-		}()
-
-		// Capture filename if success
+	var lastErr error
+	for attempt := 1; attempt <= maxAttempts; attempt++ {
+		// Context deadline for this attempt
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		lastErr = d.attempt(ctx, client)
+		cancel()
 		if lastErr == nil {
-			// Retrieve filename from the request header (set above)
-			fn := req.Header.Get("X-Image-Shepherd-Filename")
-			cancel()
-			return fn, nil
+			return d.filename, nil
+		}
+		if errors.Is(lastErr, errNotModified) {
+			return "", lastErr
 		}
 
-		cancel()
-		// Retry on next loop if attempts remain
+		// Retry on next loop if attempts remain, keeping the partial file
 		if attempt < maxAttempts {
+			zap.S().Warnw("Download attempt failed, will retry", "url", d.url, "attempt", attempt, "bytes_written", d.written, "error", lastErr, "backoff", backoff.String())
 			time.Sleep(backoff)
 			backoff *= 2
-			continue
 		}
 	}
 
-	if lastErr == nil {
-		lastErr = fmt.Errorf("download failed: unknown error")
+	// On error, remove the partial file
+	if d.filename != "" {
+		_ = os.Remove(d.filename)
 	}
 	return "", lastErr
 }
 
-func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
-	// Download the image
-	zap.S().Infow("Starting download", "url", i.Url, "image", i.Name, "source_format", i.SourceFormat, "compression", i.Compression)
-	filename, err := downloadToCwd(i.Url)
-	if err != nil {
-		zap.S().Errorw("Download failed", "url", i.Url, "image", i.Name, "error", err)
-		return err
-	}
-	defer func() {
-		zap.S().Infow("Cleaning up downloaded file", "file", filename)
-		if err := os.Remove(filename); err != nil && !os.IsNotExist(err) {
-			zap.S().Warnw("Failed to remove downloaded file", "file", filename, "error", err)
-		}
-	}()
+// Artifact is a downloaded, verified and converted image that is ready to be
+// published to any number of clouds.
+type Artifact struct {
+	// File is the disk image to upload and DiskFormat its Glance disk format.
+	File       string
+	DiskFormat string
+	// Meta is the upstream metadata of the source the artifact was built from.
+	Meta SourceMeta
+
+	// Stats describes how the artifact was built. For a streamed artifact, it
+	// is only complete once the artifact has been published.
+	Stats BuildStats
+
+	// stream reads the image of an artifact built by BuildStream that has no
+	// File, and finish verifies the download once stream has been read.
+	// changed reports whether stream failed because the source changed.
+	stream  io.Reader
+	finish  func() error
+	changed func() bool
+
+	cleanup []func()
+}
 
-	zap.S().Infow("Download completed", "file", filename, "image", i.Name)
-	if f, err := os.Open(filename); err == nil {
-		h := sha256.New()
-		if _, err := io.Copy(h, f); err == nil {
-			zap.S().Infow("SHA256 (downloaded file)", "file", filename, "sha256", fmt.Sprintf("%x", h.Sum(nil)))
-		} else {
-			zap.S().Warnw("Failed to compute SHA256 for downloaded file", "file", filename, "error", err)
-		}
-		_ = f.Close()
-	} else {
-		zap.S().Warnw("Failed to open downloaded file for hashing", "file", filename, "error", err)
-	}
+// BuildStats describes the download and conversion of an artifact.
+type BuildStats struct {
+	// DownloadedBytes is the size of the download and DownloadSHA256 its
+	// SHA256 digest.
+	DownloadedBytes int64
+	DownloadSHA256  string
+	// ChecksumAlgorithm and Checksum are the verified digest of the download,
+	// and UncompressedChecksum the verified digest after decompression, if
+	// the image has a checksum.
+	ChecksumAlgorithm    string
+	Checksum             string
+	UncompressedChecksum string
+	// ImageBytes is the size of the image as it is uploaded and ImageSHA256
+	// its SHA256 digest.
+	ImageBytes  int64
+	ImageSHA256 string
+	// Download is how long it took to download and decompress the image, of
+	// which Decompress was spent decompressing and extracting it, and Convert
+	// how long it took to convert it. A streamed image is downloaded while it
+	// is uploaded.
+	Download   time.Duration
+	Decompress time.Duration
+	Convert    time.Duration
+}
 
-	// Handle compression and format detection, then convert to raw if needed
-	// SourceFormat and Compression can be set in images.yaml. If unset, auto-detect.
+// Streamed reports whether the artifact is uploaded as it is downloaded, in
+// which case it can only be published once.
+func (a *Artifact) Streamed() bool {
+	return a.finish != nil
+}
 
-	// Step 1: Decompress if instructed or inferred
-	srcFile := filename
-	// If srcFile changes (due to decompression), we should ensure it gets cleaned up too.
-	// We track it so we can clean it up if it differs from filename (which is already deferred).
-	defer func() {
-		if srcFile != filename {
-			zap.S().Infow("Cleaning up decompressed source file", "file", srcFile)
-			if err := os.Remove(srcFile); err != nil && !os.IsNotExist(err) {
-				zap.S().Warnw("Failed to remove decompressed source file", "file", srcFile, "error", err)
-			}
-		}
-	}()
+// Close removes the files that make up the artifact.
+func (a *Artifact) Close() {
+	for idx := len(a.cleanup) - 1; idx >= 0; idx-- {
+		a.cleanup[idx]()
+	}
+	a.cleanup = nil
+}
 
-	comp := strings.ToLower(strings.TrimSpace(i.Compression))
-	decompressXZ := func(in string) (string, error) {
-		zap.S().Infof("Decompressing xz image %s", in)
-		outName := in[:len(in)-len(path.Ext(in))]
-		out, err := os.Create(outName)
-		if err != nil {
-			return "", err
-		}
-		defer out.Close()
-		cmd := exec.Command("xz", "-dc", in)
-		cmd.Stdout = out
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return "", err
-		}
-		zap.S().Infow("Decompression complete", "compression", "xz", "input", in, "output", outName)
-		return outName, nil
-	}
-	decompressGZ := func(in string) (string, error) {
-		zap.S().Infof("Decompressing gzip image %s", in)
-		outName := in[:len(in)-len(path.Ext(in))]
-		out, err := os.Create(outName)
-		if err != nil {
-			return "", err
-		}
-		defer out.Close()
-
-		cmd := exec.Command("gzip", "-dc", in)
-		cmd.Stdout = out
-		cmd.Stderr = os.Stderr
-		if err := cmd.Run(); err != nil {
-			return "", err
-		}
-		zap.S().Infow("Decompression complete", "compression", "gz", "input", in, "output", outName)
-		return outName, nil
-	}
-
-	// extractFromTar extracts a single disk image file from a tar archive (tar.xz or tar.gz).
-	// It prefers a member named "disk.raw", otherwise falls back to the first file matching
-	// a known disk extension in priority order: .raw, .qcow2, .img, .vmdk, .vdi
-	extractFromTar := func(archivePath string, comp string) (string, error) {
-		var flag string
-		switch comp {
-		case "tar.xz", "txz":
-			flag = "-J"
-		case "tar.gz", "tgz":
-			flag = "-z"
-		default:
-			// infer from extension
-			l := strings.ToLower(archivePath)
-			if strings.HasSuffix(l, ".tar.xz") || strings.HasSuffix(l, ".txz") {
-				flag = "-J"
-			} else if strings.HasSuffix(l, ".tar.gz") || strings.HasSuffix(l, ".tgz") {
-				flag = "-z"
-			}
-		}
+// Build downloads, verifies, decompresses and converts the image to its target
+// format. All intermediate files are written to workDir, which must be private
+// to this build. The artifact must be closed once it has been published.
+func (i Image) Build(meta SourceMeta, workDir string) (*Artifact, error) {
+	return i.build(meta, workDir, false)
+}
 
-		// List archive members
-		var listArgs []string
-		if flag != "" {
-			listArgs = []string{"-t", flag, "-f", archivePath}
-		} else {
-			listArgs = []string{"-t", "-f", archivePath}
-		}
-		zap.S().Infow("Listing tar archive entries", "archive", archivePath, "compression_flag", flag)
-		out, err := exec.Command("tar", listArgs...).Output()
-		if err != nil {
-			return "", fmt.Errorf("failed to list tar archive %s: %w", archivePath, err)
-		}
-
-		lines := strings.Split(strings.ReplaceAll(string(out), "\r\n", "\n"), "\n")
-		choose := func(candidates []string) string {
-			// Prefer disk.raw
-			for _, e := range candidates {
-				entry := strings.TrimSpace(e)
-				if entry == "" || strings.HasSuffix(entry, "/") {
-					continue
-				}
-				if strings.EqualFold(filepath.Base(entry), "disk.raw") {
-					return entry
-				}
-			}
-			// Otherwise choose by extension priority
-			priorities := []string{".raw", ".qcow2", ".img", ".vmdk", ".vdi"}
-			for _, ext := range priorities {
-				for _, e := range candidates {
-					entry := strings.TrimSpace(e)
-					if entry == "" || strings.HasSuffix(entry, "/") {
-						continue
-					}
-					if strings.EqualFold(filepath.Ext(entry), ext) {
-						return entry
-					}
-				}
-			}
-			// Fallback: first non-directory entry
-			for _, e := range candidates {
-				entry := strings.TrimSpace(e)
-				if entry != "" && !strings.HasSuffix(entry, "/") {
-					return entry
-				}
-			}
-			return ""
-		}
+// BuildStream is like Build, except that an image that doesn't need to be
+// converted and has no checksum to verify isn't written to workDir at all.
+// Instead, the artifact streams it from the source through the decompressor
+// while it is published, which means it can only be published once.
+func (i Image) BuildStream(meta SourceMeta, workDir string) (*Artifact, error) {
+	return i.build(meta, workDir, true)
+}
 
-		target := choose(lines)
-		if target == "" {
-			return "", fmt.Errorf("no suitable image file found in tar archive %s", archivePath)
-		}
-		zap.S().Infow("Selected image from tar archive", "archive", archivePath, "member", target)
+// build builds the image, starting over once with a new download if the
+// source changed while an interrupted download was being resumed.
+func (i Image) build(meta SourceMeta, workDir string, stream bool) (*Artifact, error) {
+	a, err := i.buildOnce(meta, workDir, stream)
+	if errors.Is(err, ErrSourceChanged) {
+		zap.S().Warnw("Source changed while resuming the download; restarting it from zero", "url", i.Url, "image", i.Name)
+		a, err = i.buildOnce(meta, workDir, stream)
+	}
+	return a, err
+}
 
-		// Extract only the selected member to a local file using stdout (-O)
-		outName := filepath.Base(target)
-		if outName == "" || outName == "." || outName == "/" {
-			outName = "extracted-image"
-		}
-		dst, err := os.Create(outName)
+func (i Image) buildOnce(meta SourceMeta, workDir string, stream bool) (_ *Artifact, err error) {
+	a := &Artifact{DiskFormat: "raw", Meta: meta}
+	defer func() {
 		if err != nil {
-			return "", err
+			a.Close()
 		}
-		defer func() {
-			_ = dst.Close()
-			if err != nil {
-				_ = os.Remove(outName)
-			}
-		}()
+	}()
 
-		var extractArgs []string
-		if flag != "" {
-			extractArgs = []string{"-x", flag, "-f", archivePath, "-O", target}
-		} else {
-			extractArgs = []string{"-x", "-f", archivePath, "-O", target}
-		}
-		zap.S().Infow("Extracting member from tar archive", "archive", archivePath, "member", target, "output", outName)
-		cmd := exec.Command("tar", extractArgs...)
-		cmd.Stdout = dst
-		cmd.Stderr = os.Stderr
-		if err = cmd.Run(); err != nil {
-			return "", err
+	// Download the image. Compressed images are decompressed as they are
+	// downloaded, so no compressed copy is kept unless it comes from the cache
+	// or is a zip archive, which can't be read as a stream.
+	p, err := i.openPipeline(meta)
+	if err != nil {
+		return nil, err
+	}
+	a.cleanup = append(a.cleanup, p.Close)
+	defer func() {
+		// The decompressor may not keep the error of the source, so report
+		// why the download actually failed
+		if err != nil && p.changed() {
+			err = ErrSourceChanged
 		}
+	}()
 
-		zap.S().Infow("Extraction complete", "archive", archivePath, "member", target, "output", outName)
-		return outName, nil
+	if stream {
+		if format, ok := i.streamFormat(p); ok {
+			return i.streamArtifact(a, p, format)
+		}
+		zap.S().Infow("Image can't be streamed; writing it to the working directory", "image", i.Name, "work_dir", workDir)
 	}
 
-	switch comp {
-	case "xz":
-		if outName, err := decompressXZ(filename); err != nil {
-			return err
-		} else {
-			srcFile = outName
-		}
-	case "gz", "gzip":
-		if outName, err := decompressGZ(filename); err != nil {
-			return err
-		} else {
-			srcFile = outName
-		}
-	case "tar.xz", "txz":
-		if outName, err := extractFromTar(filename, "tar.xz"); err != nil {
-			return err
-		} else {
-			srcFile = outName
-		}
-	case "tar.gz", "tgz":
-		if outName, err := extractFromTar(filename, "tar.gz"); err != nil {
-			return err
-		} else {
-			srcFile = outName
-		}
-	case "none", "":
-		// Infer by extension if not explicitly specified
-		l := strings.ToLower(filename)
-		switch {
-		case strings.HasSuffix(l, ".tar.xz") || strings.HasSuffix(l, ".txz"):
-			if outName, err := extractFromTar(filename, "tar.xz"); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".tar.gz") || strings.HasSuffix(l, ".tgz"):
-			if outName, err := extractFromTar(filename, "tar.gz"); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".xz"):
-			if outName, err := decompressXZ(filename); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".gz"):
-			if outName, err := decompressGZ(filename); err != nil {
-				return err
-			} else {
-				srcFile = outName
+	// Step 1: Decompress as detected from the content, configured or inferred
+	// by extension
+	var srcFile string
+	switch {
+	case p.dc.compression == compressionNone && p.src.file != "":
+		srcFile = p.src.file
+	case p.dc.compression == compressionZip:
+		archive := p.src.file
+		if archive == "" {
+			archive = filepath.Join(workDir, p.src.name)
+			if err = writeFile(archive, p.dc.raw); err != nil {
+				break
 			}
+			defer os.Remove(archive)
 		}
+		extractStart := time.Now()
+		srcFile, err = unpackZip(archive, workDir)
+		p.dc.decoding += time.Since(extractStart)
 	default:
-		zap.S().Warnf("Unknown compression value %q; attempting to infer by extension", comp)
-		l := strings.ToLower(filename)
-		switch {
-		case strings.HasSuffix(l, ".tar.xz") || strings.HasSuffix(l, ".txz"):
-			if outName, err := extractFromTar(filename, "tar.xz"); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".tar.gz") || strings.HasSuffix(l, ".tgz"):
-			if outName, err := extractFromTar(filename, "tar.gz"); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".xz"):
-			if outName, err := decompressXZ(filename); err != nil {
-				return err
-			} else {
-				srcFile = outName
-			}
-		case strings.HasSuffix(l, ".gz"):
-			if outName, err := decompressGZ(filename); err != nil {
-				return err
-			} else {
-				srcFile = outName
+		srcFile, err = unpack(p.dc.compression, p.dc.r, p.src.name, workDir)
+	}
+	if err != nil {
+		zap.S().Errorw("Download failed", "url", i.Url, "image", i.Name, "compression", compressionLabel(p.dc.compression), "error", err)
+		return nil, err
+	}
+
+	// Clean up the downloaded or decompressed file, but never the cached copy
+	if srcFile != p.src.file {
+		written := srcFile
+		a.cleanup = append(a.cleanup, func() {
+			zap.S().Infow("Cleaning up source file", "file", written)
+			if err := os.Remove(written); err != nil && !os.IsNotExist(err) {
+				zap.S().Warnw("Failed to remove source file", "file", written, "error", err)
 			}
-		}
+		})
 	}
 
-	// Step 2: Determine source format (config or auto-detect)
-	var format string
-	sf := strings.ToLower(strings.TrimSpace(i.SourceFormat))
-	if sf != "" {
-		format = sf
-		zap.S().Infow("Using source format from config", "format", format, "file", srcFile)
-	} else {
+	// Verify the download before anything is created in Glance
+	if err := p.finish(i, &a.Stats); err != nil {
+		return nil, err
+	}
+	a.Meta = p.sourceMeta(meta)
+	if i.Checksum != nil && i.Checksum.Uncompressed != "" {
+		uncompressed := strings.ToLower(strings.TrimSpace(i.Checksum.Uncompressed))
+		if err := i.Checksum.Verify(srcFile, uncompressed); err != nil {
+			zap.S().Errorw("Uncompressed checksum verification failed", "file", srcFile, "image", i.Name, "error", err)
+			p.discard()
+			return nil, err
+		}
+		a.Stats.UncompressedChecksum = uncompressed
+	}
+
+	// Step 2: Determine source format (detected, config or qemu-img)
+	detected, err := sniffFormat(srcFile)
+	if err != nil {
+		return nil, err
+	}
+	format := i.resolveFormat(detected, srcFile)
+	if format == "" {
 		infoCmd := exec.Command("qemu-img", "info", srcFile)
 		infoOut, err := infoCmd.Output()
 		if err != nil {
-			return err
+			return nil, err
 		}
 		for _, line := range strings.Split(string(infoOut), "\n") {
 			line = strings.TrimSpace(line)
@@ -508,7 +585,7 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 		}
 		if format == "" {
 			zap.S().Errorw("Could not detect image format", "file", srcFile)
-			return fmt.Errorf("unable to detect image format for %s", srcFile)
+			return nil, fmt.Errorf("unable to detect image format for %s", srcFile)
 		}
 		zap.S().Infow("Detected source format", "format", format, "file", srcFile)
 		if f, err := os.Open(srcFile); err == nil {
@@ -524,55 +601,131 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 		}
 	}
 
-	// Step 3: Convert to raw if needed
-	var rawFile string
-	// If rawFile is created as a result of conversion, we need to clean it up.
-	defer func() {
-		if rawFile != "" && rawFile != srcFile {
-			zap.S().Infow("Cleaning up converted raw file", "file", rawFile)
-			if err := os.Remove(rawFile); err != nil && !os.IsNotExist(err) {
-				zap.S().Warnw("Failed to remove converted raw file", "file", rawFile, "error", err)
-			}
-		}
-	}()
+	// Step 3: Convert to the target format if needed
+	outFormat, convert := i.outputFormat(format)
+	if a.DiskFormat, err = glanceDiskFormat(outFormat); err != nil {
+		return nil, err
+	}
+	if i.TargetCompressed && outFormat != TargetFormatQCOW2 {
+		return nil, fmt.Errorf("target_compressed needs qcow2 output, but the image would be uploaded as %s", outFormat)
+	}
+	var outFile string
 
-	zap.S().Debugw("Beginning conversion decision", "detected_format", format, "file", srcFile)
-	if format == "raw" {
-		zap.S().Infow("Input image is already in raw format; skipping conversion", "file", srcFile)
+	zap.S().Debugw("Beginning conversion decision", "detected_format", format, "target_format", outFormat, "compressed", i.TargetCompressed, "file", srcFile)
+	if !convert {
+		zap.S().Infow("Input image is already in the target format; skipping conversion", "format", outFormat, "file", srcFile)
 		if f, err := os.Open(srcFile); err == nil {
 			h := sha256.New()
 			if _, err := io.Copy(h, f); err == nil {
-				zap.S().Infow("SHA256 (raw file)", "file", srcFile, "sha256", fmt.Sprintf("%x", h.Sum(nil)))
+				a.Stats.ImageSHA256 = fmt.Sprintf("%x", h.Sum(nil))
+				zap.S().Infow("SHA256 (output file)", "file", srcFile, "sha256", a.Stats.ImageSHA256)
 			} else {
-				zap.S().Warnw("Failed to compute SHA256 for raw file", "file", srcFile, "error", err)
+				zap.S().Warnw("Failed to compute SHA256 for output file", "file", srcFile, "error", err)
 			}
 			_ = f.Close()
 		} else {
-			zap.S().Warnw("Failed to open raw file for hashing", "file", srcFile, "error", err)
+			zap.S().Warnw("Failed to open output file for hashing", "file", srcFile, "error", err)
 		}
-		rawFile = srcFile
+		outFile = srcFile
 	} else {
-		rawFile = fmt.Sprintf("%s.raw", srcFile)
-		zap.S().Infow("Converting image to raw", "from_format", format, "input", srcFile, "output", rawFile)
-		cmd := exec.Command("qemu-img", "convert", "-f", format, "-O", "raw", srcFile, rawFile)
-		if err := cmd.Run(); err != nil {
-			zap.S().Errorw("Conversion failed", "from_format", format, "input", srcFile, "output", rawFile, "error", err)
-			return err
-		}
-		zap.S().Infow("Conversion complete", "output", rawFile)
-		if f, err := os.Open(rawFile); err == nil {
+		outFile = filepath.Join(workDir, filepath.Base(srcFile)+"."+a.DiskFormat)
+		args := []string{"convert", "-f", qemuInputFormat(format), "-O", outFormat}
+		if i.TargetCompressed {
+			args = append(args, "-c")
+		}
+		args = append(args, srcFile, outFile)
+		zap.S().Infow("Converting image", "from_format", format, "to_format", outFormat, "compressed", i.TargetCompressed, "input", srcFile, "output", outFile)
+		cmd := exec.Command("qemu-img", args...)
+		convertStart := time.Now()
+		err := cmd.Run()
+		a.Stats.Convert = time.Since(convertStart)
+		if err != nil {
+			zap.S().Errorw("Conversion failed", "from_format", format, "to_format", outFormat, "input", srcFile, "output", outFile, "error", err)
+			return nil, err
+		}
+		zap.S().Infow("Conversion complete", "output", outFile, "duration", a.Stats.Convert.String())
+		// The converted file needs to be cleaned up
+		converted := outFile
+		a.cleanup = append(a.cleanup, func() {
+			zap.S().Infow("Cleaning up converted file", "file", converted)
+			if err := os.Remove(converted); err != nil && !os.IsNotExist(err) {
+				zap.S().Warnw("Failed to remove converted file", "file", converted, "error", err)
+			}
+		})
+		if f, err := os.Open(outFile); err == nil {
 			h := sha256.New()
 			if _, err := io.Copy(h, f); err == nil {
-				zap.S().Infow("SHA256 (raw file)", "file", rawFile, "sha256", fmt.Sprintf("%x", h.Sum(nil)))
+				a.Stats.ImageSHA256 = fmt.Sprintf("%x", h.Sum(nil))
+				zap.S().Infow("SHA256 (output file)", "file", outFile, "sha256", a.Stats.ImageSHA256)
 			} else {
-				zap.S().Warnw("Failed to compute SHA256 for raw file", "file", rawFile, "error", err)
+				zap.S().Warnw("Failed to compute SHA256 for output file", "file", outFile, "error", err)
 			}
 			_ = f.Close()
 		} else {
-			zap.S().Warnw("Failed to open raw file for hashing", "file", rawFile, "error", err)
+			zap.S().Warnw("Failed to open output file for hashing", "file", outFile, "error", err)
+		}
+	}
+
+	a.File = outFile
+	if info, err := os.Stat(outFile); err == nil {
+		a.Stats.ImageBytes = info.Size()
+	}
+	return a, nil
+}
+
+// streamArtifact turns a into an artifact that uploads the image in the given
+// format straight from the pipeline.
+func (i Image) streamArtifact(a *Artifact, p *pipeline, format string) (*Artifact, error) {
+	outFormat, _ := i.outputFormat(format)
+	var err error
+	if a.DiskFormat, err = glanceDiskFormat(outFormat); err != nil {
+		return nil, err
+	}
+	zap.S().Infow("Streaming image without conversion", "image", i.Name, "format", outFormat, "compression", compressionLabel(p.dc.compression))
+
+	// Hash the image as it is uploaded for the logs
+	sum256 := sha256.New()
+	var size byteCounter
+	hashes := io.MultiWriter(sum256, &size)
+
+	a.stream = io.TeeReader(p.dc.r, hashes)
+	a.changed = p.changed
+	a.finish = func() error {
+		if err := p.finish(i, &a.Stats); err != nil {
+			return err
+		}
+		a.Meta = p.sourceMeta(a.Meta)
+		a.Stats.ImageBytes = int64(size)
+		a.Stats.ImageSHA256 = hex.EncodeToString(sum256.Sum(nil))
+		zap.S().Infow("SHA256 (output file)", "file", p.src.name, "sha256", a.Stats.ImageSHA256)
+		return nil
+	}
+	return a, nil
+}
+
+// uploadTimeout returns the time allowed for uploading or importing the image.
+func (i Image) uploadTimeout() time.Duration {
+	if i.UploadTimeout > 0 {
+		return time.Duration(i.UploadTimeout) * time.Second
+	}
+	return uploadTimeout()
+}
+
+// uploadTimeout returns the time allowed for uploading or importing image
+// data, as propagated by the CLI through IMAGE_SHEPHERD_UPLOAD_TIMEOUT_SECS.
+func uploadTimeout() time.Duration {
+	timeoutSecs := 6000
+	if v := os.Getenv("IMAGE_SHEPHERD_UPLOAD_TIMEOUT_SECS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			timeoutSecs = n
 		}
 	}
+	return time.Duration(timeoutSecs) * time.Second
+}
 
+// create creates the image object in Glance, recording the source metadata in
+// its properties, and returns its ID.
+func (i Image) create(c *gophercloud.ServiceClient, diskFormat string, meta SourceMeta) (string, error) {
 	// Determine the image visibility
 	var visibility images.ImageVisibility
 	if i.Public {
@@ -582,19 +735,24 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 	}
 
 	// Create the image object
-	// Merge source metadata into properties
-	if i.Properties == nil {
-		i.Properties = map[string]string{}
+	// Merge source metadata into a copy of the properties, since the same
+	// image may be published to several clouds
+	properties := make(map[string]string, len(i.Properties)+4)
+	for k, v := range i.Properties {
+		properties[k] = v
 	}
-	i.Properties["source_url"] = i.Url
+	properties["source_url"] = i.Url
 	if meta.ETag != "" {
-		i.Properties["source_etag"] = meta.ETag
+		properties["source_etag"] = meta.ETag
 	}
 	if meta.LastModified != "" {
-		i.Properties["source_last_modified"] = meta.LastModified
+		properties["source_last_modified"] = meta.LastModified
 	}
 	if meta.ContentLength > 0 {
-		i.Properties["source_content_length"] = fmt.Sprintf("%d", meta.ContentLength)
+		properties["source_content_length"] = fmt.Sprintf("%d", meta.ContentLength)
+	}
+	if i.Protected {
+		properties[ProtectedProperty] = "true"
 	}
 
 	zap.S().Infow("Creating image object", "name", i.Name, "public", i.Public, "protected", i.Protected, "tags", i.Tags)
@@ -604,47 +762,44 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 		Visibility:      &visibility,
 		Protected:       &i.Protected,
 		ContainerFormat: "bare",
-		DiskFormat:      "raw",
-		Properties:      i.Properties,
+		DiskFormat:      diskFormat,
+		Properties:      properties,
 	}
 	res, err := images.Create(context.TODO(), c, createOpts).Extract()
 	if err != nil {
-		return err
+		return "", err
 	}
 	zap.S().Infow("Image object created", "id", res.ID, "name", i.Name)
+	return res.ID, nil
+}
 
-	// Upload the image data
-	data, err := os.Open(rawFile)
+// Publish creates the image in Glance and uploads the artifact to it with the
+// given upload method, either UploadMethodUpload or UploadMethodGlanceDirect.
+// It returns the ID of the new image.
+func (i Image) Publish(c *gophercloud.ServiceClient, a *Artifact, method string) (string, error) {
+	if a.Streamed() && a.stream == nil {
+		return "", errors.New("streamed image has already been published")
+	}
+	id, err := i.create(c, a.DiskFormat, a.Meta)
 	if err != nil {
-		return err
+		return "", err
 	}
-	defer data.Close()
 
-	zap.S().Infow("Uploading image data", "id", res.ID, "file", rawFile)
-	// Use context with timeout for image data upload
-	timeoutSecs := 6000
-	if v := os.Getenv("IMAGE_SHEPHERD_UPLOAD_TIMEOUT_SECS"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil && n > 0 {
-			timeoutSecs = n
-		}
+	if a.Streamed() {
+		return i.publishStream(c, a, method, id)
 	}
-	ctxUpload, cancelUpload := context.WithTimeout(context.Background(), time.Duration(timeoutSecs)*time.Second)
-	defer cancelUpload()
 
-	// Temporarily increase HTTP client timeout to exceed the upload context timeout,
-	// otherwise the client may abort early while awaiting headers.
-	prevTimeout := c.HTTPClient.Timeout
-	bump := time.Duration(timeoutSecs+30) * time.Second
-	if prevTimeout != 0 && prevTimeout < bump {
-		c.HTTPClient.Timeout = bump
-		zap.S().Infow("Temporarily increasing HTTP client timeout for upload", "previous_timeout_secs", int(prevTimeout/time.Second), "new_timeout_secs", int(bump/time.Second))
+	// Upload the image data
+	data, err := os.Open(a.File)
+	if err != nil {
+		return "", err
 	}
-	defer func() {
-		if prevTimeout != 0 {
-			c.HTTPClient.Timeout = prevTimeout
-			zap.S().Debugw("Restored HTTP client timeout after upload", "timeout_secs", int(prevTimeout/time.Second))
-		}
-	}()
+	defer data.Close()
+
+	// The upload context bounds the whole upload, since the client only
+	// bounds requests without a deadline of their own
+	ctxUpload, cancelUpload := context.WithTimeout(context.Background(), i.uploadTimeout())
+	defer cancelUpload()
 
 	// Retry upload with backoff on transient failures/timeouts
 	maxAttempts := 3
@@ -652,15 +807,23 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 	for attempt := 1; attempt <= maxAttempts; attempt++ {
 		// Reset reader to beginning for each retry
 		if _, seekErr := data.Seek(0, 0); seekErr != nil {
-			zap.S().Errorw("Failed to seek image file before upload", "file", rawFile, "error", seekErr)
-			return seekErr
+			zap.S().Errorw("Failed to seek image file before upload", "file", a.File, "error", seekErr)
+			return "", seekErr
 		}
 
-		zap.S().Infow("Uploading image data", "id", res.ID, "file", rawFile, "timeout_secs", timeoutSecs, "attempt", attempt, "max_attempts", maxAttempts)
-		err = imagedata.Upload(ctxUpload, c, res.ID, data).ExtractErr()
+		zap.S().Infow("Uploading image data", "id", id, "file", a.File, "method", method, "attempt", attempt, "max_attempts", maxAttempts)
+		if method == UploadMethodGlanceDirect {
+			err = imagedata.Stage(ctxUpload, c, id, data).ExtractErr()
+		} else {
+			err = imagedata.Upload(ctxUpload, c, id, data).ExtractErr()
+		}
 		if err == nil {
-			zap.S().Infow("Image data upload complete", "id", res.ID, "file", rawFile, "attempt", attempt)
-			return nil
+			zap.S().Infow("Image data upload complete", "id", id, "file", a.File, "attempt", attempt)
+			if method == UploadMethodGlanceDirect {
+				err = i.importAndWait(c, id, importOpts{method: imageimport.GlanceDirectMethod})
+				return id, err
+			}
+			return id, nil
 		}
 
 		msg := err.Error()
@@ -674,16 +837,52 @@ func (i Image) Upload(c *gophercloud.ServiceClient, meta SourceMeta) error {
 			strings.Contains(msg, "504")
 
 		if attempt < maxAttempts && retryable {
-			zap.S().Warnw("Image data upload failed, will retry with backoff", "id", res.ID, "file", rawFile, "attempt", attempt, "error", err, "backoff", backoff.String())
+			zap.S().Warnw("Image data upload failed, will retry with backoff", "id", id, "file", a.File, "attempt", attempt, "error", err, "backoff", backoff.String())
 			time.Sleep(backoff)
 			backoff *= 2
 			continue
 		}
 
-		zap.S().Errorw("Image data upload failed", "id", res.ID, "file", rawFile, "attempt", attempt, "error", err)
-		return err
+		zap.S().Errorw("Image data upload failed", "id", id, "file", a.File, "attempt", attempt, "error", err)
+		return "", err
+	}
+	return "", err
+}
+
+// publishStream uploads a streamed artifact to the image id. A stream can't be
+// rewound, so the upload isn't retried, and the image is deleted if the upload
+// fails. If that is because the source changed, ErrSourceChanged is returned
+// so the image can be built again without streaming.
+func (i Image) publishStream(c *gophercloud.ServiceClient, a *Artifact, method string, id string) (string, error) {
+	ctxUpload, cancelUpload := context.WithTimeout(context.Background(), i.uploadTimeout())
+	defer cancelUpload()
+
+	zap.S().Infow("Streaming image data", "id", id, "url", i.Url, "method", method)
+	var err error
+	if method == UploadMethodGlanceDirect {
+		err = imagedata.Stage(ctxUpload, c, id, a.stream).ExtractErr()
+	} else {
+		err = imagedata.Upload(ctxUpload, c, id, a.stream).ExtractErr()
+	}
+	a.stream = nil
+	if err == nil {
+		err = a.finish()
+	}
+	if err != nil {
+		zap.S().Errorw("Image data stream failed; deleting image", "id", id, "error", err)
+		i.discard(c, id)
+		if a.changed() {
+			return "", ErrSourceChanged
+		}
+		return "", err
+	}
+	zap.S().Infow("Image data stream complete", "id", id)
+
+	if method == UploadMethodGlanceDirect {
+		err = i.importAndWait(c, id, importOpts{method: imageimport.GlanceDirectMethod})
+		return id, err
 	}
-	return err
+	return id, nil
 }
 
 func RenameHideByID(c *gophercloud.ServiceClient, id string) error {
@@ -722,3 +921,30 @@ func RenameHideByID(c *gophercloud.ServiceClient, id string) error {
 	zap.S().Infow("Renamed and hid image", "id", id, "old_name", img.Name, "new_name", newName, "os_hidden", true)
 	return nil
 }
+
+// DeleteByID deletes an image. If unprotect is true, a protected image is
+// unprotected first; otherwise deleting a protected image fails.
+func DeleteByID(c *gophercloud.ServiceClient, id string, unprotect bool) error {
+	zap.S().Infow("Deleting image by ID", "id", id, "unprotect", unprotect)
+
+	if unprotect {
+		updateOpts := images.UpdateOpts{
+			images.ReplaceImageProtected{
+				NewProtected: false,
+			},
+		}
+		if _, err := images.Update(context.TODO(), c, id, updateOpts).Extract(); err != nil {
+			zap.S().Errorw("Failed to unprotect image", "id", id, "error", err)
+			return err
+		}
+		zap.S().Infow("Unprotected image", "id", id)
+	}
+
+	if err := images.Delete(context.TODO(), c, id).ExtractErr(); err != nil {
+		zap.S().Errorw("Failed to delete image", "id", id, "error", err)
+		return err
+	}
+
+	zap.S().Infow("Deleted image", "id", id)
+	return nil
+}
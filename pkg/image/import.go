@@ -0,0 +1,229 @@
+package image
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"path"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/imageimport"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+	"go.uber.org/zap"
+)
+
+// Values of upload_method.
+const (
+	// UploadMethodUpload downloads and converts the image locally and uploads
+	// the result to Glance. This is the default.
+	UploadMethodUpload = "upload"
+	// UploadMethodWebDownload has Glance download the image from its source
+	// URL itself, using the interoperable image import API.
+	UploadMethodWebDownload = "web-download"
+	// UploadMethodGlanceDirect downloads and converts the image locally, then
+	// stages it in Glance and imports it from there.
+	UploadMethodGlanceDirect = "glance-direct"
+)
+
+// UploadMethods lists the valid values of upload_method.
+var UploadMethods = []string{UploadMethodUpload, UploadMethodWebDownload, UploadMethodGlanceDirect}
+
+// importPollInterval is how often the status of an import is checked.
+var importPollInterval = 5 * time.Second
+
+// ImportMethods returns the interoperable image import methods the cloud
+// advertises in /v2/info/import.
+func ImportMethods(c *gophercloud.ServiceClient) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	info, err := imageimport.Get(ctx, c).Extract()
+	if err != nil {
+		return nil, err
+	}
+	return info.ImportMethods.Value, nil
+}
+
+// ConfiguredUploadMethod returns the upload_method of the image in lower case,
+// or UploadMethodUpload if it isn't set.
+func (i Image) ConfiguredUploadMethod() string {
+	if m := strings.ToLower(strings.TrimSpace(i.UploadMethod)); m != "" {
+		return m
+	}
+	return UploadMethodUpload
+}
+
+// UploadMethodFor returns the upload method to use on a cloud that advertises
+// the given import methods. It falls back to UploadMethodUpload when the
+// configured method isn't advertised or can't be used for this image.
+func (i Image) UploadMethodFor(available []string) string {
+	method := i.ConfiguredUploadMethod()
+	if method == UploadMethodUpload {
+		return UploadMethodUpload
+	}
+	if !slices.Contains(available, method) {
+		zap.S().Warnw("Upload method not supported by the cloud; falling back to upload", "image", i.Name, "upload_method", method, "available", available)
+		return UploadMethodUpload
+	}
+	if method == UploadMethodWebDownload {
+		if reason := i.webDownloadBlocker(); reason != "" {
+			zap.S().Warnw("Image can't be imported with web-download; falling back to upload", "image", i.Name, "reason", reason)
+			return UploadMethodUpload
+		}
+	}
+	return method
+}
+
+// webDownloadBlocker explains why Glance can't import the source as it is, or
+// returns an empty string if it can. Glance stores what it downloads without
+// decompressing it, and a checksum must be verified before anything is created
+// in Glance.
+func (i Image) webDownloadBlocker() string {
+	if compressionFor(i.Compression, path.Base(i.Url)) != compressionNone {
+		return "source is compressed"
+	}
+	sf := strings.ToLower(strings.TrimSpace(i.SourceFormat))
+	if sf == "" {
+		return "source_format must be set"
+	}
+	if _, err := glanceDiskFormat(qemuFormat(sf)); err != nil {
+		return err.Error()
+	}
+	if tf := i.targetFormat(); tf != TargetFormatAsIs && qemuFormat(tf) != qemuFormat(sf) {
+		return fmt.Sprintf("converting to target_format %s requires a local download", tf)
+	}
+	if i.TargetCompressed {
+		return "compressing the image requires a local download"
+	}
+	if i.Checksum != nil {
+		return "verifying the checksum requires a local download"
+	}
+	return ""
+}
+
+// importOpts starts an import. Unlike imageimport.CreateOpts, it only sends a
+// URI for web-download.
+type importOpts struct {
+	method imageimport.ImportMethod
+	uri    string
+}
+
+func (o importOpts) ToImportCreateMap() (map[string]any, error) {
+	m := map[string]any{"name": o.method}
+	if o.uri != "" {
+		m["uri"] = o.uri
+	}
+	return map[string]any{"method": m}, nil
+}
+
+// WebDownload creates the image in Glance and has Glance download it from the
+// source URL with the web-download import method, so the image never passes
+// through this host. It returns the ID of the new image.
+func (i Image) WebDownload(c *gophercloud.ServiceClient, meta SourceMeta) (string, error) {
+	diskFormat, err := glanceDiskFormat(qemuFormat(strings.ToLower(strings.TrimSpace(i.SourceFormat))))
+	if err != nil {
+		return "", err
+	}
+	id, err := i.create(c, diskFormat, meta)
+	if err != nil {
+		return "", err
+	}
+
+	zap.S().Infow("Importing image with web-download", "id", id, "url", i.Url)
+	if err := i.importAndWait(c, id, importOpts{method: imageimport.WebDownloadMethod, uri: i.Url}); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// importAndWait starts an import of the image and waits for it to become
+// active. A failed import is deleted.
+func (i Image) importAndWait(c *gophercloud.ServiceClient, id string, opts importOpts) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	err := imageimport.Create(ctx, c, id, opts).ExtractErr()
+	cancel()
+	if err != nil {
+		zap.S().Errorw("Failed to start image import", "id", id, "method", opts.method, "error", err)
+		i.discard(c, id)
+		return err
+	}
+
+	if err := waitForImport(c, id, i.uploadTimeout()); err != nil {
+		zap.S().Errorw("Image import failed", "id", id, "method", opts.method, "error", err)
+		i.discard(c, id)
+		return err
+	}
+	zap.S().Infow("Image import complete", "id", id, "method", opts.method)
+	return nil
+}
+
+// discard deletes an image whose import failed, so it isn't mistaken for the
+// current version on the next run.
+func (i Image) discard(c *gophercloud.ServiceClient, id string) {
+	if err := DeleteByID(c, id, i.Protected); err != nil {
+		zap.S().Warnw("Failed to delete image after failed upload", "id", id, "error", err)
+	}
+}
+
+// waitForImport polls the image until the import finishes. Glance reports a
+// failed import by returning the image to the queued status, and on clouds
+// with multiple stores by listing them in os_glance_failed_import.
+func waitForImport(c *gophercloud.ServiceClient, id string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	started := false
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+		img, err := images.Get(ctx, c, id).Extract()
+		cancel()
+		if err != nil {
+			return err
+		}
+
+		failed, _ := img.Properties["os_glance_failed_import"].(string)
+		switch img.Status {
+		case images.ImageStatusActive:
+			return nil
+		case images.ImageStatusKilled, images.ImageStatusDeleted, images.ImageStatusPendingDelete, images.ImageStatusDeactivated:
+			return fmt.Errorf("import ended with image status %s%s", img.Status, importTaskMessage(c, id))
+		case images.ImageStatusQueued:
+			if failed != "" || started {
+				return fmt.Errorf("import failed%s", importTaskMessage(c, id))
+			}
+		default:
+			started = true
+		}
+		if failed != "" {
+			return fmt.Errorf("import failed for stores %s%s", failed, importTaskMessage(c, id))
+		}
+
+		if time.Now().After(deadline) {
+			return fmt.Errorf("import did not finish within %s (image status %s)", timeout, img.Status)
+		}
+		zap.S().Debugw("Waiting for image import", "id", id, "status", img.Status)
+		time.Sleep(importPollInterval)
+	}
+}
+
+// importTaskMessage returns the message of the latest import task of the
+// image, formatted for appending to an error, if Glance exposes one.
+func importTaskMessage(c *gophercloud.ServiceClient, id string) string {
+	var body struct {
+		Tasks []struct {
+			Status  string `json:"status"`
+			Message string `json:"message"`
+		} `json:"tasks"`
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	if _, err := c.Get(ctx, c.ServiceURL("images", id, "tasks"), &body, &gophercloud.RequestOpts{OkCodes: []int{http.StatusOK}}); err != nil {
+		return ""
+	}
+	for idx := len(body.Tasks) - 1; idx >= 0; idx-- {
+		if msg := body.Tasks[idx].Message; msg != "" {
+			return ": " + msg
+		}
+	}
+	return ""
+}
@@ -0,0 +1,279 @@
+package image
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+// glance is a stub of the Glance v2 API that manages a single image, glanceID.
+type glance struct {
+	mu sync.Mutex
+	// methods are the advertised import methods
+	methods []string
+	// statuses are returned by successive requests for the image, repeating
+	// the last one
+	statuses []string
+	// failedStores is the os_glance_failed_import property of the image
+	failedStores string
+	// tasks are the messages of the import tasks of the image, oldest first.
+	// Without tasks, the tasks API isn't found.
+	tasks []string
+	// uploadStatus, if set, is returned for uploaded and staged image data
+	uploadStatus int
+
+	// requests lists the requests received, as "METHOD path", and data and
+	// imported what was uploaded and the body of the import request
+	requests []string
+	data     []byte
+	imported map[string]any
+}
+
+const glanceID = "6f1c"
+
+func (g *glance) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.requests = append(g.requests, r.Method+" "+r.URL.Path)
+	image := "/v2/images/" + glanceID
+
+	switch route := r.Method + " " + r.URL.Path; route {
+	case "GET /v2/info/import":
+		writeJSON(w, http.StatusOK, map[string]any{"import-methods": map[string]any{"value": g.methods}})
+	case "POST /v2/images":
+		writeJSON(w, http.StatusCreated, map[string]any{"id": glanceID, "status": "queued"})
+	case "PUT " + image + "/file", "PUT " + image + "/stage":
+		data, err := io.ReadAll(r.Body)
+		switch {
+		case g.uploadStatus != 0:
+			http.Error(w, "upload failed", g.uploadStatus)
+			return
+		case err != nil:
+			http.Error(w, "upload failed", http.StatusInternalServerError)
+			return
+		}
+		g.data = data
+		w.WriteHeader(http.StatusNoContent)
+	case "POST " + image + "/import":
+		_ = json.NewDecoder(r.Body).Decode(&g.imported)
+		w.WriteHeader(http.StatusAccepted)
+	case "GET " + image:
+		status := "active"
+		if len(g.statuses) > 0 {
+			status = g.statuses[0]
+			if len(g.statuses) > 1 {
+				g.statuses = g.statuses[1:]
+			}
+		}
+		body := map[string]any{"id": glanceID, "status": status}
+		if g.failedStores != "" {
+			body["os_glance_failed_import"] = g.failedStores
+		}
+		writeJSON(w, http.StatusOK, body)
+	case "GET " + image + "/tasks":
+		if len(g.tasks) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		tasks := make([]map[string]any, len(g.tasks))
+		for idx, msg := range g.tasks {
+			tasks[idx] = map[string]any{"status": "failure", "message": msg}
+		}
+		writeJSON(w, http.StatusOK, map[string]any{"tasks": tasks})
+	case "DELETE " + image:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unexpected request "+route, http.StatusNotImplemented)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// serveGlance starts g and returns an image service client for it.
+func serveGlance(t *testing.T, g *glance) *gophercloud.ServiceClient {
+	t.Helper()
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	return &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *srv.Client()},
+		Endpoint:       srv.URL + "/",
+		ResourceBase:   srv.URL + "/v2/",
+	}
+}
+
+func TestUploadMethodFor(t *testing.T) {
+	both := []string{"glance-direct", "web-download"}
+	raw := Image{Name: "appliance", Url: "https://example.com/appliance.raw", SourceFormat: "raw"}
+	with := func(edit func(i *Image)) Image {
+		i := raw
+		edit(&i)
+		return i
+	}
+
+	tests := []struct {
+		name      string
+		image     Image
+		available []string
+		want      string
+	}{
+		{"default", raw, both, UploadMethodUpload},
+		{"web-download", with(func(i *Image) { i.UploadMethod = "web-download" }), both, UploadMethodWebDownload},
+		{"glance-direct in any case", with(func(i *Image) { i.UploadMethod = " Glance-Direct " }), both, UploadMethodGlanceDirect},
+		{"not advertised", with(func(i *Image) { i.UploadMethod = "web-download" }), []string{"glance-direct"}, UploadMethodUpload},
+		{"no import API", with(func(i *Image) { i.UploadMethod = "glance-direct" }), nil, UploadMethodUpload},
+		{
+			name: "compressed source",
+			image: with(func(i *Image) {
+				i.UploadMethod, i.Url = "web-download", "https://example.com/appliance.raw.xz"
+			}),
+			available: both,
+			want:      UploadMethodUpload,
+		},
+		// Only web-download needs Glance to take the source as it is
+		{
+			name: "glance-direct with a compressed source",
+			image: with(func(i *Image) {
+				i.UploadMethod, i.Url = "glance-direct", "https://example.com/appliance.raw.xz"
+			}),
+			available: both,
+			want:      UploadMethodGlanceDirect,
+		},
+	}
+	for _, tt := range tests {
+		if got := tt.image.UploadMethodFor(tt.available); got != tt.want {
+			t.Errorf("UploadMethodFor(%v) for %s = %s, want %s", tt.available, tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWebDownloadBlocker(t *testing.T) {
+	tests := []struct {
+		name  string
+		image Image
+		want  string
+	}{
+		{"raw as raw", Image{Url: "https://example.com/disk.raw", SourceFormat: "raw"}, ""},
+		{"qcow2 as qcow2", Image{Url: "https://example.com/disk.qcow2", SourceFormat: "QCOW2", TargetFormat: "qcow2"}, ""},
+		{"vhd as-is", Image{Url: "https://example.com/disk.vhd", SourceFormat: "vhd", TargetFormat: "as-is"}, ""},
+		{"compressed by extension", Image{Url: "https://example.com/disk.raw.xz", SourceFormat: "raw"}, "source is compressed"},
+		{"compressed by configuration", Image{Url: "https://example.com/disk", SourceFormat: "raw", Compression: "gz"}, "source is compressed"},
+		{"no source format", Image{Url: "https://example.com/disk.raw"}, "source_format must be set"},
+		{"unsupported source format", Image{Url: "https://example.com/disk.qed", SourceFormat: "qed", TargetFormat: "as-is"}, `image format "qed" can't be uploaded to Glance as-is`},
+		{"conversion", Image{Url: "https://example.com/disk.qcow2", SourceFormat: "qcow2"}, "converting to target_format raw requires a local download"},
+		{"compression", Image{Url: "https://example.com/disk.qcow2", SourceFormat: "qcow2", TargetFormat: "as-is", TargetCompressed: true}, "compressing the image requires a local download"},
+		{"checksum", Image{Url: "https://example.com/disk.raw", SourceFormat: "raw", Checksum: &Checksum{Value: "abc"}}, "verifying the checksum requires a local download"},
+	}
+	for _, tt := range tests {
+		if got := tt.image.webDownloadBlocker(); got != tt.want {
+			t.Errorf("webDownloadBlocker() for %s = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestWaitForImport(t *testing.T) {
+	importPollInterval = time.Millisecond
+	t.Cleanup(func() { importPollInterval = 5 * time.Second })
+
+	tests := []struct {
+		name      string
+		g         *glance
+		timeout   time.Duration
+		wantError string
+	}{
+		{
+			name: "active",
+			g:    &glance{statuses: []string{"queued", "importing", "active"}},
+		},
+		{
+			name:      "returned to queued",
+			g:         &glance{statuses: []string{"importing", "queued"}, tasks: []string{"", "Image import failed: 404 Not Found"}},
+			wantError: "import failed: Image import failed: 404 Not Found",
+		},
+		{
+			name:      "killed without tasks",
+			g:         &glance{statuses: []string{"importing", "killed"}},
+			wantError: "import ended with image status killed",
+		},
+		{
+			name:      "failed stores",
+			g:         &glance{statuses: []string{"importing"}, failedStores: "ceph", tasks: []string{"store ceph unavailable"}},
+			wantError: "import failed for stores ceph: store ceph unavailable",
+		},
+		{
+			name:      "timeout",
+			g:         &glance{statuses: []string{"importing"}},
+			timeout:   20 * time.Millisecond,
+			wantError: "import did not finish within 20ms (image status importing)",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			timeout := tt.timeout
+			if timeout == 0 {
+				timeout = time.Minute
+			}
+			err := waitForImport(serveGlance(t, tt.g), glanceID, timeout)
+			if tt.wantError == "" {
+				if err != nil {
+					t.Errorf("waitForImport() error = %v", err)
+				}
+				return
+			}
+			if err == nil || err.Error() != tt.wantError {
+				t.Errorf("waitForImport() error = %v, want %q", err, tt.wantError)
+			}
+		})
+	}
+}
+
+func TestWebDownload(t *testing.T) {
+	importPollInterval = time.Millisecond
+	t.Cleanup(func() { importPollInterval = 5 * time.Second })
+	i := Image{Name: "appliance", Url: "https://example.com/appliance.raw", SourceFormat: "raw", UploadMethod: "web-download"}
+	i.Init()
+
+	g := &glance{methods: []string{"web-download"}, statuses: []string{"importing", "active"}}
+	c := serveGlance(t, g)
+	methods, err := ImportMethods(c)
+	if err != nil {
+		t.Fatalf("ImportMethods() error = %v", err)
+	}
+	if method := i.UploadMethodFor(methods); method != UploadMethodWebDownload {
+		t.Fatalf("UploadMethodFor(%v) = %s, want web-download", methods, method)
+	}
+	id, err := i.WebDownload(c, SourceMeta{})
+	if err != nil || id != glanceID {
+		t.Fatalf("WebDownload() = %s, %v, want %s", id, err, glanceID)
+	}
+	want := map[string]any{"method": map[string]any{"name": "web-download", "uri": i.Url}}
+	if !jsonEqual(g.imported, want) {
+		t.Errorf("import request = %v, want %v", g.imported, want)
+	}
+
+	// A failed import is deleted
+	g = &glance{statuses: []string{"importing", "queued"}}
+	c = serveGlance(t, g)
+	if _, err := i.WebDownload(c, SourceMeta{}); err == nil || !strings.Contains(err.Error(), "import failed") {
+		t.Fatalf("WebDownload() error = %v, want import failed", err)
+	}
+	if last := g.requests[len(g.requests)-1]; last != "DELETE /v2/images/"+glanceID {
+		t.Errorf("last request = %s, want the image to be deleted", last)
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,73 @@
+package image
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/ProtonMail/go-crypto/openpgp/clearsign"
+	"go.uber.org/zap"
+)
+
+// loadKeyring reads an armored OpenPGP public key file.
+func loadKeyring(path string) (openpgp.EntityList, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("open keyring: %w", err)
+	}
+	defer f.Close()
+	keyring, err := openpgp.ReadArmoredKeyRing(f)
+	if err != nil {
+		return nil, fmt.Errorf("read keyring %s: %w", path, err)
+	}
+	return keyring, nil
+}
+
+// verifySigned checks the OpenPGP signature of a checksum file and returns the
+// signed content, which is the only part that may be trusted. With a signature
+// URL the signature is detached (armored or binary); otherwise the checksum
+// file itself must be clearsigned.
+func (c Checksum) verifySigned(body []byte) ([]byte, error) {
+	if c.Keyring == "" {
+		if c.SignatureURL != "" {
+			return nil, fmt.Errorf("signature_url requires a keyring")
+		}
+		return body, nil
+	}
+
+	keyring, err := loadKeyring(c.Keyring)
+	if err != nil {
+		return nil, err
+	}
+
+	var signer *openpgp.Entity
+	signed := body
+	if c.SignatureURL != "" {
+		zap.S().Infow("Fetching checksum signature", "url", c.SignatureURL)
+		sig, err := fetchSmall(c.SignatureURL)
+		if err != nil {
+			return nil, err
+		}
+		if bytes.HasPrefix(bytes.TrimSpace(sig), []byte("-----BEGIN PGP SIGNATURE-----")) {
+			signer, err = openpgp.CheckArmoredDetachedSignature(keyring, bytes.NewReader(body), bytes.NewReader(sig), nil)
+		} else {
+			signer, err = openpgp.CheckDetachedSignature(keyring, bytes.NewReader(body), bytes.NewReader(sig), nil)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid signature for checksum file %s: %w", c.URL, err)
+		}
+	} else {
+		block, _ := clearsign.Decode(body)
+		if block == nil {
+			return nil, fmt.Errorf("checksum file %s is not clearsigned and no signature_url is set", c.URL)
+		}
+		if signer, err = block.VerifySignature(keyring, nil); err != nil {
+			return nil, fmt.Errorf("invalid signature for checksum file %s: %w", c.URL, err)
+		}
+		signed = block.Plaintext
+	}
+
+	zap.S().Infow("Checksum file signature verified", "url", c.URL, "key_id", fmt.Sprintf("%X", signer.PrimaryKey.KeyId), "identities", len(signer.Identities))
+	return signed, nil
+}
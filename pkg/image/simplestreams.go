@@ -0,0 +1,142 @@
+package image
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// SimpleStreams selects an image from a simplestreams products index, such as
+// Ubuntu's com.ubuntu.cloud:released:download.json.
+type SimpleStreams struct {
+	// URL is the products index, e.g.
+	// https://cloud-images.ubuntu.com/releases/streams/v1/com.ubuntu.cloud:released:download.json
+	URL string `yaml:"url"`
+	// Product is the full product ID, e.g. com.ubuntu.cloud:server:24.04:amd64.
+	// If unset, the product is selected by Release and Arch.
+	Product string `yaml:"product,omitempty"`
+	// Release matches the version or release name of a product, e.g. 24.04 or noble.
+	Release string `yaml:"release,omitempty"`
+	// Arch is the product architecture, e.g. amd64.
+	Arch string `yaml:"arch,omitempty"`
+	// Serial pins a build serial. The newest serial is used if unset.
+	Serial string `yaml:"serial,omitempty"`
+	// Item is the file type to download. It defaults to disk1.img.
+	Item string `yaml:"item,omitempty"`
+}
+
+// simpleStreamsIndex is the subset of the products:1.0 format that is needed to
+// pick a disk image.
+type simpleStreamsIndex struct {
+	Format   string `json:"format"`
+	Products map[string]struct {
+		Arch     string `json:"arch"`
+		OS       string `json:"os"`
+		Release  string `json:"release"`
+		Version  string `json:"version"`
+		Versions map[string]struct {
+			Items map[string]struct {
+				Ftype  string `json:"ftype"`
+				Path   string `json:"path"`
+				Sha256 string `json:"sha256"`
+			} `json:"items"`
+		} `json:"versions"`
+	} `json:"products"`
+}
+
+// resolveSimpleStreams points the image at the selected build of a
+// simplestreams product, verified with the published sha256.
+func (i *Image) resolveSimpleStreams() error {
+	ss := i.SimpleStreams
+	if ss == nil || ss.URL == "" {
+		return fmt.Errorf("image %q uses source %q but has no simplestreams url", i.Name, SourceSimpleStreams)
+	}
+	item := ss.Item
+	if item == "" {
+		item = "disk1.img"
+	}
+
+	zap.S().Infow("Fetching simplestreams index", "url", ss.URL, "product", ss.Product, "release", ss.Release, "arch", ss.Arch, "serial", ss.Serial)
+	// Product indexes for a whole distribution can be several megabytes
+	body, err := fetchLimited(ss.URL, 256<<20)
+	if err != nil {
+		return err
+	}
+	var index simpleStreamsIndex
+	if err := json.Unmarshal(body, &index); err != nil {
+		return fmt.Errorf("parse simplestreams index %s: %w", ss.URL, err)
+	}
+	if index.Format != "" && index.Format != "products:1.0" {
+		return fmt.Errorf("simplestreams index %s has unsupported format %q", ss.URL, index.Format)
+	}
+
+	productID := ss.Product
+	if productID == "" {
+		var matches []string
+		for id, p := range index.Products {
+			if (ss.Release == "" || p.Version == ss.Release || p.Release == ss.Release) && (ss.Arch == "" || p.Arch == ss.Arch) {
+				matches = append(matches, id)
+			}
+		}
+		if len(matches) != 1 {
+			sort.Strings(matches)
+			return fmt.Errorf("simplestreams release %q and arch %q match %d products %v; set product", ss.Release, ss.Arch, len(matches), matches)
+		}
+		productID = matches[0]
+	}
+	product, ok := index.Products[productID]
+	if !ok {
+		return fmt.Errorf("simplestreams index %s has no product %q", ss.URL, productID)
+	}
+
+	// Serials are dates such as 20251010 or 20251010.1, newest wins
+	serial := ss.Serial
+	if serial == "" {
+		for candidate, v := range product.Versions {
+			if _, ok := v.Items[item]; ok && (serial == "" || compareVersions(candidate, serial) > 0) {
+				serial = candidate
+			}
+		}
+	}
+	build, ok := product.Versions[serial]
+	if !ok {
+		return fmt.Errorf("product %s has no build with a %s item (serial %q)", productID, item, ss.Serial)
+	}
+	file, ok := build.Items[item]
+	if !ok || file.Path == "" {
+		return fmt.Errorf("build %s of product %s has no %s item", serial, productID, item)
+	}
+
+	// Item paths are relative to the mirror root, the parent of streams/
+	root, err := url.Parse(ss.URL)
+	if err != nil {
+		return fmt.Errorf("invalid simplestreams url: %w", err)
+	}
+	if idx := strings.Index(root.Path, "/streams/"); idx >= 0 {
+		root.Path = root.Path[:idx+1]
+	} else {
+		root.Path = path.Dir(root.Path) + "/"
+	}
+	ref, err := url.Parse(file.Path)
+	if err != nil {
+		return fmt.Errorf("invalid item path %q: %w", file.Path, err)
+	}
+
+	if i.Checksum == nil && file.Sha256 != "" {
+		i.Checksum = &Checksum{Value: file.Sha256}
+	}
+	if product.OS != "" {
+		setDefault(&i.Properties, "os_distro", product.OS)
+	}
+	if product.Version != "" {
+		setDefault(&i.Properties, "os_version", product.Version)
+	}
+	i.Properties["simplestreams_product"] = productID
+	i.setResolved(root.ResolveReference(ref).String(), serial)
+	return nil
+}
@@ -0,0 +1,129 @@
+package image
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestResolveSimpleStreams(t *testing.T) {
+	// ubuntu-released-download.json has the layout of Ubuntu's released
+	// products index, trimmed to a few products and builds
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/releases/streams/v1/com.ubuntu.cloud:released:download.json" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeFile(w, r, "testdata/ubuntu-released-download.json")
+	}))
+	defer srv.Close()
+	index := srv.URL + "/releases/streams/v1/com.ubuntu.cloud:released:download.json"
+	mirror := srv.URL + "/releases/server/releases/"
+
+	tests := []struct {
+		name        string
+		ss          SimpleStreams
+		wantURL     string
+		wantSerial  string
+		wantProduct string
+		wantVersion string
+		wantError   string
+	}{
+		{
+			name:        "newest serial with a disk image",
+			ss:          SimpleStreams{Release: "24.04", Arch: "amd64"},
+			wantURL:     mirror + "noble/release-20251010.1/ubuntu-24.04-server-cloudimg-amd64.img",
+			wantSerial:  "20251010.1",
+			wantProduct: "com.ubuntu.cloud:server:24.04:amd64",
+			wantVersion: "24.04",
+		},
+		{
+			name:        "release by codename",
+			ss:          SimpleStreams{Release: "noble", Arch: "arm64"},
+			wantURL:     mirror + "noble/release-20251010/ubuntu-24.04-server-cloudimg-arm64.img",
+			wantSerial:  "20251010",
+			wantProduct: "com.ubuntu.cloud:server:24.04:arm64",
+			wantVersion: "24.04",
+		},
+		{
+			name:        "product",
+			ss:          SimpleStreams{Product: "com.ubuntu.cloud:server:22.04:amd64"},
+			wantURL:     mirror + "jammy/release-20251009/ubuntu-22.04-server-cloudimg-amd64.img",
+			wantSerial:  "20251009",
+			wantProduct: "com.ubuntu.cloud:server:22.04:amd64",
+			wantVersion: "22.04",
+		},
+		{
+			name:        "pinned serial",
+			ss:          SimpleStreams{Release: "24.04", Arch: "amd64", Serial: "20250926"},
+			wantURL:     mirror + "noble/release-20250926/ubuntu-24.04-server-cloudimg-amd64.img",
+			wantSerial:  "20250926",
+			wantProduct: "com.ubuntu.cloud:server:24.04:amd64",
+			wantVersion: "24.04",
+		},
+		{
+			name:        "item",
+			ss:          SimpleStreams{Release: "22.04", Item: "tar.gz"},
+			wantURL:     mirror + "jammy/release-20251009/ubuntu-22.04-server-cloudimg-amd64.tar.gz",
+			wantSerial:  "20251009",
+			wantProduct: "com.ubuntu.cloud:server:22.04:amd64",
+			wantVersion: "22.04",
+		},
+		{
+			name:      "ambiguous release",
+			ss:        SimpleStreams{Release: "24.04"},
+			wantError: `match 2 products [com.ubuntu.cloud:server:24.04:amd64 com.ubuntu.cloud:server:24.04:arm64]; set product`,
+		},
+		{
+			name:      "unknown product",
+			ss:        SimpleStreams{Product: "com.ubuntu.cloud:server:20.04:amd64"},
+			wantError: `has no product "com.ubuntu.cloud:server:20.04:amd64"`,
+		},
+		{
+			name:      "pinned serial without a disk image",
+			ss:        SimpleStreams{Release: "24.04", Arch: "amd64", Serial: "20251014"},
+			wantError: "build 20251014 of product com.ubuntu.cloud:server:24.04:amd64 has no disk1.img item",
+		},
+		{
+			name:      "unknown serial",
+			ss:        SimpleStreams{Release: "24.04", Arch: "amd64", Serial: "20240101"},
+			wantError: `has no build with a disk1.img item (serial "20240101")`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ss := tt.ss
+			ss.URL = index
+			i := Image{Name: "Ubuntu", Source: SourceSimpleStreams, SimpleStreams: &ss}
+			i.Init()
+
+			err := i.Resolve()
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Resolve() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve() error = %v", err)
+			}
+			if i.Url != tt.wantURL {
+				t.Errorf("url = %s, want %s", i.Url, tt.wantURL)
+			}
+			for key, want := range map[string]string{
+				"source_version":        tt.wantSerial,
+				"simplestreams_product": tt.wantProduct,
+				"os_distro":             "ubuntu",
+				"os_version":            tt.wantVersion,
+			} {
+				if got := i.Properties[key]; got != want {
+					t.Errorf("%s = %q, want %q", key, got, want)
+				}
+			}
+			if i.Checksum == nil || len(i.Checksum.Value) != 64 {
+				t.Errorf("checksum = %+v, want the sha256 of the item", i.Checksum)
+			}
+		})
+	}
+}
@@ -0,0 +1,62 @@
+package image
+
+import (
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Source types select how the download URL of an image is found.
+const (
+	// SourceURL downloads the configured url as is.
+	SourceURL = "url"
+	// SourceDiscover finds the latest version in a directory listing.
+	SourceDiscover = "discover"
+	// SourceCoreOSStream follows a Fedora CoreOS stream.
+	SourceCoreOSStream = "coreos-stream"
+	// SourceSimpleStreams selects a build from a simplestreams products index.
+	SourceSimpleStreams = "simplestreams"
+)
+
+// Sources lists the valid values of source.
+var Sources = []string{SourceURL, SourceDiscover, SourceCoreOSStream, SourceSimpleStreams}
+
+// Resolve determines the URL to download for image sources that aren't a
+// fixed URL, updating Url and recording the resolved version in the
+// source_version property. It must be called after Init.
+func (i *Image) Resolve() error {
+	source := strings.ToLower(strings.TrimSpace(i.Source))
+	switch source {
+	case "", SourceURL:
+		if i.Url == "" {
+			return fmt.Errorf("image %q has no url", i.Name)
+		}
+		return nil
+	case SourceDiscover:
+		if i.Discover == nil {
+			return fmt.Errorf("image %q uses source %q but has no discover block", i.Name, source)
+		}
+		resolved, version, err := i.Discover.Latest(i.Url)
+		if err != nil {
+			return err
+		}
+		i.setResolved(resolved, version)
+		return nil
+	case SourceCoreOSStream:
+		return i.resolveCoreOSStream()
+	case SourceSimpleStreams:
+		return i.resolveSimpleStreams()
+	default:
+		return fmt.Errorf("image %q has unknown source %q", i.Name, i.Source)
+	}
+}
+
+// setResolved records the outcome of resolving a source.
+func (i *Image) setResolved(resolved string, version string) {
+	zap.S().Infow("Resolved image source", "name", i.Name, "source", i.Source, "url", resolved, "version", version)
+	i.Url = resolved
+	if version != "" {
+		i.Properties["source_version"] = version
+	}
+}
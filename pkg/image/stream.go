@@ -0,0 +1,444 @@
+package image
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sourceStream reads a download as a stream instead of saving it to a file,
+// so it can be decompressed on the fly. Like download.run, it makes up to
+// three attempts, counted again once a resumed attempt makes progress, and an
+// interrupted attempt is resumed with a Range request if the server supports
+// it. Since the bytes already read have been consumed,
+// a source that changed mid-download ends the stream with ErrSourceChanged,
+// and the build starts over with a new stream.
+type sourceStream struct {
+	url       string
+	validator string
+	canResume bool
+	client    *http.Client
+	// timeout is how long a request may wait for the server, either for the
+	// response headers or for more of the body
+	timeout time.Duration
+
+	// filename is the name of the downloaded file, and etag and lastModified
+	// the validators of its content, taken from the first response
+	filename     string
+	etag         string
+	lastModified string
+	offset       int64
+	body         io.ReadCloser
+	// cancel aborts the current request, which idle does once the body has
+	// not delivered any data for timeout
+	cancel context.CancelFunc
+	idle   *time.Timer
+	// err is the error that ended the stream, once no attempts are left
+	err error
+
+	attempt int
+	backoff time.Duration
+}
+
+const (
+	streamAttempts = 3
+	streamBackoff  = 2 * time.Second
+)
+
+// source is an opened image download.
+type source struct {
+	io.ReadCloser
+	// name is the file name of the download
+	name string
+	// file is the path of the cached copy, if the download cache is used, and
+	// release must be called once that copy is no longer needed. discard
+	// removes the copy from the cache.
+	file    string
+	release func()
+	discard func()
+}
+
+// openSource opens srcURL for reading. With a download cache configured, the
+// image is read from the revalidated cached copy; otherwise it is streamed
+// from the server without being saved.
+func openSource(srcURL string, meta SourceMeta, timeout time.Duration) (*source, error) {
+	if c := sharedCache(); c != nil {
+		file, release, err := c.Fetch(srcURL, meta, timeout)
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			release()
+			return nil, err
+		}
+		discard := func() { c.Discard(srcURL, file) }
+		return &source{ReadCloser: f, name: filepath.Base(file), file: file, release: release, discard: discard}, nil
+	}
+
+	s, err := openStream(srcURL, meta, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &source{ReadCloser: s, name: s.filename}, nil
+}
+
+// openStream starts downloading srcURL as a stream. The timeout bounds how
+// long each request waits for the server, not how long the body takes to read,
+// since a stream is read at the pace of whatever consumes it.
+func openStream(srcURL string, meta SourceMeta, timeout time.Duration) (*sourceStream, error) {
+	s := &sourceStream{
+		url:       srcURL,
+		validator: resumeValidator(meta),
+		canResume: meta.AcceptRanges,
+		client:    streamClient(timeout),
+		timeout:   timeout,
+		backoff:   streamBackoff,
+	}
+	for {
+		err := s.open()
+		if err == nil {
+			return s, nil
+		}
+		if !s.retry(err) {
+			return nil, err
+		}
+	}
+}
+
+// streamClient returns an HTTP client that gives up on a server that doesn't
+// accept the connection or send the response headers within timeout.
+func streamClient(timeout time.Duration) *http.Client {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.DialContext = (&net.Dialer{Timeout: timeout, KeepAlive: 30 * time.Second}).DialContext
+	t.ResponseHeaderTimeout = timeout
+	return &http.Client{Transport: t}
+}
+
+// downloadTimeout returns the time allowed for each download attempt of the
+// image.
+func (i Image) downloadTimeout() time.Duration {
+	if i.DownloadTimeout > 0 {
+		return time.Duration(i.DownloadTimeout) * time.Second
+	}
+	return downloadTimeout()
+}
+
+// downloadTimeout returns the time allowed for each download attempt, as
+// propagated by the CLI through IMAGE_SHEPHERD_DOWNLOAD_TIMEOUT_SECS.
+func downloadTimeout() time.Duration {
+	timeoutSecs := 300
+	if v := os.Getenv("IMAGE_SHEPHERD_DOWNLOAD_TIMEOUT_SECS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			timeoutSecs = n
+		}
+	}
+	return time.Duration(timeoutSecs) * time.Second
+}
+
+// retry reports whether another attempt should be made after err, sleeping
+// before it if so.
+func (s *sourceStream) retry(err error) bool {
+	s.attempt++
+	if s.attempt >= streamAttempts || (s.offset > 0 && !(s.canResume && s.validator != "")) {
+		return false
+	}
+	zap.S().Warnw("Download attempt failed, will retry", "url", s.url, "attempt", s.attempt, "bytes_read", s.offset, "error", err, "backoff", s.backoff.String())
+	time.Sleep(s.backoff)
+	s.backoff *= 2
+	return true
+}
+
+// open makes a request for the rest of the stream.
+func (s *sourceStream) open() error {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, err := http.NewRequestWithContext(ctx, "GET", s.url, nil)
+	if err != nil {
+		cancel()
+		return err
+	}
+	resuming := s.offset > 0
+	if resuming {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", s.offset))
+		req.Header.Set("If-Range", s.validator)
+		zap.S().Infow("Resuming download", "url", s.url, "offset", s.offset)
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		cancel()
+		return err
+	}
+	switch {
+	case resuming && resp.StatusCode == http.StatusPartialContent:
+		var start int64
+		if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-", &start); err != nil || start != s.offset {
+			resp.Body.Close()
+			cancel()
+			return fmt.Errorf("download resumed at unexpected range %q", resp.Header.Get("Content-Range"))
+		}
+	case resp.StatusCode < 200 || resp.StatusCode > 299:
+		resp.Body.Close()
+		cancel()
+		return fmt.Errorf("download failed: %s", resp.Status)
+	case resuming:
+		resp.Body.Close()
+		cancel()
+		return ErrSourceChanged
+	default:
+		s.filename = responseFilename(resp)
+		s.etag = resp.Header.Get("ETag")
+		s.lastModified = resp.Header.Get("Last-Modified")
+		// Resume against the content being read, which may be newer than the
+		// metadata the download was started with
+		if v := resumeValidator(SourceMeta{ETag: s.etag, LastModified: s.lastModified}); v != "" {
+			s.validator = v
+		}
+		if !s.canResume {
+			s.canResume = strings.EqualFold(resp.Header.Get("Accept-Ranges"), "bytes")
+		}
+	}
+	s.body = resp.Body
+	s.cancel = cancel
+	s.idle = time.AfterFunc(s.timeout, cancel)
+	s.idle.Stop()
+	return nil
+}
+
+// ErrSourceChanged is returned when a stream can't be resumed because the
+// source changed since it was started. The download must start over from
+// zero.
+var ErrSourceChanged = errors.New("source changed during download")
+
+func (s *sourceStream) Read(p []byte) (int, error) {
+	for {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.body == nil {
+			if err := s.open(); err != nil {
+				if errors.Is(err, ErrSourceChanged) || !s.retry(err) {
+					s.err = err
+				}
+				continue
+			}
+		}
+
+		n, err := s.readBody(p)
+		s.offset += int64(n)
+		if n > 0 && s.attempt > 0 {
+			// The resumed request made progress, so it gets a fresh set of
+			// attempts
+			s.attempt, s.backoff = 0, streamBackoff
+		}
+		if err == nil || err == io.EOF {
+			return n, err
+		}
+
+		// The connection broke; resume with the next request
+		_ = s.Close()
+		if !s.retry(err) {
+			s.err = err
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// readBody reads from the current response, aborting the request if the server
+// sends nothing for timeout. Only the time spent waiting for the server
+// counts, not the time between reads.
+func (s *sourceStream) readBody(p []byte) (int, error) {
+	s.idle.Reset(s.timeout)
+	n, err := s.body.Read(p)
+	if !s.idle.Stop() && err != nil && err != io.EOF {
+		err = fmt.Errorf("no data received for %s: %w", s.timeout, err)
+	}
+	return n, err
+}
+
+// Close releases the connection.
+func (s *sourceStream) Close() error {
+	if s.body == nil {
+		return nil
+	}
+	s.idle.Stop()
+	err := s.body.Close()
+	s.cancel()
+	s.body = nil
+	return err
+}
+
+// pipeline is an image download that is hashed and decompressed as it is
+// read.
+type pipeline struct {
+	src *source
+	dc  *decompressor
+
+	// expected is the expected digest of the download, if it is verified
+	expected string
+	sum256   hash.Hash
+	sum      hash.Hash
+	size     byteCounter
+	started  time.Time
+}
+
+// byteCounter counts the bytes written to it.
+type byteCounter int64
+
+func (c *byteCounter) Write(p []byte) (int, error) {
+	*c += byteCounter(len(p))
+	return len(p), nil
+}
+
+// openPipeline resolves the expected checksum of the image and starts
+// downloading it. The expected checksum is resolved first so a missing
+// checksum file fails before anything is downloaded.
+func (i Image) openPipeline(meta SourceMeta) (_ *pipeline, err error) {
+	p := &pipeline{sum256: sha256.New(), started: time.Now()}
+	hashes := io.MultiWriter(p.sum256, &p.size)
+	if i.Checksum != nil {
+		if p.expected, err = i.Checksum.Expected(i.Url); err != nil {
+			zap.S().Errorw("Failed to resolve expected checksum", "url", i.Url, "image", i.Name, "error", err)
+			return nil, err
+		}
+		zap.S().Infow("Resolved expected checksum", "image", i.Name, "algorithm", i.Checksum.algorithm(), "digest", p.expected)
+		if p.expected != "" {
+			if p.sum, err = newHash(i.Checksum.algorithm()); err != nil {
+				return nil, err
+			}
+			hashes = io.MultiWriter(p.sum256, &p.size, p.sum)
+		}
+	}
+
+	zap.S().Infow("Starting download", "url", i.Url, "image", i.Name, "source_format", i.SourceFormat, "compression", i.Compression)
+	if p.src, err = openSource(i.Url, meta, i.downloadTimeout()); err != nil {
+		zap.S().Errorw("Download failed", "url", i.Url, "image", i.Name, "error", err)
+		return nil, err
+	}
+	if p.dc, err = newDecompressor(io.TeeReader(p.src, hashes), i.Compression, p.src.name); err != nil {
+		zap.S().Errorw("Download failed", "url", i.Url, "image", i.Name, "error", err)
+		p.Close()
+		return nil, err
+	}
+	return p, nil
+}
+
+// finish reads whatever is left of the download, such as archive padding or
+// a cached file that was used as is, so the digests cover all of it, and
+// verifies it against the expected checksum. What was downloaded is recorded
+// in stats.
+func (p *pipeline) finish(i Image, stats *BuildStats) error {
+	if _, err := io.Copy(io.Discard, p.dc.raw); err != nil {
+		zap.S().Errorw("Download failed", "url", i.Url, "image", i.Name, "error", err)
+		return err
+	}
+	stats.Download = time.Since(p.started)
+	stats.Decompress = p.dc.elapsed()
+	stats.DownloadedBytes = int64(p.size)
+	stats.DownloadSHA256 = hex.EncodeToString(p.sum256.Sum(nil))
+	zap.S().Infow("Download completed", "file", p.src.name, "image", i.Name, "bytes", stats.DownloadedBytes, "duration", stats.Download.String(), "decompress_duration", stats.Decompress.String())
+	zap.S().Infow("SHA256 (downloaded file)", "file", p.src.name, "sha256", stats.DownloadSHA256)
+
+	if p.expected != "" {
+		if err := i.Checksum.verifyDigest(p.src.name, hex.EncodeToString(p.sum.Sum(nil)), p.expected); err != nil {
+			zap.S().Errorw("Checksum verification failed", "file", p.src.name, "image", i.Name, "error", err)
+			p.discard()
+			return err
+		}
+		stats.ChecksumAlgorithm = i.Checksum.algorithm()
+		stats.Checksum = strings.ToLower(p.expected)
+	}
+	return nil
+}
+
+// changed reports whether the download failed because the source changed while
+// it was being resumed.
+func (p *pipeline) changed() bool {
+	s, ok := p.src.ReadCloser.(*sourceStream)
+	return ok && errors.Is(s.err, ErrSourceChanged)
+}
+
+// sourceMeta returns meta with the validators of the content that was
+// actually downloaded, which differ from meta if the source changed since
+// meta was fetched.
+func (p *pipeline) sourceMeta(meta SourceMeta) SourceMeta {
+	s, ok := p.src.ReadCloser.(*sourceStream)
+	if !ok || (s.etag == "" && s.lastModified == "") {
+		return meta
+	}
+	if s.etag != meta.ETag || s.lastModified != meta.LastModified {
+		meta.ETag, meta.LastModified, meta.ContentLength = s.etag, s.lastModified, 0
+	}
+	return meta
+}
+
+// discard removes a cached copy that failed verification from the cache, so
+// it isn't reused on the next run.
+func (p *pipeline) discard() {
+	if p.src.discard != nil {
+		p.src.discard()
+	}
+}
+
+// Close stops the download and releases the cached copy, if any.
+func (p *pipeline) Close() {
+	if p.dc != nil {
+		_ = p.dc.Close()
+	}
+	_ = p.src.Close()
+	if p.src.release != nil {
+		p.src.release()
+	}
+}
+
+// streamHead is how much of the decompressed image is read ahead to detect
+// its format before it is streamed, enough to find the ISO 9660 magic.
+const streamHead = isoMagicOffset + 5
+
+// streamFormat returns the format of an image that can be uploaded as it is
+// downloaded, which requires that it has no checksum, that it isn't in an
+// archive, that its format is known without looking at the whole file, and
+// that it isn't converted. ok is false if any of that isn't the case.
+func (i Image) streamFormat(p *pipeline) (format string, ok bool) {
+	// A checksum is only verified once the whole image has been read, which
+	// would be after an unverified image was already active in Glance
+	if i.Checksum != nil {
+		return "", false
+	}
+	switch p.dc.compression {
+	case compressionNone, compressionXZ, compressionGzip, compressionZstd, compressionBz2:
+	default:
+		return "", false
+	}
+	br, isBuffered := p.dc.r.(*bufio.Reader)
+	if !isBuffered {
+		return "", false
+	}
+	head, err := br.Peek(streamHead)
+	if err != nil && err != io.EOF {
+		return "", false
+	}
+	if format = i.resolveFormat(sniffHead(head), p.src.name); format == "" {
+		return "", false
+	}
+	if _, convert := i.outputFormat(format); convert {
+		return "", false
+	}
+	return format, true
+}
@@ -0,0 +1,246 @@
+package image
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// flakyServer serves content with http.ServeContent, which answers Range and
+// If-Range requests, but breaks off its first response halfway through.
+type flakyServer struct {
+	content []byte
+	etag    string
+	// stall makes the first response hang instead of closing the connection
+	stall bool
+	// changed is the content served, with a new ETag, once the first response
+	// broke off
+	changed []byte
+
+	mu       sync.Mutex
+	requests []http.Header
+}
+
+func (s *flakyServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.requests = append(s.requests, r.Header.Clone())
+	first := len(s.requests) == 1
+	content, etag := s.content, s.etag
+	s.mu.Unlock()
+
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if !first {
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+		return
+	}
+
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+	_, _ = w.Write(content[:len(content)/2])
+	w.(http.Flusher).Flush()
+
+	if s.changed != nil {
+		s.mu.Lock()
+		s.content, s.etag = s.changed, `"v2"`
+		s.mu.Unlock()
+	}
+	if s.stall {
+		<-r.Context().Done()
+	}
+	panic(http.ErrAbortHandler)
+}
+
+func TestSourceStream(t *testing.T) {
+	content := bytes.Repeat([]byte("0123456789abcdef"), 64<<10)
+	tests := []struct {
+		name    string
+		server  *flakyServer
+		want    []byte
+		wantErr error
+		// fail is whether the stream ends with an error other than wantErr
+		fail bool
+		// wantRange is the Range header of the second request, if it is resumed
+		wantRange string
+	}{
+		{
+			name:      "resumed after the connection broke",
+			server:    &flakyServer{content: content, etag: `"v1"`},
+			want:      content,
+			wantRange: "bytes=524288-",
+		},
+		{
+			name:      "resumed after the server stopped sending",
+			server:    &flakyServer{content: content, etag: `"v1"`, stall: true},
+			want:      content,
+			wantRange: "bytes=524288-",
+		},
+		{
+			name:      "source changed",
+			server:    &flakyServer{content: content, etag: `"v1"`, changed: bytes.ToUpper(content)},
+			want:      content[:len(content)/2],
+			wantErr:   ErrSourceChanged,
+			wantRange: "bytes=524288-",
+		},
+		{
+			name:   "no validator to resume with",
+			server: &flakyServer{content: content},
+			want:   content[:len(content)/2],
+			fail:   true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(tt.server)
+			defer srv.Close()
+
+			s, err := openStream(srv.URL+"/debian-13.raw", SourceMeta{}, 500*time.Millisecond)
+			if err != nil {
+				t.Fatalf("openStream() error = %v", err)
+			}
+			defer s.Close()
+			s.backoff = time.Millisecond
+
+			got, err := io.ReadAll(s)
+			switch {
+			case tt.wantErr != nil:
+				if !errors.Is(err, tt.wantErr) {
+					t.Errorf("read error = %v, want %v", err, tt.wantErr)
+				}
+			case (err != nil) != tt.fail:
+				t.Errorf("read error = %v, want error %v", err, tt.fail)
+			}
+			if !bytes.Equal(got, tt.want) {
+				t.Errorf("read %d bytes, want %d", len(got), len(tt.want))
+			}
+			if s.filename != "debian-13.raw" {
+				t.Errorf("filename = %q, want %q", s.filename, "debian-13.raw")
+			}
+
+			if tt.wantRange == "" {
+				if len(tt.server.requests) != 1 {
+					t.Errorf("made %d requests, want 1", len(tt.server.requests))
+				}
+				return
+			}
+			if len(tt.server.requests) != 2 {
+				t.Fatalf("made %d requests, want 2", len(tt.server.requests))
+			}
+			resumed := tt.server.requests[1]
+			if r := resumed.Get("Range"); r != tt.wantRange {
+				t.Errorf("Range = %q, want %q", r, tt.wantRange)
+			}
+			if ir := resumed.Get("If-Range"); ir != `"v1"` {
+				t.Errorf("If-Range = %q, want %q", ir, `"v1"`)
+			}
+		})
+	}
+}
+
+func TestPublishStream(t *testing.T) {
+	qcow2 := diskImage(64<<10, 0, "QFI\xfb\x00\x00\x00\x03")
+	corrupt := compressGzip(t, qcow2)
+	// Break the CRC-32 in the gzip trailer, which is only checked at the end
+	corrupt[len(corrupt)-8] ^= 0xff
+
+	tests := []struct {
+		name         string
+		image        Image
+		body         []byte
+		uploadStatus int
+		wantStreamed bool
+		wantError    string
+	}{
+		{
+			name:         "streamed",
+			image:        Image{Url: "/disk.qcow2.gz", TargetFormat: "qcow2"},
+			body:         compressGzip(t, qcow2),
+			wantStreamed: true,
+		},
+		{
+			name:         "upload rejected",
+			image:        Image{Url: "/disk.qcow2.gz", TargetFormat: "qcow2"},
+			body:         compressGzip(t, qcow2),
+			uploadStatus: http.StatusRequestEntityTooLarge,
+			wantStreamed: true,
+			wantError:    "413",
+		},
+		{
+			name:         "corrupt download",
+			image:        Image{Url: "/disk.qcow2.gz", TargetFormat: "qcow2"},
+			body:         corrupt,
+			wantStreamed: true,
+			wantError:    "gzip: invalid checksum",
+		},
+		// A checksum has to be verified before the image is created
+		{
+			name:  "checksum",
+			image: Image{Url: "/disk.qcow2.gz", TargetFormat: "qcow2", Checksum: &Checksum{Value: sha256Hex(compressGzip(t, qcow2))}},
+			body:  compressGzip(t, qcow2),
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			src := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write(tt.body)
+			}))
+			defer src.Close()
+			g := &glance{uploadStatus: tt.uploadStatus}
+			c := serveGlance(t, g)
+
+			i := tt.image
+			i.Name = "appliance"
+			i.Url = src.URL + i.Url
+			i.Init()
+			a, err := i.BuildStream(SourceMeta{}, t.TempDir())
+			if err != nil {
+				t.Fatalf("BuildStream() error = %v", err)
+			}
+			defer a.Close()
+			if a.Streamed() != tt.wantStreamed {
+				t.Fatalf("Streamed() = %v, want %v", a.Streamed(), tt.wantStreamed)
+			}
+
+			id, err := i.Publish(c, a, UploadMethodUpload)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("Publish() error = %v, want %q", err, tt.wantError)
+				}
+				// A partial image must not be taken for the current version
+				if last := g.requests[len(g.requests)-1]; last != "DELETE /v2/images/"+glanceID {
+					t.Errorf("last request = %s, want the image to be deleted", last)
+				}
+				return
+			}
+			if err != nil || id != glanceID {
+				t.Fatalf("Publish() = %s, %v, want %s", id, err, glanceID)
+			}
+			if !bytes.Equal(g.data, qcow2) {
+				t.Errorf("uploaded %d bytes, want the %d bytes of the image", len(g.data), len(qcow2))
+			}
+			if a.DiskFormat != "qcow2" || a.Stats.ImageSHA256 != sha256Hex(qcow2) {
+				t.Errorf("disk format, image sha256 = %s, %s, want qcow2, %s", a.DiskFormat, a.Stats.ImageSHA256, sha256Hex(qcow2))
+			}
+			if tt.wantStreamed {
+				if _, err := i.Publish(c, a, UploadMethodUpload); err == nil {
+					t.Errorf("second Publish() of a streamed image succeeded")
+				}
+			}
+		})
+	}
+}
+
+func sha256Hex(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,262 @@
+// Package notify sends the outcome of a run to chat rooms and webhooks.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/HackUCF/image-shepherd/pkg/shepherd"
+)
+
+// Values of type.
+const (
+	// TypeWebhook posts the message and the run report as JSON.
+	TypeWebhook = "webhook"
+	// TypeSlack posts the message to a Slack-compatible incoming webhook.
+	TypeSlack = "slack"
+	// TypeMatrix sends the message to a Matrix room.
+	TypeMatrix = "matrix"
+)
+
+// Values of on.
+const (
+	// OnChange notifies when a new version of any image was uploaded.
+	OnChange = "change"
+	// OnFailure notifies when any image failed, or the run itself did.
+	OnFailure = "failure"
+	// OnAlways notifies after every run.
+	OnAlways = "always"
+)
+
+// DefaultTemplate is the message sent unless a notification has its own
+// template.
+const DefaultTemplate = `image-shepherd run {{.Status}}: {{.Summary.Uploaded}} uploaded, {{.Summary.Unchanged}} unchanged, {{.Summary.Failed}} failed
+{{- range .Uploaded}}
+- {{.Name}} on {{.Target}}: uploaded {{.NewID}}{{with .SourceVersion}} (version {{.}}){{end}}
+{{- end}}
+{{- range .Failed}}
+- {{.Name}} on {{.Target}}: failed: {{.Error}}
+{{- end}}`
+
+// Notification is where and when to send the outcome of a run. URL, Token
+// and header values may reference environment variables as ${NAME}, which
+// keeps secrets out of the configuration file.
+type Notification struct {
+	// Type is webhook (the default), slack or matrix.
+	Type string `yaml:"type,omitempty"`
+	// URL is the webhook URL, or the homeserver URL for Matrix.
+	URL string `yaml:"url"`
+	// Room and Token are the room ID and access token for Matrix.
+	Room  string `yaml:"room,omitempty"`
+	Token string `yaml:"token,omitempty"`
+	// Headers are added to webhook requests.
+	Headers map[string]string `yaml:"headers,omitempty"`
+	// On lists the events to notify on: change, failure or always. The
+	// default is change and failure.
+	On []string `yaml:"on,omitempty"`
+	// Template is a Go text/template for the message, executed with a
+	// Message. DefaultTemplate is used if it is empty.
+	Template string `yaml:"template,omitempty"`
+}
+
+// Message is what a template is executed with.
+type Message struct {
+	shepherd.Report
+	Status shepherd.Status
+	// Uploaded and Failed are the images of the report that were uploaded or
+	// failed.
+	Uploaded []shepherd.ImageReport
+	Failed   []shepherd.ImageReport
+}
+
+// kind returns the normalized type of the notification.
+func (n Notification) kind() string {
+	if t := strings.ToLower(strings.TrimSpace(n.Type)); t != "" {
+		return t
+	}
+	return TypeWebhook
+}
+
+// events returns the normalized events to notify on.
+func (n Notification) events() []string {
+	if len(n.On) == 0 {
+		return []string{OnChange, OnFailure}
+	}
+	events := make([]string, len(n.On))
+	for idx, e := range n.On {
+		events[idx] = strings.ToLower(strings.TrimSpace(e))
+	}
+	return events
+}
+
+// template parses the message template of the notification.
+func (n Notification) template() (*template.Template, error) {
+	text := n.Template
+	if strings.TrimSpace(text) == "" {
+		text = DefaultTemplate
+	}
+	return template.New("message").Option("missingkey=error").Parse(text)
+}
+
+// Validate checks the notification for errors that would otherwise only show
+// when it is sent.
+func (n Notification) Validate() error {
+	switch n.kind() {
+	case TypeWebhook, TypeSlack:
+	case TypeMatrix:
+		if n.Room == "" || n.Token == "" {
+			return fmt.Errorf("matrix notifications need a room and a token")
+		}
+	default:
+		return fmt.Errorf("invalid type %q (expected %s, %s or %s)", n.Type, TypeWebhook, TypeSlack, TypeMatrix)
+	}
+	if n.URL == "" {
+		return fmt.Errorf("missing url")
+	}
+	for _, e := range n.events() {
+		switch e {
+		case OnChange, OnFailure, OnAlways:
+		default:
+			return fmt.Errorf("invalid on %q (expected %s, %s or %s)", e, OnChange, OnFailure, OnAlways)
+		}
+	}
+	if _, err := n.template(); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	return nil
+}
+
+// wants reports whether the notification is sent for a run.
+func (n Notification) wants(msg Message) bool {
+	events := n.events()
+	return slices.Contains(events, OnAlways) ||
+		(slices.Contains(events, OnChange) && len(msg.Uploaded) > 0) ||
+		(slices.Contains(events, OnFailure) && msg.Status != shepherd.StatusSuccess)
+}
+
+// NewMessage builds the message for a run from its report and status.
+func NewMessage(rep shepherd.Report, status shepherd.Status) Message {
+	msg := Message{Report: rep, Status: status}
+	for _, ir := range rep.Images {
+		switch ir.Outcome {
+		case shepherd.OutcomeUploaded:
+			msg.Uploaded = append(msg.Uploaded, ir)
+		case shepherd.OutcomeFailed:
+			msg.Failed = append(msg.Failed, ir)
+		}
+	}
+	return msg
+}
+
+// Send sends every notification that wants the run. Failures are logged, but
+// never fail the run.
+func Send(notifications []Notification, msg Message) {
+	for _, n := range notifications {
+		if !n.wants(msg) {
+			continue
+		}
+		if err := n.send(msg); err != nil {
+			zap.S().Errorw("Failed to send notification", "type", n.kind(), "host", host(n.URL), "error", err)
+			continue
+		}
+		zap.S().Infow("Sent notification", "type", n.kind(), "host", host(n.URL), "status", msg.Status)
+	}
+}
+
+// send renders the message and delivers it.
+func (n Notification) send(msg Message) error {
+	tmpl, err := n.template()
+	if err != nil {
+		return err
+	}
+	var text bytes.Buffer
+	if err := tmpl.Execute(&text, msg); err != nil {
+		return fmt.Errorf("failed to render template: %w", err)
+	}
+
+	endpoint := os.ExpandEnv(n.URL)
+	headers := map[string]string{}
+	var payload any
+	switch n.kind() {
+	case TypeSlack:
+		payload = map[string]string{"text": text.String()}
+	case TypeMatrix:
+		// Matrix deduplicates messages by transaction ID, which must be unique
+		// per access token
+		txn := fmt.Sprintf("image-shepherd-%d", time.Now().UnixNano())
+		endpoint = fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s",
+			strings.TrimRight(endpoint, "/"), url.PathEscape(os.ExpandEnv(n.Room)), txn)
+		headers["Authorization"] = "Bearer " + os.ExpandEnv(n.Token)
+		payload = map[string]string{"msgtype": "m.text", "body": text.String()}
+	default:
+		for k, v := range n.Headers {
+			headers[k] = os.ExpandEnv(v)
+		}
+		payload = struct {
+			Text   string          `json:"text"`
+			Status shepherd.Status `json:"status"`
+			shepherd.Report
+		}{text.String(), msg.Status, msg.Report}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	method := http.MethodPost
+	if n.kind() == TypeMatrix {
+		method = http.MethodPut
+	}
+	return deliver(method, endpoint, headers, body)
+}
+
+// deliver sends a JSON request and checks that it succeeded.
+func deliver(method string, endpoint string, headers map[string]string, body []byte) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	client := &http.Client{Timeout: 30 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error would include the whole URL
+		var ue *url.Error
+		if errors.As(err, &ue) {
+			err = ue.Err
+		}
+		return fmt.Errorf("%s %s failed: %w", method, host(endpoint), err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("%s %s failed: %s", method, host(endpoint), resp.Status)
+	}
+	return nil
+}
+
+// host returns the host of a URL for logging, since the rest of a webhook URL
+// is often a secret.
+func host(raw string) string {
+	if u, err := url.Parse(os.ExpandEnv(raw)); err == nil && u.Host != "" {
+		return u.Host
+	}
+	return "?"
+}
@@ -0,0 +1,236 @@
+package notify
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/HackUCF/image-shepherd/pkg/shepherd"
+)
+
+// message returns the message of a run with the given image outcomes.
+func message(status shepherd.Status, images ...shepherd.ImageReport) Message {
+	rep := shepherd.Report{Images: images}
+	for _, ir := range images {
+		switch ir.Outcome {
+		case shepherd.OutcomeUploaded:
+			rep.Summary.Uploaded++
+		case shepherd.OutcomeUnchanged:
+			rep.Summary.Unchanged++
+		case shepherd.OutcomeFailed:
+			rep.Summary.Failed++
+		}
+	}
+	return NewMessage(rep, status)
+}
+
+var (
+	uploaded = shepherd.ImageReport{
+		Name: "debian-13", Target: "prod/RegionOne", Outcome: shepherd.OutcomeUploaded,
+		NewID: "6f1c", SourceVersion: "20261012-1",
+	}
+	unchanged = shepherd.ImageReport{Name: "fedora-42", Target: "prod/RegionOne", Outcome: shepherd.OutcomeUnchanged}
+	failed    = shepherd.ImageReport{
+		Name: "alpine-3.22", Target: "prod/RegionOne", Outcome: shepherd.OutcomeFailed,
+		Error: "download failed: 404 Not Found",
+	}
+)
+
+func TestWants(t *testing.T) {
+	changed := message(shepherd.StatusSuccess, uploaded, unchanged)
+	quiet := message(shepherd.StatusSuccess, unchanged)
+	broken := message(shepherd.StatusFailure, failed)
+	partial := message(shepherd.StatusPartialFailure, uploaded, failed)
+
+	tests := []struct {
+		on   []string
+		msg  Message
+		want bool
+	}{
+		{nil, changed, true},
+		{nil, quiet, false},
+		{nil, broken, true},
+		{[]string{"change"}, changed, true},
+		{[]string{"change"}, quiet, false},
+		{[]string{"change"}, broken, false},
+		{[]string{"change"}, partial, true},
+		{[]string{"failure"}, changed, false},
+		{[]string{"failure"}, broken, true},
+		{[]string{" Failure "}, partial, true},
+		{[]string{"always"}, quiet, true},
+		{[]string{"ALWAYS"}, broken, true},
+	}
+	for _, tt := range tests {
+		n := Notification{On: tt.on}
+		if got := n.wants(tt.msg); got != tt.want {
+			t.Errorf("wants() on %v for a %s run with %d uploaded = %v, want %v", tt.on, tt.msg.Status, len(tt.msg.Uploaded), got, tt.want)
+		}
+	}
+}
+
+func TestTemplate(t *testing.T) {
+	msg := message(shepherd.StatusPartialFailure, uploaded, unchanged, failed)
+	tests := []struct {
+		name      string
+		template  string
+		want      string
+		wantError string
+	}{
+		{
+			name: "default",
+			want: `image-shepherd run partial-failure: 1 uploaded, 1 unchanged, 1 failed
+- debian-13 on prod/RegionOne: uploaded 6f1c (version 20261012-1)
+- alpine-3.22 on prod/RegionOne: failed: download failed: 404 Not Found`,
+		},
+		{
+			name:     "custom",
+			template: `{{.Status}}{{range .Failed}} {{.Name}}{{end}}`,
+			want:     "partial-failure alpine-3.22",
+		},
+		{
+			name:      "unknown field",
+			template:  `{{.Images.Name}}`,
+			wantError: "failed to render template",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got string
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var body struct{ Text string }
+				_ = json.NewDecoder(r.Body).Decode(&body)
+				got = body.Text
+			}))
+			defer srv.Close()
+
+			err := Notification{Type: TypeSlack, URL: srv.URL, Template: tt.template}.send(msg)
+			if tt.wantError != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantError) {
+					t.Fatalf("send() error = %v, want %q", err, tt.wantError)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("send() error = %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("sent %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// request is a request received by the test server.
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   map[string]any
+}
+
+func TestSend(t *testing.T) {
+	t.Setenv("TEST_WEBHOOK_SECRET", "s3cret")
+	t.Setenv("TEST_MATRIX_TOKEN", "syt_token")
+	msg := message(shepherd.StatusSuccess, uploaded)
+
+	tests := []struct {
+		name       string
+		n          Notification
+		wantMethod string
+		wantPath   string
+		wantHeader map[string]string
+		wantBody   map[string]any
+	}{
+		{
+			name:       "webhook",
+			n:          Notification{URL: "/hooks/images", Headers: map[string]string{"X-Secret": "${TEST_WEBHOOK_SECRET}"}},
+			wantMethod: http.MethodPost,
+			wantPath:   "/hooks/images",
+			wantHeader: map[string]string{"X-Secret": "s3cret", "Content-Type": "application/json"},
+			wantBody:   map[string]any{"status": "success", "summary": map[string]any{"uploaded": 1.0, "unchanged": 0.0, "failed": 0.0, "aborted": 0.0, "pruned": 0.0}},
+		},
+		{
+			name:       "slack",
+			n:          Notification{Type: "Slack", URL: "/services/T000/B000/XXXX"},
+			wantMethod: http.MethodPost,
+			wantPath:   "/services/T000/B000/XXXX",
+			wantBody:   map[string]any{"text": nil},
+		},
+		{
+			name:       "matrix",
+			n:          Notification{Type: TypeMatrix, URL: "/", Room: "!ops:example.org", Token: "${TEST_MATRIX_TOKEN}"},
+			wantMethod: http.MethodPut,
+			wantPath:   "/_matrix/client/v3/rooms/%21ops:example.org/send/m.room.message/image-shepherd-",
+			wantHeader: map[string]string{"Authorization": "Bearer syt_token"},
+			wantBody:   map[string]any{"msgtype": "m.text", "body": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []request
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				req := request{method: r.Method, path: r.URL.EscapedPath(), header: r.Header}
+				data, _ := io.ReadAll(r.Body)
+				if err := json.Unmarshal(data, &req.body); err != nil {
+					t.Errorf("request body %s: %v", data, err)
+				}
+				got = append(got, req)
+			}))
+			defer srv.Close()
+
+			n := tt.n
+			n.URL = strings.TrimSuffix(srv.URL+n.URL, "/")
+			Send([]Notification{n}, msg)
+			if len(got) != 1 {
+				t.Fatalf("sent %d requests, want 1", len(got))
+			}
+			req := got[0]
+			if req.method != tt.wantMethod || !strings.HasPrefix(req.path, tt.wantPath) {
+				t.Errorf("request = %s %s, want %s %s", req.method, req.path, tt.wantMethod, tt.wantPath)
+			}
+			for k, want := range tt.wantHeader {
+				if v := req.header.Get(k); v != want {
+					t.Errorf("header %s = %q, want %q", k, v, want)
+				}
+			}
+			// A nil value only has to be present, as the message itself is
+			// covered by TestTemplate
+			for k, want := range tt.wantBody {
+				v, ok := req.body[k]
+				switch {
+				case !ok:
+					t.Errorf("body has no %s: %v", k, req.body)
+				case want != nil && !jsonEqual(v, want):
+					t.Errorf("body %s = %v, want %v", k, v, want)
+				}
+			}
+			if text, _ := req.body["text"].(string); tt.n.Type != TypeMatrix && !strings.Contains(text, "debian-13") {
+				t.Errorf("body text = %q, want the message", text)
+			}
+		})
+	}
+}
+
+func TestSendFailures(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "invalid_token", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	err := Notification{URL: srv.URL + "/hooks/secret-path"}.send(message(shepherd.StatusFailure, failed))
+	if err == nil || !strings.Contains(err.Error(), "403 Forbidden") {
+		t.Fatalf("send() error = %v, want 403 Forbidden", err)
+	}
+	if strings.Contains(err.Error(), "secret-path") {
+		t.Errorf("send() error %q includes the webhook path", err)
+	}
+}
+
+func jsonEqual(a, b any) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
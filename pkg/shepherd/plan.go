@@ -0,0 +1,178 @@
+package shepherd
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"go.uber.org/zap"
+)
+
+// Action is what a run would do with a configured image.
+type Action string
+
+const (
+	// ActionUploadNew uploads an image that has no current version in Glance.
+	ActionUploadNew Action = "upload-new"
+	// ActionReplace uploads a new version and renames/hides the current one.
+	ActionReplace Action = "replace"
+	// ActionSkipUnchanged leaves the current image alone because the source
+	// has not changed since it was uploaded.
+	ActionSkipUnchanged Action = "skip-unchanged"
+	// ActionError means the decision could not be made reliably.
+	ActionError Action = "error"
+	// ActionAborted means the image was never processed because the run
+	// stopped at an earlier failure.
+	ActionAborted Action = "aborted"
+)
+
+// Decision describes what a run does (or would do) with a configured image,
+// and why.
+type Decision struct {
+	Name string
+	// ConfigFile is the configuration file the image was loaded from.
+	ConfigFile string
+	// Target is the cloud and region the decision applies to.
+	Target image.Target
+	Action Action
+	Reason string
+	// URL is the resolved source URL and Version the resolved source version,
+	// if the source type has versions.
+	URL     string
+	Version string
+	// CurrentID and CurrentName identify the matched current image, if any,
+	// and CurrentCreatedAt is when it was uploaded.
+	CurrentID        string
+	CurrentName      string
+	CurrentCreatedAt time.Time
+	// Meta is the upstream metadata the decision was based on.
+	Meta image.SourceMeta
+	// MetaErr is set when the upstream metadata could not be fetched.
+	MetaErr error
+}
+
+// prepare initializes a configured image and resolves its source URL.
+func prepare(imgCfg *image.Image) error {
+	imgCfg.Init()
+	return imgCfg.Resolve()
+}
+
+// unresolved is the decision for an image whose source could not be resolved.
+func unresolved(imgCfg image.Image, err error) Decision {
+	return Decision{
+		Name:       imgCfg.Name,
+		ConfigFile: imgCfg.ConfigFile,
+		Action:     ActionError,
+		Reason:     fmt.Sprintf("could not resolve source: %s", err),
+	}
+}
+
+// decide runs the matching and freshness checks for a single configured image
+// on one target, given the upstream metadata of its source. imgCfg must already
+// have been prepared.
+func decide(t *target, imgCfg image.Image, cons constraints, meta image.SourceMeta, metaErr error) Decision {
+	d := Decision{
+		Name:       imgCfg.Name,
+		ConfigFile: imgCfg.ConfigFile,
+		Target:     t.name,
+		URL:        imgCfg.Url,
+		Version:    imgCfg.Properties["source_version"],
+		Meta:       meta,
+		MetaErr:    metaErr,
+	}
+	if t.listErr != nil {
+		d.Action = ActionError
+		d.Reason = fmt.Sprintf("could not list existing images on %s: %s", t.name, t.listErr)
+		return d
+	}
+
+	current := findCurrent(t.existing, imgCfg, cons)
+	if current == nil {
+		zap.S().Infow("No current image found; will upload", "name", imgCfg.Name)
+		d.Action = ActionUploadNew
+		if matchesByProperties(imgCfg) {
+			d.Reason = "no current image matches os_distro/os_version/os_type"
+		} else {
+			d.Reason = "no current image matches name"
+		}
+		return d
+	}
+
+	zap.S().Infow("Found current image candidate", "id", current.ID, "name", current.Name)
+	d.CurrentID = current.ID
+	d.CurrentName = current.Name
+	d.CurrentCreatedAt = current.CreatedAt
+
+	// Versioned sources (discover, coreos-stream, simplestreams) are compared
+	// by version, which is more reliable than the mirror's HTTP validators
+	if d.Version != "" {
+		if cv, _ := current.Properties["source_version"].(string); cv != "" {
+			if cv == d.Version {
+				d.Action = ActionSkipUnchanged
+				d.Reason = fmt.Sprintf("source version matches current image %s", current.ID)
+			} else {
+				d.Action = ActionReplace
+				d.Reason = fmt.Sprintf("source version %s replaces %s of current image %s", d.Version, cv, current.ID)
+			}
+			return d
+		}
+	}
+
+	// Decide if the source is newer than what we already have
+	if reason := unchangedReason(current, meta); reason != "" {
+		d.Action = ActionSkipUnchanged
+		d.Reason = fmt.Sprintf("source %s matches current image %s", reason, current.ID)
+		return d
+	}
+
+	d.Action = ActionReplace
+	switch {
+	case metaErr != nil:
+		d.Reason = fmt.Sprintf("source metadata unavailable; would replace current image %s", current.ID)
+	case meta.ETag == "" && meta.LastModified == "":
+		d.Reason = fmt.Sprintf("source has no ETag or Last-Modified; would replace current image %s", current.ID)
+	default:
+		d.Reason = fmt.Sprintf("source changed since current image %s was uploaded", current.ID)
+	}
+	return d
+}
+
+// Plan runs the candidate selection and freshness checks of Run for every
+// configured image on each of its targets without downloading, uploading or
+// modifying anything. It fails only if no target could be listed.
+func Plan(clients map[image.Target]Clients, imagesCfg []image.Image) ([]Decision, error) {
+	targets, err := connect(clients, imagesCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cons := loadConstraints()
+
+	decisions := make([]Decision, 0, len(imagesCfg))
+	for _, imgCfg := range imagesCfg {
+		zap.S().Infow("Planning image", "name", imgCfg.Name, "targets", len(imgCfg.Targets))
+
+		if err := prepare(&imgCfg); err != nil {
+			for _, t := range targetsOf(targets, imgCfg) {
+				d := unresolved(imgCfg, err)
+				d.Target = t.name
+				decisions = append(decisions, d)
+			}
+			continue
+		}
+
+		// Get upstream metadata to determine if a new image was published
+		meta, metaErr := image.FetchSourceMeta(imgCfg.Url)
+		for _, t := range targetsOf(targets, imgCfg) {
+			d := decide(t, imgCfg, cons, meta, metaErr)
+			if d.MetaErr != nil && d.Action != ActionError {
+				// A run would still attempt the upload, but the source is most likely
+				// unreachable, which is exactly what a reviewer needs to know.
+				d.Action = ActionError
+				d.Reason = fmt.Sprintf("could not fetch source metadata: %s", d.MetaErr)
+			}
+			decisions = append(decisions, d)
+		}
+	}
+	return decisions, nil
+}
@@ -0,0 +1,163 @@
+package shepherd
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+func TestDecide(t *testing.T) {
+	current := images.Image{
+		ID:   "current",
+		Name: "debian-13",
+		Properties: map[string]any{
+			"source_url":           "https://example.com/debian-13.qcow2",
+			"source_etag":          `"abc"`,
+			"source_last_modified": "Mon, 12 Oct 2026 08:00:00 GMT",
+		},
+	}
+	versioned := images.Image{
+		ID:         "current",
+		Name:       "debian-13",
+		Properties: map[string]any{"source_version": "20261012-1", "source_etag": `"abc"`},
+	}
+	byName := image.Image{Name: "debian-13", Url: "https://example.com/debian-13.qcow2"}
+	withVersion := func(version string) image.Image {
+		imgCfg := byName
+		imgCfg.Properties = map[string]string{"source_version": version}
+		return imgCfg
+	}
+	byProperties := image.Image{Name: "Ubuntu 24.04", Properties: map[string]string{
+		"os_distro": "ubuntu", "os_version": "24.04", "os_type": "linux",
+	}}
+
+	tests := []struct {
+		name       string
+		existing   []images.Image
+		listErr    error
+		imgCfg     image.Image
+		meta       image.SourceMeta
+		metaErr    error
+		wantAction Action
+		wantReason string
+	}{
+		{
+			name:       "listing failed",
+			listErr:    errors.New("401 Unauthorized"),
+			imgCfg:     byName,
+			wantAction: ActionError,
+			wantReason: "could not list existing images",
+		},
+		{
+			name:       "no current image by name",
+			existing:   []images.Image{{ID: "other", Name: "debian-12"}},
+			imgCfg:     byName,
+			wantAction: ActionUploadNew,
+			wantReason: "no current image matches name",
+		},
+		{
+			name:       "no current image by properties",
+			existing:   []images.Image{current},
+			imgCfg:     byProperties,
+			wantAction: ActionUploadNew,
+			wantReason: "no current image matches os_distro/os_version/os_type",
+		},
+		{
+			name:       "same etag",
+			existing:   []images.Image{current},
+			imgCfg:     byName,
+			meta:       image.SourceMeta{ETag: `"abc"`, LastModified: "Tue, 13 Oct 2026 08:00:00 GMT"},
+			wantAction: ActionSkipUnchanged,
+			wantReason: "source etag matches",
+		},
+		{
+			name:       "same last-modified",
+			existing:   []images.Image{current},
+			imgCfg:     byName,
+			meta:       image.SourceMeta{LastModified: "Mon, 12 Oct 2026 08:00:00 GMT"},
+			wantAction: ActionSkipUnchanged,
+			wantReason: "source last_modified matches",
+		},
+		{
+			name:       "changed etag and last-modified",
+			existing:   []images.Image{current},
+			imgCfg:     byName,
+			meta:       image.SourceMeta{ETag: `"def"`, LastModified: "Tue, 13 Oct 2026 08:00:00 GMT"},
+			wantAction: ActionReplace,
+			wantReason: "source changed since current image current",
+		},
+		{
+			name:       "no validators",
+			existing:   []images.Image{current},
+			imgCfg:     byName,
+			wantAction: ActionReplace,
+			wantReason: "source has no ETag or Last-Modified",
+		},
+		{
+			name:       "current image without validators",
+			existing:   []images.Image{{ID: "current", Name: "debian-13"}},
+			imgCfg:     byName,
+			meta:       image.SourceMeta{ETag: `"abc"`},
+			wantAction: ActionReplace,
+			wantReason: "source changed",
+		},
+		{
+			name:       "metadata unavailable",
+			existing:   []images.Image{current},
+			imgCfg:     byName,
+			metaErr:    errors.New("HEAD failed: 503 Service Unavailable"),
+			wantAction: ActionReplace,
+			wantReason: "source metadata unavailable",
+		},
+		{
+			name:       "same version",
+			existing:   []images.Image{versioned},
+			imgCfg:     withVersion("20261012-1"),
+			meta:       image.SourceMeta{ETag: `"def"`},
+			wantAction: ActionSkipUnchanged,
+			wantReason: "source version matches",
+		},
+		{
+			name:       "new version wins over same etag",
+			existing:   []images.Image{versioned},
+			imgCfg:     withVersion("20261015-1"),
+			meta:       image.SourceMeta{ETag: `"abc"`},
+			wantAction: ActionReplace,
+			wantReason: "source version 20261015-1 replaces 20261012-1",
+		},
+		{
+			name:       "same version without metadata",
+			existing:   []images.Image{versioned},
+			imgCfg:     withVersion("20261012-1"),
+			metaErr:    errors.New("HEAD failed: 503 Service Unavailable"),
+			wantAction: ActionSkipUnchanged,
+			wantReason: "source version matches",
+		},
+		{
+			name:       "current image without version falls back to etag",
+			existing:   []images.Image{current},
+			imgCfg:     withVersion("20261015-1"),
+			meta:       image.SourceMeta{ETag: `"abc"`},
+			wantAction: ActionSkipUnchanged,
+			wantReason: "source etag matches",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tgt := &target{name: image.Target{Cloud: "test"}, existing: tt.existing, listErr: tt.listErr}
+			d := decide(tgt, tt.imgCfg, constraints{}, tt.meta, tt.metaErr)
+			if d.Action != tt.wantAction {
+				t.Errorf("decide() action = %s (%s), want %s", d.Action, d.Reason, tt.wantAction)
+			}
+			if !strings.Contains(d.Reason, tt.wantReason) {
+				t.Errorf("decide() reason = %q, want it to contain %q", d.Reason, tt.wantReason)
+			}
+			if d.MetaErr != tt.metaErr {
+				t.Errorf("decide() MetaErr = %v, want %v", d.MetaErr, tt.metaErr)
+			}
+		})
+	}
+}
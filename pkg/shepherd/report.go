@@ -0,0 +1,193 @@
+package shepherd
+
+import (
+	"encoding/json"
+	"os"
+	"time"
+)
+
+// Outcome classifies a result for summaries.
+type Outcome string
+
+const (
+	// OutcomeUploaded means a new version of the image was published.
+	OutcomeUploaded Outcome = "uploaded"
+	// OutcomeUnchanged means the current image was left alone.
+	OutcomeUnchanged Outcome = "unchanged"
+	// OutcomeFailed means the image could not be managed.
+	OutcomeFailed Outcome = "failed"
+	// OutcomeAborted means the image was not processed because the run
+	// stopped at an earlier failure.
+	OutcomeAborted Outcome = "aborted"
+)
+
+// Outcome returns how managing the image on its target turned out.
+func (r Result) Outcome() Outcome {
+	switch {
+	case r.Action == ActionAborted:
+		return OutcomeAborted
+	case r.Err != nil:
+		return OutcomeFailed
+	case r.Action == ActionSkipUnchanged:
+		return OutcomeUnchanged
+	default:
+		return OutcomeUploaded
+	}
+}
+
+// Summary counts the outcomes of a run.
+type Summary struct {
+	Uploaded  int `json:"uploaded"`
+	Unchanged int `json:"unchanged"`
+	Failed    int `json:"failed"`
+	Aborted   int `json:"aborted"`
+	Pruned    int `json:"pruned"`
+}
+
+// Summarize counts the outcomes of results.
+func Summarize(results []Result) Summary {
+	var s Summary
+	for _, r := range results {
+		s.Pruned += len(r.Pruned)
+		switch r.Outcome() {
+		case OutcomeFailed:
+			s.Failed++
+		case OutcomeAborted:
+			s.Aborted++
+		case OutcomeUnchanged:
+			s.Unchanged++
+		default:
+			s.Uploaded++
+		}
+	}
+	return s
+}
+
+// Status classifies a finished run.
+type Status string
+
+const (
+	// StatusSuccess means every image was uploaded or left unchanged.
+	StatusSuccess Status = "success"
+	// StatusPartialFailure means some images failed and others didn't.
+	StatusPartialFailure Status = "partial-failure"
+	// StatusFailure means no image was uploaded or left unchanged, or the run
+	// could not start at all.
+	StatusFailure Status = "failure"
+)
+
+// RunStatus classifies a run from the results and error returned by Run.
+func RunStatus(results []Result, err error) Status {
+	if err == nil {
+		return StatusSuccess
+	}
+	if s := Summarize(results); s.Uploaded+s.Unchanged > 0 {
+		return StatusPartialFailure
+	}
+	return StatusFailure
+}
+
+// Report is the machine-readable record of a run.
+type Report struct {
+	Started  time.Time     `json:"started"`
+	Finished time.Time     `json:"finished"`
+	Summary  Summary       `json:"summary"`
+	Images   []ImageReport `json:"images"`
+}
+
+// ImageReport is the record of one configured image on one target.
+type ImageReport struct {
+	Name       string  `json:"name"`
+	ConfigFile string  `json:"config_file,omitempty"`
+	Target     string  `json:"target"`
+	Outcome    Outcome `json:"outcome"`
+	Action     Action  `json:"action"`
+	Reason     string  `json:"reason"`
+	Error      string  `json:"error,omitempty"`
+
+	SourceURL           string `json:"source_url,omitempty"`
+	SourceVersion       string `json:"source_version,omitempty"`
+	SourceETag          string `json:"source_etag,omitempty"`
+	SourceLastModified  string `json:"source_last_modified,omitempty"`
+	SourceContentLength int64  `json:"source_content_length,omitempty"`
+
+	Method     string   `json:"upload_method,omitempty"`
+	PreviousID string   `json:"previous_id,omitempty"`
+	NewID      string   `json:"new_id,omitempty"`
+	HiddenID   string   `json:"hidden_id,omitempty"`
+	Pruned     []string `json:"pruned,omitempty"`
+
+	DownloadedBytes      int64  `json:"downloaded_bytes,omitempty"`
+	DownloadSHA256       string `json:"download_sha256,omitempty"`
+	ChecksumAlgorithm    string `json:"checksum_algorithm,omitempty"`
+	Checksum             string `json:"checksum,omitempty"`
+	UncompressedChecksum string `json:"uncompressed_checksum,omitempty"`
+	UploadedBytes        int64  `json:"uploaded_bytes,omitempty"`
+	ImageSHA256          string `json:"image_sha256,omitempty"`
+
+	Started time.Time `json:"started"`
+	// Durations are in seconds, by phase: download, decompress (part of
+	// download), convert, upload, prune and total
+	Durations map[string]float64 `json:"durations_seconds"`
+}
+
+// NewReport builds the report of a run that started and finished at the given
+// times.
+func NewReport(results []Result, started time.Time, finished time.Time) Report {
+	rep := Report{
+		Started:  started,
+		Finished: finished,
+		Summary:  Summarize(results),
+		Images:   make([]ImageReport, 0, len(results)),
+	}
+	for _, r := range results {
+		ir := ImageReport{
+			Name:                 r.Name,
+			ConfigFile:           r.ConfigFile,
+			Target:               r.Target.String(),
+			Outcome:              r.Outcome(),
+			Action:               r.Action,
+			Reason:               r.Reason,
+			SourceURL:            r.URL,
+			SourceVersion:        r.Version,
+			SourceETag:           r.Meta.ETag,
+			SourceLastModified:   r.Meta.LastModified,
+			SourceContentLength:  r.Meta.ContentLength,
+			Method:               r.Method,
+			PreviousID:           r.CurrentID,
+			NewID:                r.NewID,
+			HiddenID:             r.HiddenID,
+			Pruned:               r.Pruned,
+			DownloadedBytes:      r.Build.DownloadedBytes,
+			DownloadSHA256:       r.Build.DownloadSHA256,
+			ChecksumAlgorithm:    r.Build.ChecksumAlgorithm,
+			Checksum:             r.Build.Checksum,
+			UncompressedChecksum: r.Build.UncompressedChecksum,
+			ImageSHA256:          r.Build.ImageSHA256,
+			Started:              r.Started,
+			Durations:            map[string]float64{"total": r.Duration.Seconds()},
+		}
+		if r.Err != nil {
+			ir.Error = r.Err.Error()
+		}
+		if r.NewID != "" {
+			ir.UploadedBytes = r.Build.ImageBytes
+		}
+		for phase, d := range map[string]time.Duration{"download": r.Build.Download, "decompress": r.Build.Decompress, "convert": r.Build.Convert, "upload": r.Upload, "prune": r.Prune} {
+			if d > 0 {
+				ir.Durations[phase] = d.Seconds()
+			}
+		}
+		rep.Images = append(rep.Images, ir)
+	}
+	return rep
+}
+
+// WriteFile writes the report to a JSON file.
+func (rep Report) WriteFile(name string) error {
+	data, err := json.MarshalIndent(rep, "", "  ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(name, append(data, '\n'), 0o644)
+}
@@ -0,0 +1,142 @@
+package shepherd
+
+import (
+	"errors"
+	"testing"
+)
+
+// result returns the result of an image managed with the given action, which
+// failed with err if it is not nil.
+func result(name string, action Action, err error, pruned ...string) Result {
+	return Result{Decision: Decision{Name: name, Action: action}, Err: err, Pruned: pruned}
+}
+
+var errUpload = errors.New("upload image: 413 Request Entity Too Large")
+
+func TestSummarize(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		want    Summary
+	}{
+		{
+			name: "empty",
+		},
+		{
+			name: "every outcome",
+			results: []Result{
+				result("debian-13", ActionReplace, nil, "old-1", "old-2"),
+				result("ubuntu-24.04", ActionUploadNew, nil),
+				result("fedora-42", ActionSkipUnchanged, nil),
+				result("alpine-3.22", ActionReplace, errUpload),
+				result("rocky-10", ActionError, errors.New("could not list existing images")),
+				result("freebsd-14", ActionAborted, nil),
+			},
+			want: Summary{Uploaded: 2, Unchanged: 1, Failed: 2, Aborted: 1, Pruned: 2},
+		},
+		{
+			name: "failed after pruning",
+			results: []Result{
+				result("debian-13", ActionSkipUnchanged, errors.New("retention for debian-13: 1 image(s) could not be pruned"), "old-1"),
+			},
+			want: Summary{Failed: 1, Pruned: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Summarize(tt.results); got != tt.want {
+				t.Errorf("Summarize() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestResultOutcome(t *testing.T) {
+	tests := []struct {
+		result Result
+		want   Outcome
+	}{
+		{result("a", ActionUploadNew, nil), OutcomeUploaded},
+		{result("a", ActionReplace, nil), OutcomeUploaded},
+		{result("a", ActionSkipUnchanged, nil), OutcomeUnchanged},
+		{result("a", ActionReplace, errUpload), OutcomeFailed},
+		{result("a", ActionError, errUpload), OutcomeFailed},
+		{result("a", ActionAborted, nil), OutcomeAborted},
+	}
+	for _, tt := range tests {
+		if got := tt.result.Outcome(); got != tt.want {
+			t.Errorf("Outcome() of %s (err %v) = %s, want %s", tt.result.Action, tt.result.Err, got, tt.want)
+		}
+	}
+}
+
+func TestRunStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []Result
+		err     error
+		want    Status
+	}{
+		{
+			name:    "every image uploaded or unchanged",
+			results: []Result{result("debian-13", ActionReplace, nil), result("fedora-42", ActionSkipUnchanged, nil)},
+			want:    StatusSuccess,
+		},
+		{
+			name: "some images failed",
+			results: []Result{
+				result("debian-13", ActionReplace, nil),
+				result("alpine-3.22", ActionReplace, errUpload),
+			},
+			err:  errUpload,
+			want: StatusPartialFailure,
+		},
+		{
+			name: "only unchanged images succeeded",
+			results: []Result{
+				result("fedora-42", ActionSkipUnchanged, nil),
+				result("alpine-3.22", ActionReplace, errUpload),
+			},
+			err:  errUpload,
+			want: StatusPartialFailure,
+		},
+		{
+			name:    "every image failed",
+			results: []Result{result("debian-13", ActionReplace, errUpload), result("alpine-3.22", ActionError, errUpload)},
+			err:     errUpload,
+			want:    StatusFailure,
+		},
+		{
+			name: "fail-fast after the first image",
+			results: []Result{
+				result("alpine-3.22", ActionReplace, errUpload),
+				result("debian-13", ActionAborted, nil),
+				result("fedora-42", ActionAborted, nil),
+			},
+			err:  errUpload,
+			want: StatusFailure,
+		},
+		{
+			name: "fail-fast after some uploads",
+			results: []Result{
+				result("debian-13", ActionUploadNew, nil),
+				result("alpine-3.22", ActionReplace, errUpload),
+				result("fedora-42", ActionAborted, nil),
+			},
+			err:  errUpload,
+			want: StatusPartialFailure,
+		},
+		{
+			name: "run could not start",
+			err:  errors.New("no target could be listed"),
+			want: StatusFailure,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := RunStatus(tt.results, tt.err); got != tt.want {
+				t.Errorf("RunStatus() = %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
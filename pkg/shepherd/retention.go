@@ -0,0 +1,224 @@
+package shepherd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/gophercloud/gophercloud/v2"
+	"github.com/gophercloud/gophercloud/v2/openstack/blockstorage/v3/volumes"
+	"github.com/gophercloud/gophercloud/v2/openstack/compute/v2/servers"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+	"go.uber.org/zap"
+)
+
+// imageUsage reports whether an image is still in use. An error means usage
+// could not be determined and the image must be kept.
+type imageUsage interface {
+	inUse(id string) (bool, error)
+}
+
+// usageChecker reports whether an image is still referenced by a server or a
+// volume. Volumes can't be filtered by image, so they are listed once and
+// shared by all workers.
+type usageChecker struct {
+	compute      *gophercloud.ServiceClient
+	blockStorage *gophercloud.ServiceClient
+
+	once         sync.Once
+	volumeImages map[string]bool
+	volumeErr    error
+}
+
+func newUsageChecker(cl Clients) *usageChecker {
+	return &usageChecker{compute: cl.Compute, blockStorage: cl.BlockStorage}
+}
+
+// inUse reports whether any server or volume references the image. An error
+// means usage could not be determined and the image must be kept.
+func (u *usageChecker) inUse(id string) (bool, error) {
+	if u.compute == nil || u.blockStorage == nil {
+		return false, fmt.Errorf("compute and block storage clients are required to check image usage")
+	}
+
+	u.once.Do(u.loadVolumeImages)
+	if u.volumeErr != nil {
+		return false, u.volumeErr
+	}
+	if u.volumeImages[id] {
+		zap.S().Infow("Image is referenced by a volume", "id", id)
+		return true, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	pages, err := servers.List(u.compute, servers.ListOpts{Image: id, AllTenants: true}).AllPages(ctx)
+	if gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+		zap.S().Warnw("Not allowed to list servers of all projects; only checking servers in the current project", "id", id)
+		pages, err = servers.List(u.compute, servers.ListOpts{Image: id}).AllPages(ctx)
+	}
+	if err != nil {
+		return false, fmt.Errorf("list servers using image %s: %w", id, err)
+	}
+	found, err := servers.ExtractServers(pages)
+	if err != nil {
+		return false, fmt.Errorf("parse servers using image %s: %w", id, err)
+	}
+	if len(found) > 0 {
+		zap.S().Infow("Image is referenced by servers", "id", id, "server_count", len(found))
+		return true, nil
+	}
+	return false, nil
+}
+
+func (u *usageChecker) loadVolumeImages() {
+	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
+	defer cancel()
+	pages, err := volumes.List(u.blockStorage, volumes.ListOpts{AllTenants: true}).AllPages(ctx)
+	if gophercloud.ResponseCodeIs(err, http.StatusForbidden) {
+		zap.S().Warnw("Not allowed to list volumes of all projects; only checking volumes in the current project")
+		pages, err = volumes.List(u.blockStorage, volumes.ListOpts{}).AllPages(ctx)
+	}
+	if err != nil {
+		u.volumeErr = fmt.Errorf("list volumes: %w", err)
+		return
+	}
+	all, err := volumes.ExtractVolumes(pages)
+	if err != nil {
+		u.volumeErr = fmt.Errorf("parse volumes: %w", err)
+		return
+	}
+	u.volumeImages = map[string]bool{}
+	for _, v := range all {
+		if id := v.VolumeImageMetadata["image_id"]; id != "" {
+			u.volumeImages[id] = true
+		}
+	}
+	zap.S().Infow("Loaded volume image references", "volumes", len(all), "images", len(u.volumeImages))
+}
+
+// supersededVersions returns the hidden versions of imgCfg that image-shepherd
+// uploaded, newest first. hiddenID is the current image that was just renamed
+// and hidden during this run, if any.
+func supersededVersions(existing []images.Image, imgCfg image.Image, cons constraints, hiddenID string) []images.Image {
+	byProperties := matchesByProperties(imgCfg)
+	var versions []images.Image
+	for _, ex := range existing {
+		if !ex.Hidden && ex.ID != hiddenID {
+			continue
+		}
+		if isSnapshotOrBackup(&ex) {
+			continue
+		}
+		// Only ever touch images that image-shepherd uploaded itself
+		if su, _ := ex.Properties["source_url"].(string); su == "" {
+			continue
+		}
+		if cons.owner != "" && ex.Owner != cons.owner {
+			continue
+		}
+
+		match := false
+		if ex.ID == hiddenID {
+			// Our snapshot of the image predates its rename
+			match = true
+		} else if byProperties {
+			gd, _ := ex.Properties["os_distro"].(string)
+			gv, _ := ex.Properties["os_version"].(string)
+			gt, _ := ex.Properties["os_type"].(string)
+			arch, _ := ex.Properties["architecture"].(string)
+			match = gd == imgCfg.Properties["os_distro"] && gv == imgCfg.Properties["os_version"] && gt == imgCfg.Properties["os_type"] &&
+				arch == imgCfg.Properties["architecture"]
+			// Images of another family or architecture can share the OS
+			// properties, and their versions aren't ours to prune
+			if family := imgCfg.Properties["image_family"]; family != "" {
+				exFamily, _ := ex.Properties["image_family"].(string)
+				match = match && exFamily == family
+			}
+		} else {
+			family, _ := ex.Properties["image_family"].(string)
+			match = family == imgCfg.Properties["image_family"] && strings.HasPrefix(ex.Name, imgCfg.Name+"-")
+		}
+		if match {
+			versions = append(versions, ex)
+		}
+	}
+	sort.SliceStable(versions, func(a, b int) bool {
+		return versions[a].CreatedAt.After(versions[b].CreatedAt)
+	})
+	return versions
+}
+
+// prune deletes the superseded versions of imgCfg that fall outside its
+// retention policy and returns the IDs of the deleted images.
+func prune(c *gophercloud.ServiceClient, usage imageUsage, existing []images.Image, imgCfg image.Image, cons constraints, hiddenID string) ([]string, error) {
+	policy := imgCfg.Retention
+	maxAge, err := policy.MaxAgeDuration()
+	if err != nil {
+		return nil, err
+	}
+	if policy.Keep <= 0 && maxAge == 0 {
+		return nil, nil
+	}
+
+	versions := supersededVersions(existing, imgCfg, cons, hiddenID)
+	zap.S().Infow("Applying retention policy", "name", imgCfg.Name, "keep", policy.Keep, "max_age", policy.MaxAge, "hidden_versions", len(versions))
+
+	var deleted []string
+	victims, errs := prunable(versions, policy.Keep, maxAge, usage, time.Now())
+	for _, v := range victims {
+		if err := image.DeleteByID(c, v.ID, v.Protected); err != nil {
+			errs = append(errs, fmt.Errorf("delete image %s: %w", v.ID, err))
+			continue
+		}
+		deleted = append(deleted, v.ID)
+	}
+
+	if len(errs) > 0 {
+		return deleted, fmt.Errorf("retention for %s: %d image(s) could not be pruned: %w", imgCfg.Name, len(errs), errs[0])
+	}
+	return deleted, nil
+}
+
+// prunable returns the superseded versions, newest first, that fall outside
+// the newest keep versions or are older than maxAge at now, and that can be
+// deleted. Zero keep or maxAge means no limit. The errors are those of the
+// versions whose usage could not be determined, which are kept.
+func prunable(versions []images.Image, keep int, maxAge time.Duration, usage imageUsage, now time.Time) ([]images.Image, []error) {
+	var out []images.Image
+	var errs []error
+	for idx, v := range versions {
+		expired := maxAge > 0 && now.Sub(v.CreatedAt) > maxAge
+		surplus := keep > 0 && idx >= keep
+		if !expired && !surplus {
+			continue
+		}
+
+		// Only unprotect images that image-shepherd created protected. Anything
+		// else was protected by a person.
+		if marker, _ := v.Properties[image.ProtectedProperty].(string); v.Protected && marker != "true" {
+			zap.S().Warnw("Keeping superseded image protected outside of image-shepherd", "id", v.ID, "name", v.Name)
+			continue
+		}
+
+		used, err := usage.inUse(v.ID)
+		if err != nil {
+			zap.S().Warnw("Keeping superseded image; could not determine whether it is in use", "id", v.ID, "name", v.Name, "error", err)
+			errs = append(errs, err)
+			continue
+		}
+		if used {
+			zap.S().Infow("Keeping superseded image still in use", "id", v.ID, "name", v.Name)
+			continue
+		}
+
+		zap.S().Infow("Pruning superseded image", "id", v.ID, "name", v.Name, "created_at", v.CreatedAt, "expired", expired, "surplus", surplus)
+		out = append(out, v)
+	}
+	return out, errs
+}
@@ -0,0 +1,326 @@
+package shepherd
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/gophercloud/gophercloud/v2/openstack/image/v2/images"
+)
+
+// fakeUsage reports the images in used as in use, and fails for those in
+// failing.
+type fakeUsage struct {
+	used    map[string]bool
+	failing map[string]bool
+	checked []string
+}
+
+func (u *fakeUsage) inUse(id string) (bool, error) {
+	u.checked = append(u.checked, id)
+	if u.failing[id] {
+		return false, errors.New("list servers: forbidden")
+	}
+	return u.used[id], nil
+}
+
+var retentionNow = time.Date(2026, 10, 16, 12, 0, 0, 0, time.UTC)
+
+// hiddenVersion returns a superseded version of the image named name, uploaded
+// by image-shepherd the given number of days before retentionNow.
+func hiddenVersion(id string, name string, days int, properties map[string]any) images.Image {
+	props := map[string]any{"source_url": "https://example.com/" + name + ".qcow2", "image_family": name}
+	for k, v := range properties {
+		props[k] = v
+	}
+	created := retentionNow.Add(-time.Duration(days) * 24 * time.Hour)
+	return images.Image{
+		ID:         id,
+		Name:       name + "-" + created.Format("02-Jan-2006"),
+		Hidden:     true,
+		CreatedAt:  created,
+		Properties: props,
+	}
+}
+
+func ids(versions []images.Image) []string {
+	out := make([]string, len(versions))
+	for idx, v := range versions {
+		out[idx] = v.ID
+	}
+	return out
+}
+
+func TestSupersededVersions(t *testing.T) {
+	byName := image.Image{Name: "debian-13", Properties: map[string]string{"image_family": "debian-13"}}
+	byProperties := image.Image{Name: "Ubuntu 24.04", Properties: map[string]string{
+		"image_family": "Ubuntu 24.04", "os_distro": "ubuntu", "os_version": "24.04", "os_type": "linux", "architecture": "x86_64",
+	}}
+	ubuntu := func(edits ...string) map[string]any {
+		props := map[string]any{"image_family": "Ubuntu 24.04", "os_distro": "ubuntu", "os_version": "24.04", "os_type": "linux", "architecture": "x86_64"}
+		for idx := 0; idx+1 < len(edits); idx += 2 {
+			props[edits[idx]] = edits[idx+1]
+		}
+		return props
+	}
+
+	current := hiddenVersion("current", "debian-13", 0, nil)
+	current.Hidden = false
+	current.Name = "debian-13"
+	notOurs := hiddenVersion("manual", "debian-13", 5, nil)
+	delete(notOurs.Properties, "source_url")
+	otherOwner := hiddenVersion("other-owner", "debian-13", 6, nil)
+	otherOwner.Owner = "other-project"
+
+	tests := []struct {
+		name     string
+		existing []images.Image
+		imgCfg   image.Image
+		cons     constraints
+		hiddenID string
+		want     []string
+	}{
+		{
+			name: "by name, newest first",
+			existing: []images.Image{
+				hiddenVersion("old", "debian-13", 30, nil),
+				hiddenVersion("new", "debian-13", 1, nil),
+				hiddenVersion("mid", "debian-13", 10, nil),
+			},
+			imgCfg: byName,
+			want:   []string{"new", "mid", "old"},
+		},
+		{
+			name:     "current image is never a superseded version",
+			existing: []images.Image{current, hiddenVersion("old", "debian-13", 30, nil)},
+			imgCfg:   byName,
+			want:     []string{"old"},
+		},
+		{
+			name:     "image just hidden in this run",
+			existing: []images.Image{current, hiddenVersion("old", "debian-13", 30, nil)},
+			imgCfg:   byName,
+			hiddenID: "current",
+			want:     []string{"current", "old"},
+		},
+		{
+			name: "other family with the same name prefix",
+			existing: []images.Image{
+				hiddenVersion("minimal", "debian-13-minimal", 3, nil),
+				hiddenVersion("old", "debian-13", 30, nil),
+			},
+			imgCfg: byName,
+			want:   []string{"old"},
+		},
+		{
+			name: "same family under another name",
+			existing: []images.Image{
+				func() images.Image {
+					v := hiddenVersion("renamed", "debian-13", 3, nil)
+					v.Name = "debian-trixie-01-Oct-2026"
+					return v
+				}(),
+			},
+			imgCfg: byName,
+			want:   nil,
+		},
+		{
+			name:     "images not uploaded by image-shepherd",
+			existing: []images.Image{notOurs, hiddenVersion("old", "debian-13", 30, nil)},
+			imgCfg:   byName,
+			want:     []string{"old"},
+		},
+		{
+			name: "snapshots and backups",
+			existing: []images.Image{
+				hiddenVersion("snapshot", "debian-13", 2, map[string]any{"image_type": "snapshot"}),
+				hiddenVersion("backup", "debian-13", 3, map[string]any{"block_device_mapping": `[{"source_type": "backup"}]`}),
+				hiddenVersion("old", "debian-13", 30, nil),
+			},
+			imgCfg: byName,
+			want:   []string{"old"},
+		},
+		{
+			name:     "no owner constraint",
+			existing: []images.Image{otherOwner, hiddenVersion("old", "debian-13", 30, nil)},
+			imgCfg:   byName,
+			want:     []string{"other-owner", "old"},
+		},
+		{
+			name: "owner constraint excludes other projects",
+			existing: []images.Image{otherOwner, func() images.Image {
+				v := hiddenVersion("old", "debian-13", 30, nil)
+				v.Owner = "admin"
+				return v
+			}()},
+			imgCfg: byName,
+			cons:   constraints{owner: "admin"},
+			want:   []string{"old"},
+		},
+		{
+			name: "by properties, whatever the name",
+			existing: []images.Image{
+				hiddenVersion("noble", "Ubuntu Noble", 3, ubuntu()),
+				hiddenVersion("jammy", "Ubuntu 24.04", 4, ubuntu("os_version", "22.04")),
+				hiddenVersion("no-properties", "Ubuntu 24.04", 5, nil),
+			},
+			imgCfg: byProperties,
+			want:   []string{"noble"},
+		},
+		{
+			name: "by properties, other architecture or family",
+			existing: []images.Image{
+				hiddenVersion("arm64", "Ubuntu 24.04", 3, ubuntu("architecture", "aarch64")),
+				hiddenVersion("minimal", "Ubuntu 24.04 Minimal", 4, ubuntu("image_family", "Ubuntu 24.04 Minimal")),
+				hiddenVersion("no-architecture", "Ubuntu 24.04", 5, ubuntu("architecture", "")),
+				hiddenVersion("old", "Ubuntu 24.04", 30, ubuntu()),
+			},
+			imgCfg: byProperties,
+			want:   []string{"old"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := ids(supersededVersions(tt.existing, tt.imgCfg, tt.cons, tt.hiddenID))
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("supersededVersions() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrunable(t *testing.T) {
+	// Newest first, as returned by supersededVersions
+	versions := []images.Image{
+		hiddenVersion("v1", "debian-13", 1, nil),
+		hiddenVersion("v2", "debian-13", 10, nil),
+		hiddenVersion("v3", "debian-13", 40, nil),
+		hiddenVersion("v4", "debian-13", 100, nil),
+	}
+	withVersion := func(idx int, edit func(v *images.Image)) []images.Image {
+		out := slices.Clone(versions)
+		out[idx].Properties = map[string]any{}
+		for k, v := range versions[idx].Properties {
+			out[idx].Properties[k] = v
+		}
+		edit(&out[idx])
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		versions  []images.Image
+		keep      int
+		maxAge    time.Duration
+		used      []string
+		failing   []string
+		want      []string
+		wantErrs  int
+		wantCheck []string
+	}{
+		{
+			name:      "keep",
+			versions:  versions,
+			keep:      2,
+			want:      []string{"v3", "v4"},
+			wantCheck: []string{"v3", "v4"},
+		},
+		{
+			name:      "keep more than there are",
+			versions:  versions,
+			keep:      5,
+			want:      nil,
+			wantCheck: nil,
+		},
+		{
+			name:      "max age",
+			versions:  versions,
+			maxAge:    30 * 24 * time.Hour,
+			want:      []string{"v3", "v4"},
+			wantCheck: []string{"v3", "v4"},
+		},
+		{
+			name:      "keep or max age, whichever deletes more",
+			versions:  versions,
+			keep:      3,
+			maxAge:    7 * 24 * time.Hour,
+			want:      []string{"v2", "v3", "v4"},
+			wantCheck: []string{"v2", "v3", "v4"},
+		},
+		{
+			name:      "no limits",
+			versions:  versions,
+			want:      nil,
+			wantCheck: nil,
+		},
+		{
+			name:      "in use",
+			versions:  versions,
+			keep:      1,
+			used:      []string{"v2", "v4"},
+			want:      []string{"v3"},
+			wantCheck: []string{"v2", "v3", "v4"},
+		},
+		{
+			name:      "usage unknown",
+			versions:  versions,
+			keep:      2,
+			failing:   []string{"v3"},
+			want:      []string{"v4"},
+			wantErrs:  1,
+			wantCheck: []string{"v3", "v4"},
+		},
+		{
+			name: "protected outside of image-shepherd",
+			versions: withVersion(3, func(v *images.Image) {
+				v.Protected = true
+			}),
+			keep:      2,
+			want:      []string{"v3"},
+			wantCheck: []string{"v3"},
+		},
+		{
+			name: "protected by image-shepherd",
+			versions: withVersion(3, func(v *images.Image) {
+				v.Protected = true
+				v.Properties[image.ProtectedProperty] = "true"
+			}),
+			keep:      2,
+			want:      []string{"v3", "v4"},
+			wantCheck: []string{"v3", "v4"},
+		},
+		{
+			name: "marker without protection",
+			versions: withVersion(3, func(v *images.Image) {
+				v.Properties[image.ProtectedProperty] = "true"
+			}),
+			keep:      2,
+			want:      []string{"v3", "v4"},
+			wantCheck: []string{"v3", "v4"},
+		},
+	}
+	toSet := func(list []string) map[string]bool {
+		m := map[string]bool{}
+		for _, id := range list {
+			m[id] = true
+		}
+		return m
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			usage := &fakeUsage{used: toSet(tt.used), failing: toSet(tt.failing)}
+			got, errs := prunable(tt.versions, tt.keep, tt.maxAge, usage, retentionNow)
+			if !slices.Equal(ids(got), tt.want) {
+				t.Errorf("prunable() = %v, want %v", ids(got), tt.want)
+			}
+			if len(errs) != tt.wantErrs {
+				t.Errorf("prunable() errors = %v, want %d", errs, tt.wantErrs)
+			}
+			if !slices.Equal(usage.checked, tt.wantCheck) {
+				t.Errorf("usage checked for %v, want %v", usage.checked, tt.wantCheck)
+			}
+		})
+	}
+}
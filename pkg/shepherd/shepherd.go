@@ -2,9 +2,15 @@ package shepherd
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	"github.com/HackUCF/image-shepherd/pkg/image"
 	"github.com/gophercloud/gophercloud/v2"
@@ -12,27 +18,103 @@ import (
 	"go.uber.org/zap"
 )
 
-func Run(c *gophercloud.ServiceClient, imagesCfg []image.Image) {
-	// Fetch existing images once
-	zap.S().Infow("Fetching existing images", "phase", "list", "action", "start")
-	// Apply network timeouts
-	clientTimeout := 60 * time.Second
-	c.HTTPClient.Timeout = clientTimeout
-	zap.S().Infow("Applied HTTP client timeout", "timeout_seconds", clientTimeout.Seconds())
-	ctxList, cancel := context.WithTimeout(context.Background(), 60*time.Second)
-	defer cancel()
-	pages, err := images.List(c, images.ListOpts{}).AllPages(ctxList)
-	if err != nil {
-		zap.S().Errorw("Failed to list existing images", "error", err)
-		return
+// Clients holds the OpenStack service clients used by a run for one target.
+// Compute and BlockStorage are only needed when a retention policy is
+// configured; without them no superseded image is ever deleted.
+type Clients struct {
+	Image        *gophercloud.ServiceClient
+	Compute      *gophercloud.ServiceClient
+	BlockStorage *gophercloud.ServiceClient
+}
+
+// target is the state of one cloud/region shared by all workers of a run.
+type target struct {
+	name     image.Target
+	clients  Clients
+	existing []images.Image
+	listErr  error
+	usage    *usageChecker
+
+	importOnce    sync.Once
+	importMethods []string
+}
+
+// uploadMethod returns the method used to upload imgCfg to this target. The
+// import methods the target supports are only looked up once, and only if an
+// image asks for one.
+func (t *target) uploadMethod(imgCfg image.Image) string {
+	if imgCfg.ConfiguredUploadMethod() == image.UploadMethodUpload {
+		return image.UploadMethodUpload
 	}
-	existing, err := images.ExtractImages(pages)
-	if err != nil {
-		zap.S().Errorw("Failed to parse existing images", "error", err)
-		return
+	t.importOnce.Do(func() {
+		methods, err := image.ImportMethods(t.clients.Image)
+		if err != nil {
+			zap.S().Warnw("Failed to look up supported image import methods", "target", t.name.String(), "error", err)
+		}
+		zap.S().Infow("Supported image import methods", "target", t.name.String(), "methods", methods)
+		t.importMethods = methods
+	})
+	return imgCfg.UploadMethodFor(t.importMethods)
+}
+
+// connect lists the existing images of every target used by imagesCfg, once
+// per target. A target that can't be listed is kept with its error, so that
+// only the images published to it fail. An error is returned only if no target
+// could be listed at all.
+func connect(clients map[image.Target]Clients, imagesCfg []image.Image) (map[image.Target]*target, error) {
+	targets := map[image.Target]*target{}
+	var lastErr error
+	listed := 0
+	for _, imgCfg := range imagesCfg {
+		for _, name := range imgCfg.Targets {
+			if _, ok := targets[name]; ok {
+				continue
+			}
+			t := &target{name: name}
+			targets[name] = t
+			cl, ok := clients[name]
+			if !ok || cl.Image == nil {
+				t.listErr = fmt.Errorf("no image client for target %s; it could not be created", name)
+				lastErr = t.listErr
+				continue
+			}
+			t.clients = cl
+			t.usage = newUsageChecker(cl)
+			zap.S().Infow("Listing existing images on target", "target", name.String())
+			if t.existing, t.listErr = listExisting(cl.Image); t.listErr != nil {
+				lastErr = t.listErr
+				continue
+			}
+			listed++
+		}
 	}
-	zap.S().Infow("Fetched existing images", "count", len(existing))
+	if listed == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return targets, nil
+}
 
+// targetsOf returns the targets a configured image is published to, in the
+// order they are configured.
+func targetsOf(targets map[image.Target]*target, imgCfg image.Image) []*target {
+	out := make([]*target, 0, len(imgCfg.Targets))
+	for _, name := range imgCfg.Targets {
+		out = append(out, targets[name])
+	}
+	return out
+}
+
+// constraints restrict which existing images may be considered the current
+// version of a configured image.
+type constraints struct {
+	owner            string
+	requireProtected bool
+	requirePublic    bool
+}
+
+// loadConstraints reads the matching constraints propagated by the CLI through
+// the environment.
+func loadConstraints() constraints {
 	ownerFilter := strings.TrimSpace(os.Getenv("IMAGE_SHEPHERD_OWNER_PROJECT_ID"))
 	requireProtectedEnv := strings.TrimSpace(os.Getenv("IMAGE_SHEPHERD_REQUIRE_PROTECTED"))
 	requirePublicEnv := strings.TrimSpace(os.Getenv("IMAGE_SHEPHERD_REQUIRE_PUBLIC"))
@@ -43,120 +125,432 @@ func Run(c *gophercloud.ServiceClient, imagesCfg []image.Image) {
 	} else {
 		zap.S().Infow("No matching constraints configured (owner/protected/public)")
 	}
+	return constraints{owner: ownerFilter, requireProtected: requireProtected, requirePublic: requirePublic}
+}
 
-	for _, imgCfg := range imagesCfg {
-		zap.S().Infow("Managing image", "name", imgCfg.Name, "total_existing_images", len(existing))
+// listExisting fetches every image visible to the client.
+func listExisting(c *gophercloud.ServiceClient) ([]images.Image, error) {
+	zap.S().Infow("Fetching existing images", "phase", "list", "action", "start")
+	// The client bounds requests through their context, not HTTPClient.Timeout
+	ctxList, cancel := context.WithTimeout(context.Background(), 60*time.Second)
+	defer cancel()
+	pages, err := images.List(c, images.ListOpts{}).AllPages(ctxList)
+	if err != nil {
+		zap.S().Errorw("Failed to list existing images", "error", err)
+		return nil, err
+	}
+	existing, err := images.ExtractImages(pages)
+	if err != nil {
+		zap.S().Errorw("Failed to parse existing images", "error", err)
+		return nil, err
+	}
+	zap.S().Infow("Fetched existing images", "count", len(existing))
+	return existing, nil
+}
 
-		imgCfg.Init()
+// matchesByProperties reports whether the image should be matched using its
+// os_distro/os_version/os_type properties rather than its name.
+func matchesByProperties(imgCfg image.Image) bool {
+	return imgCfg.Properties["os_distro"] != "" &&
+		imgCfg.Properties["os_version"] != "" &&
+		imgCfg.Properties["os_type"] != ""
+}
+
+// findCurrent returns the current "latest" image matching either properties or
+// name (non-hidden), or nil if there is none.
+func findCurrent(existing []images.Image, imgCfg image.Image, cons constraints) *images.Image {
+	byProperties := matchesByProperties(imgCfg)
+	wantDistro := imgCfg.Properties["os_distro"]
+	wantVersion := imgCfg.Properties["os_version"]
+	wantType := imgCfg.Properties["os_type"]
 
-		// Get upstream metadata to determine if a new image was published
-		meta, metaErr := image.FetchSourceMeta(imgCfg.Url)
-		if metaErr != nil {
-			zap.S().Warnw("Could not fetch source metadata; proceeding", "url", imgCfg.Url, "image", imgCfg.Name, "error", metaErr)
+	if byProperties {
+		zap.S().Infow("Matching strategy: properties", "os_distro", wantDistro, "os_version", wantVersion, "os_type", wantType)
+	} else {
+		zap.S().Infow("Matching strategy: name", "name", imgCfg.Name)
+	}
+	for idx := range existing {
+		ex := &existing[idx]
+		if ex.Hidden {
+			continue
 		}
 
-		// Find current "latest" image matching either properties or name (non-hidden)
-		var current *images.Image
-		wantDistro, hasDistro := imgCfg.Properties["os_distro"]
-		wantVersion, hasVersion := imgCfg.Properties["os_version"]
-		wantType, hasType := imgCfg.Properties["os_type"]
+		// Explicitly exclude snapshots and backups to avoid managing user artifacts
+		if isSnapshotOrBackup(ex) {
+			continue
+		}
 
-		if hasDistro && hasVersion && hasType && wantDistro != "" && wantVersion != "" && wantType != "" {
-			zap.S().Infow("Matching strategy: properties", "os_distro", wantDistro, "os_version", wantVersion, "os_type", wantType)
+		match := false
+		if byProperties {
+			gd, _ := ex.Properties["os_distro"].(string)
+			gv, _ := ex.Properties["os_version"].(string)
+			gt, _ := ex.Properties["os_type"].(string)
+			match = (gd == wantDistro && gv == wantVersion && gt == wantType)
 		} else {
-			zap.S().Infow("Matching strategy: name", "name", imgCfg.Name)
+			match = (ex.Name == imgCfg.Name)
 		}
-		for idx := range existing {
-			ex := &existing[idx]
-			if ex.Hidden {
+		if match {
+			if cons.owner != "" && ex.Owner != cons.owner {
+				zap.S().Debugw("Skipping candidate due to owner mismatch", "id", ex.ID, "owner", ex.Owner, "expected_owner", cons.owner)
 				continue
 			}
-
-			// Explicitly exclude snapshots and backups to avoid managing user artifacts
-			if imgType, ok := ex.Properties["image_type"].(string); ok {
-				if strings.EqualFold(imgType, "snapshot") || strings.EqualFold(imgType, "backup") {
-					zap.S().Debugw("Skipping candidate identified as snapshot/backup", "id", ex.ID, "image_type", imgType)
-					continue
-				}
+			if cons.requireProtected && !ex.Protected {
+				zap.S().Debugw("Skipping candidate due to protection mismatch", "id", ex.ID, "protected", ex.Protected)
+				continue
 			}
-			if bdm, ok := ex.Properties["block_device_mapping"].(string); ok {
-				if strings.Contains(bdm, `"source_type": "snapshot"`) || strings.Contains(bdm, `"source_type": "backup"`) {
-					zap.S().Debugw("Skipping candidate identified as snapshot/backup via block_device_mapping", "id", ex.ID)
-					continue
-				}
+			if cons.requirePublic && ex.Visibility != images.ImageVisibilityPublic {
+				zap.S().Debugw("Skipping candidate due to visibility mismatch", "id", ex.ID, "visibility", ex.Visibility)
+				continue
 			}
+			return ex
+		}
+	}
+	return nil
+}
 
-			match := false
-			if hasDistro && hasVersion && hasType &&
-				wantDistro != "" && wantVersion != "" && wantType != "" {
-				gd, _ := ex.Properties["os_distro"].(string)
-				gv, _ := ex.Properties["os_version"].(string)
-				gt, _ := ex.Properties["os_type"].(string)
-				match = (gd == wantDistro && gv == wantVersion && gt == wantType)
-			} else {
-				match = (ex.Name == imgCfg.Name)
-			}
-			if match {
-				if ownerFilter != "" && ex.Owner != ownerFilter {
-					zap.S().Debugw("Skipping candidate due to owner mismatch", "id", ex.ID, "owner", ex.Owner, "expected_owner", ownerFilter)
-					continue
-				}
-				if requireProtected && !ex.Protected {
-					zap.S().Debugw("Skipping candidate due to protection mismatch", "id", ex.ID, "protected", ex.Protected)
-					continue
-				}
-				if requirePublic && ex.Visibility != images.ImageVisibilityPublic {
-					zap.S().Debugw("Skipping candidate due to visibility mismatch", "id", ex.ID, "visibility", ex.Visibility)
-					continue
-				}
-				current = ex
-				break
-			}
+// isSnapshotOrBackup reports whether an existing image is a user snapshot or
+// backup, which image-shepherd must never manage.
+func isSnapshotOrBackup(ex *images.Image) bool {
+	if imgType, ok := ex.Properties["image_type"].(string); ok {
+		if strings.EqualFold(imgType, "snapshot") || strings.EqualFold(imgType, "backup") {
+			zap.S().Debugw("Skipping candidate identified as snapshot/backup", "id", ex.ID, "image_type", imgType)
+			return true
 		}
+	}
+	if bdm, ok := ex.Properties["block_device_mapping"].(string); ok {
+		if strings.Contains(bdm, `"source_type": "snapshot"`) || strings.Contains(bdm, `"source_type": "backup"`) {
+			zap.S().Debugw("Skipping candidate identified as snapshot/backup via block_device_mapping", "id", ex.ID)
+			return true
+		}
+	}
+	return false
+}
 
-		// Decide if the source is newer than what we already have
-		unchanged := false
-		reason := ""
-		if current != nil {
-			zap.S().Infow("Found current image candidate", "id", current.ID, "name", current.Name)
-			if meta.ETag != "" {
-				if et, ok := current.Properties["source_etag"].(string); ok && et != "" && et == meta.ETag {
-					unchanged = true
-					reason = "etag"
-				}
+// unchangedReason compares the upstream metadata with the properties recorded
+// on the current image. It returns the name of the matching validator, or an
+// empty string if the source appears to have changed.
+func unchangedReason(current *images.Image, meta image.SourceMeta) string {
+	if meta.ETag != "" {
+		if et, ok := current.Properties["source_etag"].(string); ok && et != "" && et == meta.ETag {
+			return "etag"
+		}
+	}
+	if meta.LastModified != "" {
+		if lm, ok := current.Properties["source_last_modified"].(string); ok && lm != "" && lm == meta.LastModified {
+			return "last_modified"
+		}
+	}
+	return ""
+}
+
+// Result is the outcome of managing a single configured image on one target.
+type Result struct {
+	Decision
+	// Err is set when the upload or the rename/hide of the previous image failed.
+	Err error
+	// Pruned lists the superseded images deleted by the retention policy.
+	Pruned []string
+
+	// Method is the upload method used, NewID the ID of the uploaded image and
+	// HiddenID the ID of the previous image it replaced, if any.
+	Method   string
+	NewID    string
+	HiddenID string
+	// Build describes the download and conversion of the image, which is
+	// shared by every target it was built for. It is empty for web-download.
+	Build image.BuildStats
+	// Upload is how long publishing to this target took, including the
+	// import, and Prune how long applying the retention policy took.
+	Upload time.Duration
+	Prune  time.Duration
+	// Started is when the image started being managed and Duration how long
+	// managing it took on all of its targets.
+	Started  time.Time
+	Duration time.Duration
+}
+
+// concurrency returns the number of images to process in parallel, as
+// propagated by the CLI through the environment.
+func concurrency() int {
+	if v := os.Getenv("IMAGE_SHEPHERD_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			return n
+		}
+	}
+	return 1
+}
+
+// failFast reports whether a run stops at the first failed image, as
+// propagated by the CLI through the environment.
+func failFast() bool {
+	v := strings.TrimSpace(os.Getenv("IMAGE_SHEPHERD_FAIL_FAST"))
+	return strings.EqualFold(v, "true") || v == "1" || strings.EqualFold(v, "yes")
+}
+
+// workDirName turns an image name into a safe prefix for its working directory.
+func workDirName(name string) string {
+	clean := strings.Map(func(r rune) rune {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) || r == '.' || r == '-' || r == '_' {
+			return r
+		}
+		return '_'
+	}, name)
+	return "image-shepherd-" + clean + "-"
+}
+
+// manage decides what to do with a single configured image on each of its
+// targets, builds the image once if any target needs it, publishes it to those
+// targets and applies the image's retention policy. It returns one result per
+// target.
+func manage(targets []*target, imgCfg image.Image, cons constraints) []Result {
+	// Get upstream metadata to determine if a new image was published
+	meta, metaErr := image.FetchSourceMeta(imgCfg.Url)
+	if metaErr != nil {
+		zap.S().Warnw("Could not fetch source metadata; proceeding", "url", imgCfg.Url, "image", imgCfg.Name, "error", metaErr)
+	}
+
+	results := make([]Result, len(targets))
+	var pending []int
+	for idx, t := range targets {
+		results[idx] = Result{Decision: decide(t, imgCfg, cons, meta, metaErr)}
+		r := &results[idx]
+		switch r.Action {
+		case ActionError:
+			zap.S().Errorw("Cannot manage image on target", "name", imgCfg.Name, "target", t.name.String(), "reason", r.Reason)
+			r.Err = t.listErr
+		case ActionSkipUnchanged:
+			zap.S().Infow("Image unchanged; skipping upload", "name", imgCfg.Name, "target", t.name.String(), "reason", r.Reason, "source_etag", meta.ETag, "source_last_modified", meta.LastModified)
+		default:
+			pending = append(pending, idx)
+		}
+	}
+
+	// Targets that import straight from the source don't need a local build
+	var local []int
+	for _, idx := range pending {
+		results[idx].Method = targets[idx].uploadMethod(imgCfg)
+		if results[idx].Method == image.UploadMethodWebDownload {
+			publish(targets[idx], imgCfg, nil, &results[idx])
+		} else {
+			local = append(local, idx)
+		}
+	}
+	if len(local) > 0 {
+		publishLocal := func(a *image.Artifact) {
+			for _, idx := range local {
+				publish(targets[idx], imgCfg, a, &results[idx])
 			}
-			if !unchanged && meta.LastModified != "" {
-				if lm, ok := current.Properties["source_last_modified"].(string); ok && lm != "" && lm == meta.LastModified {
-					unchanged = true
-					reason = "last_modified"
-				}
+			for _, idx := range local {
+				results[idx].Build = a.Stats
+			}
+		}
+		// An image published to a single target can be streamed to it without
+		// being written to disk
+		stream := len(local) == 1
+		err := build(imgCfg, meta, stream, publishLocal)
+		if err == nil && stream && errors.Is(results[local[0]].Err, image.ErrSourceChanged) {
+			// The partly streamed image was deleted; download it again from zero
+			zap.S().Warnw("Source changed while streaming; building the image again without streaming", "name", imgCfg.Name)
+			results[local[0]].Err = nil
+			err = build(imgCfg, meta, false, publishLocal)
+		}
+		if err != nil {
+			for _, idx := range local {
+				results[idx].Err = err
 			}
-		} else {
-			zap.S().Infow("No current image found; will upload", "name", imgCfg.Name)
 		}
+	}
 
-		if unchanged {
-			zap.S().Infow("Image unchanged; skipping upload", "name", imgCfg.Name, "reason", reason, "source_etag", meta.ETag, "source_last_modified", meta.LastModified)
+	if imgCfg.Retention == nil {
+		return results
+	}
+	for idx, t := range targets {
+		if results[idx].Err != nil || t.listErr != nil {
 			continue
 		}
+		pruneStart := time.Now()
+		pruned, err := prune(t.clients.Image, t.usage, t.existing, imgCfg, cons, results[idx].HiddenID)
+		results[idx].Pruned = pruned
+		results[idx].Prune = time.Since(pruneStart)
+		if err != nil {
+			zap.S().Errorw("Failed to apply retention policy", "name", imgCfg.Name, "target", t.name.String(), "error", err)
+		} else if len(pruned) > 0 {
+			zap.S().Infow("Retention policy applied", "name", imgCfg.Name, "target", t.name.String(), "pruned", pruned)
+		}
+	}
+	return results
+}
 
-		if err := imgCfg.Upload(c, meta); err != nil {
-			zap.S().Errorw("Upload failed", "name", imgCfg.Name, "error", err)
-			if strings.Contains(err.Error(), "no space left on device") {
-				zap.S().Fatal("Exiting due to no space left on device")
-			}
-		} else {
-			zap.S().Infow("Upload complete", "name", imgCfg.Name)
-			if current != nil {
-				zap.S().Infow("Renaming/hiding previous image", "previous_id", current.ID, "previous_name", current.Name)
-				if err := image.RenameHideByID(c, current.ID); err != nil {
-					zap.S().Errorw("Failed to rename/hide previous image", "id", current.ID, "error", err)
+// build downloads and converts the image in a private working directory and
+// calls publish with the result before the working directory is removed. If
+// stream is set and the image doesn't need to be converted, the artifact is
+// streamed from the source instead, and publish must only publish it once.
+func build(imgCfg image.Image, meta image.SourceMeta, stream bool, publish func(a *image.Artifact)) error {
+	// Each image gets its own working directory so parallel downloads and
+	// conversions never collide on file names.
+	workDir, err := os.MkdirTemp(".", workDirName(imgCfg.Name))
+	if err != nil {
+		zap.S().Errorw("Failed to create working directory", "name", imgCfg.Name, "error", err)
+		return err
+	}
+	defer func() {
+		if err := os.RemoveAll(workDir); err != nil {
+			zap.S().Warnw("Failed to remove working directory", "dir", workDir, "error", err)
+		}
+	}()
+
+	var a *image.Artifact
+	if stream {
+		a, err = imgCfg.BuildStream(meta, workDir)
+	} else {
+		a, err = imgCfg.Build(meta, workDir)
+	}
+	if err != nil {
+		zap.S().Errorw("Build failed", "name", imgCfg.Name, "error", err)
+		if strings.Contains(err.Error(), "no space left on device") {
+			zap.S().Fatal("Exiting due to no space left on device")
+		}
+		return err
+	}
+	defer a.Close()
+
+	publish(a)
+	return nil
+}
+
+// publish uploads an image to one target with the upload method of r and
+// hides the previous version, recording the outcome in r. a is the built
+// image, which web-download doesn't need.
+func publish(t *target, imgCfg image.Image, a *image.Artifact, r *Result) {
+	started := time.Now()
+	defer func() { r.Upload = time.Since(started) }()
+
+	var err error
+	if r.Method == image.UploadMethodWebDownload {
+		r.NewID, err = imgCfg.WebDownload(t.clients.Image, r.Meta)
+	} else {
+		r.NewID, err = imgCfg.Publish(t.clients.Image, a, r.Method)
+	}
+	if err != nil {
+		zap.S().Errorw("Upload failed", "name", imgCfg.Name, "target", t.name.String(), "method", r.Method, "error", err)
+		if strings.Contains(err.Error(), "no space left on device") {
+			zap.S().Fatal("Exiting due to no space left on device")
+		}
+		r.Err = err
+		return
+	}
+
+	zap.S().Infow("Upload complete", "name", imgCfg.Name, "target", t.name.String(), "method", r.Method, "id", r.NewID)
+	if r.CurrentID != "" {
+		zap.S().Infow("Renaming/hiding previous image", "target", t.name.String(), "previous_id", r.CurrentID, "previous_name", r.CurrentName)
+		if err := image.RenameHideByID(t.clients.Image, r.CurrentID); err != nil {
+			zap.S().Errorw("Failed to rename/hide previous image", "target", t.name.String(), "id", r.CurrentID, "error", err)
+			r.Err = fmt.Errorf("rename/hide previous image %s: %w", r.CurrentID, err)
+			return
+		}
+		zap.S().Infow("Previous image renamed/hidden", "target", t.name.String(), "id", r.CurrentID)
+		r.HiddenID = r.CurrentID
+		return
+	}
+	zap.S().Infow("No previous image to rename/hide", "target", t.name.String())
+}
+
+// Run manages every configured image on each of its targets, processing up to
+// IMAGE_SHEPHERD_CONCURRENCY images in parallel. Each image is downloaded and
+// converted once, however many targets it is published to. It returns one
+// result per image and target, in configuration order, and an error joining
+// the errors of every failed result.
+//
+// With IMAGE_SHEPHERD_FAIL_FAST set, no further image is started once one has
+// failed. Images already in progress are finished, and the ones never started
+// are reported as aborted.
+func Run(clients map[image.Target]Clients, imagesCfg []image.Image) ([]Result, error) {
+	// Fetch existing images once per target
+	targets, err := connect(clients, imagesCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	cons := loadConstraints()
+	stopOnFailure := failFast()
+	var failed atomic.Bool
+
+	workers := concurrency()
+	if workers > len(imagesCfg) {
+		workers = len(imagesCfg)
+	}
+	zap.S().Infow("Starting workers", "workers", workers, "image_count", len(imagesCfg), "target_count", len(targets))
+
+	results := make([][]Result, len(imagesCfg))
+	jobs := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				started := time.Now()
+				imgCfg := imagesCfg[idx]
+				imgTargets := targetsOf(targets, imgCfg)
+				if stopOnFailure && failed.Load() {
+					zap.S().Warnw("Skipping image after an earlier failure", "name", imgCfg.Name)
+					for _, t := range imgTargets {
+						results[idx] = append(results[idx], aborted(imgCfg, t.name))
+					}
+					continue
+				}
+				zap.S().Infow("Managing image", "name", imgCfg.Name, "targets", len(imgTargets))
+				if err := prepare(&imgCfg); err != nil {
+					zap.S().Errorw("Failed to resolve image source", "name", imgCfg.Name, "error", err)
+					for _, t := range imgTargets {
+						d := unresolved(imgCfg, err)
+						d.Target = t.name
+						results[idx] = append(results[idx], Result{Decision: d, Err: err})
+					}
 				} else {
-					zap.S().Infow("Previous image renamed/hidden", "id", current.ID)
+					results[idx] = manage(imgTargets, imgCfg, cons)
+				}
+				for r := range results[idx] {
+					results[idx][r].Started = started
+					results[idx][r].Duration = time.Since(started)
+					if results[idx][r].Err != nil {
+						failed.Store(true)
+					}
 				}
-			} else {
-				zap.S().Infow("No previous image to rename/hide")
+			}
+		}()
+	}
+	for idx := range imagesCfg {
+		jobs <- idx
+	}
+	close(jobs)
+	wg.Wait()
+
+	var all []Result
+	var errs []error
+	for _, r := range results {
+		all = append(all, r...)
+		for _, res := range r {
+			if res.Err != nil {
+				name := res.Name
+				if res.ConfigFile != "" {
+					name = fmt.Sprintf("%s (%s)", res.Name, res.ConfigFile)
+				}
+				errs = append(errs, fmt.Errorf("%s on %s: %w", name, res.Target, res.Err))
 			}
 		}
 	}
+	return all, errors.Join(errs...)
+}
+
+// aborted is the result for an image on a target that was never processed
+// because the run stopped at an earlier failure.
+func aborted(imgCfg image.Image, t image.Target) Result {
+	return Result{Decision: Decision{
+		Name:       imgCfg.Name,
+		ConfigFile: imgCfg.ConfigFile,
+		Target:     t,
+		Action:     ActionAborted,
+		Reason:     "not processed after an earlier failure",
+	}}
 }
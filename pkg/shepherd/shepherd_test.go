@@ -0,0 +1,302 @@
+package shepherd
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/HackUCF/image-shepherd/pkg/image"
+	"github.com/gophercloud/gophercloud/v2"
+)
+
+// cloud is a stub of the Glance v2 API of one target.
+type cloud struct {
+	mu sync.Mutex
+	// existing are the images listed before the run
+	existing []map[string]any
+	// down makes every request fail
+	down bool
+
+	// uploaded counts the image data uploads by image name, and hidden lists
+	// the images that were renamed and hidden
+	names    map[string]string
+	uploaded map[string]int
+	hidden   []string
+}
+
+func (c *cloud) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.down {
+		http.Error(w, "cloud is down", http.StatusServiceUnavailable)
+		return
+	}
+	if c.names == nil {
+		c.names, c.uploaded = map[string]string{}, map[string]int{}
+	}
+
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/images/"), "/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/v2/images":
+		writeJSON(w, http.StatusOK, map[string]any{"images": c.existing})
+	case r.Method == http.MethodPost && r.URL.Path == "/v2/images":
+		var body struct{ Name string }
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		id := fmt.Sprintf("new-%d", len(c.names)+1)
+		c.names[id] = body.Name
+		writeJSON(w, http.StatusCreated, map[string]any{"id": id, "name": body.Name, "status": "queued"})
+	case r.Method == http.MethodPut && sub == "file":
+		_, _ = io.Copy(io.Discard, r.Body)
+		c.uploaded[c.names[id]]++
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodGet && sub == "":
+		for _, img := range c.existing {
+			if img["id"] == id {
+				writeJSON(w, http.StatusOK, img)
+				return
+			}
+		}
+		http.NotFound(w, r)
+	case r.Method == http.MethodPatch && sub == "":
+		c.hidden = append(c.hidden, id)
+		writeJSON(w, http.StatusOK, map[string]any{"id": id, "os_hidden": true})
+	default:
+		http.Error(w, "unexpected request", http.StatusNotImplemented)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, code int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// serveCloud starts c and returns the clients of a target backed by it.
+func serveCloud(t *testing.T, c *cloud) Clients {
+	t.Helper()
+	srv := httptest.NewServer(c)
+	t.Cleanup(srv.Close)
+	return Clients{Image: &gophercloud.ServiceClient{
+		ProviderClient: &gophercloud.ProviderClient{HTTPClient: *srv.Client()},
+		Endpoint:       srv.URL + "/",
+		ResourceBase:   srv.URL + "/v2/",
+	}}
+}
+
+// mirror serves raw disk images by path. With parallel set, each download is
+// held until that many are in progress at once, or a few seconds have passed.
+type mirror struct {
+	files    map[string][]byte
+	parallel int
+
+	mu          sync.Mutex
+	cond        *sync.Cond
+	downloads   map[string]int
+	inFlight    int
+	maxInFlight int
+	released    bool
+}
+
+func (m *mirror) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	content, ok := m.files[r.URL.Path]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method == http.MethodGet {
+		m.mu.Lock()
+		m.downloads[r.URL.Path]++
+		m.inFlight++
+		m.maxInFlight = max(m.maxInFlight, m.inFlight)
+		if m.inFlight >= m.parallel {
+			m.released = true
+			m.cond.Broadcast()
+		}
+		for !m.released {
+			m.cond.Wait()
+		}
+		m.mu.Unlock()
+		defer func() {
+			m.mu.Lock()
+			m.inFlight--
+			m.mu.Unlock()
+		}()
+	}
+	http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(content))
+}
+
+// serveMirror starts a mirror of files and returns it with its URL.
+func serveMirror(t *testing.T, parallel int, files ...string) (*mirror, string) {
+	t.Helper()
+	m := &mirror{files: map[string][]byte{}, parallel: parallel, downloads: map[string]int{}}
+	m.cond = sync.NewCond(&m.mu)
+	for _, name := range files {
+		m.files["/"+name] = bytes.Repeat([]byte(name), 1024)
+	}
+	srv := httptest.NewServer(m)
+	t.Cleanup(srv.Close)
+	// Never hold a download for good, even if fewer ever run at once
+	timer := time.AfterFunc(5*time.Second, func() {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		m.released = true
+		m.cond.Broadcast()
+	})
+	t.Cleanup(func() { timer.Stop() })
+	return m, srv.URL
+}
+
+// rawImage returns the configuration of a raw image published to targets.
+func rawImage(name string, url string, targets ...image.Target) image.Image {
+	return image.Image{Name: name, Url: url, SourceFormat: "raw", Targets: targets}
+}
+
+// outcomes returns "name on target: outcome" for each result.
+func outcomes(results []Result) []string {
+	out := make([]string, len(results))
+	for idx, r := range results {
+		out[idx] = fmt.Sprintf("%s on %s: %s", r.Name, r.Target, r.Outcome())
+	}
+	return out
+}
+
+func TestRunConcurrency(t *testing.T) {
+	t.Setenv("IMAGE_SHEPHERD_CONCURRENCY", "3")
+	t.Setenv("IMAGE_SHEPHERD_FAIL_FAST", "false")
+	m, url := serveMirror(t, 3, "a.raw", "b.raw", "c.raw", "d.raw")
+	prod := image.Target{Cloud: "prod"}
+	c := &cloud{}
+	clients := map[image.Target]Clients{prod: serveCloud(t, c)}
+
+	var imagesCfg []image.Image
+	for _, name := range []string{"a", "b", "c", "d"} {
+		imagesCfg = append(imagesCfg, rawImage(name, url+"/"+name+".raw", prod))
+	}
+	results, err := Run(clients, imagesCfg)
+	if err != nil {
+		t.Fatalf("Run() error = %v", err)
+	}
+
+	// Results come in configuration order, whichever image finished first
+	want := []string{"a on prod: uploaded", "b on prod: uploaded", "c on prod: uploaded", "d on prod: uploaded"}
+	if got := outcomes(results); !slices.Equal(got, want) {
+		t.Errorf("Run() = %v, want %v", got, want)
+	}
+	if m.maxInFlight != 3 {
+		t.Errorf("downloaded %d images at once, want 3", m.maxInFlight)
+	}
+	for _, name := range []string{"a", "b", "c", "d"} {
+		if c.uploaded[name] != 1 {
+			t.Errorf("uploaded %s %d times, want once", name, c.uploaded[name])
+		}
+	}
+}
+
+func TestRunFailFast(t *testing.T) {
+	t.Setenv("IMAGE_SHEPHERD_CONCURRENCY", "1")
+	t.Setenv("IMAGE_SHEPHERD_FAIL_FAST", "true")
+	_, url := serveMirror(t, 1, "a.raw", "b.raw", "c.raw")
+	prod := image.Target{Cloud: "prod"}
+	staging := image.Target{Cloud: "staging"}
+	c := &cloud{}
+	client := serveCloud(t, c)
+	clients := map[image.Target]Clients{prod: client, staging: client}
+
+	// b fails its checksum verification
+	corrupt := rawImage("b", url+"/b.raw", prod)
+	corrupt.Checksum = &image.Checksum{Value: strings.Repeat("0", 64)}
+	imagesCfg := []image.Image{
+		rawImage("a", url+"/a.raw", prod),
+		corrupt,
+		rawImage("c", url+"/c.raw", prod, staging),
+	}
+	results, err := Run(clients, imagesCfg)
+	if err == nil || !strings.Contains(err.Error(), "b on prod") {
+		t.Fatalf("Run() error = %v, want b to fail", err)
+	}
+
+	// An aborted image is reported on each of its targets
+	want := []string{"a on prod: uploaded", "b on prod: failed", "c on prod: aborted", "c on staging: aborted"}
+	if got := outcomes(results); !slices.Equal(got, want) {
+		t.Errorf("Run() = %v, want %v", got, want)
+	}
+	if c.uploaded["c"] != 0 {
+		t.Errorf("uploaded c after b failed")
+	}
+	if status := RunStatus(results, err); status != StatusPartialFailure {
+		t.Errorf("RunStatus() = %s, want %s", status, StatusPartialFailure)
+	}
+}
+
+func TestRunTargets(t *testing.T) {
+	t.Setenv("IMAGE_SHEPHERD_CONCURRENCY", "1")
+	t.Setenv("IMAGE_SHEPHERD_FAIL_FAST", "false")
+	m, url := serveMirror(t, 1, "debian-13.raw", "alpine-3.22.raw")
+	east, west := image.Target{Cloud: "prod", Region: "east"}, image.Target{Cloud: "prod", Region: "west"}
+	down, missing := image.Target{Cloud: "down"}, image.Target{Cloud: "missing"}
+
+	eastCloud := &cloud{existing: []map[string]any{
+		{"id": "old", "name": "debian-13", "status": "active", "uploaded": "01-Oct-2026"},
+	}}
+	westCloud := &cloud{}
+	clients := map[image.Target]Clients{
+		east: serveCloud(t, eastCloud),
+		west: serveCloud(t, westCloud),
+		down: serveCloud(t, &cloud{down: true}),
+	}
+
+	imagesCfg := []image.Image{
+		rawImage("debian-13", url+"/debian-13.raw", east, west, down, missing),
+		rawImage("alpine-3.22", url+"/alpine-3.22.raw", west),
+	}
+	results, err := Run(clients, imagesCfg)
+	if err == nil || !strings.Contains(err.Error(), "debian-13 on down") || !strings.Contains(err.Error(), "debian-13 on missing") {
+		t.Fatalf("Run() error = %v, want debian-13 to fail on down and missing", err)
+	}
+
+	// A target that can't be listed only fails the images published to it
+	want := []string{
+		"debian-13 on prod/east: uploaded",
+		"debian-13 on prod/west: uploaded",
+		"debian-13 on down: failed",
+		"debian-13 on missing: failed",
+		"alpine-3.22 on prod/west: uploaded",
+	}
+	if got := outcomes(results); !slices.Equal(got, want) {
+		t.Errorf("Run() = %v, want %v", got, want)
+	}
+	if results[0].Action != ActionReplace || results[1].Action != ActionUploadNew {
+		t.Errorf("actions = %s, %s, want %s, %s", results[0].Action, results[1].Action, ActionReplace, ActionUploadNew)
+	}
+
+	// The image is downloaded once and uploaded to each target that can take it
+	if n := m.downloads["/debian-13.raw"]; n != 1 {
+		t.Errorf("downloaded debian-13 %d times, want once", n)
+	}
+	if eastCloud.uploaded["debian-13"] != 1 || westCloud.uploaded["debian-13"] != 1 {
+		t.Errorf("uploaded debian-13 %d times to east and %d times to west, want once each", eastCloud.uploaded["debian-13"], westCloud.uploaded["debian-13"])
+	}
+	if !slices.Equal(eastCloud.hidden, []string{"old"}) || len(westCloud.hidden) != 0 {
+		t.Errorf("hid %v on east and %v on west, want [old] and none", eastCloud.hidden, westCloud.hidden)
+	}
+	if results[0].HiddenID != "old" || results[0].NewID == "" {
+		t.Errorf("east result hid %q for %q, want old for the new image", results[0].HiddenID, results[0].NewID)
+	}
+}
+
+func TestRunNoTargets(t *testing.T) {
+	down := image.Target{Cloud: "down"}
+	clients := map[image.Target]Clients{down: serveCloud(t, &cloud{down: true})}
+	_, err := Run(clients, []image.Image{rawImage("debian-13", "https://example.com/debian-13.raw", down)})
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Run() error = %v, want the listing error", err)
+	}
+}